@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+
+	database "fucku/internal/database"
+	rbac "fucku/internal/rbac"
+	users "fucku/internal/users"
+	"fucku/pkg"
+
+	"github.com/joho/godotenv"
+)
+
+// Runs a one-off command against the database, e.g.
+//
+//	go run . seed-admin -email admin@example.com -username admin -password 1Secret1
+//	go run . migrate status
+func runCommand(ctx context.Context, args []string, w io.Writer) error {
+	logger := pkg.NewLogger("app.log", slog.LevelInfo)
+	slog.SetDefault(logger)
+
+	switch args[0] {
+	case "seed-admin":
+		return seedAdminCommand(ctx, logger, args[1:], w)
+	case "migrate":
+		return migrateCommand(ctx, logger, args[1:], w)
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+func seedAdminCommand(ctx context.Context, logger *slog.Logger, args []string, w io.Writer) error {
+	// Missing .env is fine here, flags can provide everything
+	godotenv.Load()
+
+	fs := flag.NewFlagSet("seed-admin", flag.ContinueOnError)
+	email := fs.String("email", os.Getenv("ADMIN_EMAIL"), "email of the admin")
+	username := fs.String("username", os.Getenv("ADMIN_USERNAME"), "username, only used when the user does not exist yet")
+	password := fs.String("password", os.Getenv("ADMIN_PASSWORD"), "password, only used when the user does not exist yet")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *email == "" {
+		return fmt.Errorf("seed-admin: -email is required")
+	}
+
+	db, err := database.NewDatabase(os.Getenv("DB_URL"))
+	if err != nil {
+		return err
+	}
+	defer db.DBPool.Close()
+
+	if err = setupApp(ctx, db, logger); err != nil {
+		return err
+	}
+
+	if err = rbac.SeedRoles(ctx, db); err != nil {
+		return err
+	}
+
+	if err = users.SeedAdmin(ctx, db, logger, *email, *username, *password, true); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "%s is now an admin\n", *email)
+	return nil
+}
+
+// Runs migrate up, migrate down [-steps n] or migrate status
+func migrateCommand(ctx context.Context, logger *slog.Logger, args []string, w io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("migrate: expected up, down or status")
+	}
+
+	godotenv.Load()
+
+	fs := flag.NewFlagSet("migrate "+args[0], flag.ContinueOnError)
+	steps := fs.Int("steps", 1, "number of migrations to revert, only for down")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	db, err := database.NewDatabase(os.Getenv("DB_URL"))
+	if err != nil {
+		return err
+	}
+	defer db.DBPool.Close()
+
+	migrator, err := database.NewMigrator(logger, db)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "up":
+		count, err := migrator.Up(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "applied %d migrations\n", count)
+	case "down":
+		count, err := migrator.Down(ctx, *steps)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "reverted %d migrations\n", count)
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED AT\tSTATE")
+		for _, s := range statuses {
+			appliedAt, state := "-", "pending"
+			if s.AppliedAt != nil {
+				appliedAt, state = s.AppliedAt.Format("2006-01-02 15:04:05"), "applied"
+			}
+			if s.Modified {
+				state = "modified"
+			}
+			if s.Missing {
+				state = "missing"
+			}
+			fmt.Fprintf(tw, "%04d\t%s\t%s\t%s\n", s.Version, s.Name, appliedAt, state)
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("migrate: unknown subcommand %q", args[0])
+	}
+
+	return nil
+}
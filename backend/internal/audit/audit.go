@@ -0,0 +1,177 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	database "fucku/internal/database"
+	utils "fucku/internal/utils"
+)
+
+// Event types stored in the event_type column
+const (
+	EventRegister             = "register"
+	EventLogin                = "login"
+	EventLogout               = "logout"
+	EventLoginLocked          = "login_locked"
+	EventAccountUnlocked      = "account_unlocked"
+	EventEmailVerified        = "email_verified"
+	EventVerificationResent   = "verification_resent"
+	EventPasswordResetRequest = "password_reset_requested"
+	EventPasswordReset        = "password_reset"
+	EventPasswordChanged      = "password_changed"
+	EventEmailChangeRequest   = "email_change_requested"
+	EventEmailChanged         = "email_changed"
+	EventTOTPEnabled          = "totp_enabled"
+	EventTOTPDisabled         = "totp_disabled"
+	EventPasskeyRegistered    = "passkey_registered"
+	EventPasskeyRenamed       = "passkey_renamed"
+	EventPasskeyDeleted       = "passkey_deleted"
+	EventSessionCreated       = "session_created"
+	EventSessionRevoked       = "session_revoked"
+	EventTokensRevoked        = "tokens_revoked"
+	EventRefreshTokenReused   = "refresh_token_reused"
+	EventAdminVerify          = "admin_verify"
+	EventAdminSuspend         = "admin_suspend"
+	EventAdminUnsuspend       = "admin_unsuspend"
+	EventAdminDelete          = "admin_delete"
+	EventAdminPasswordReset   = "admin_password_reset"
+	EventAdminSessionsRevoked = "admin_sessions_revoked"
+	EventAdminRoleAssigned    = "admin_role_assigned"
+	EventAdminMailRetried     = "admin_mail_retried"
+)
+
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+type Event struct {
+	Id string `json:"id"`
+	// The user who acted, empty for anonymous requests & background jobs
+	ActorId string `json:"actor_id,omitempty"`
+	// The user the event is about
+	UserId    string         `json:"user_id,omitempty"`
+	EventType string         `json:"event_type"`
+	IPAddress string         `json:"ip_address"`
+	UserAgent string         `json:"user_agent"`
+	Outcome   string         `json:"outcome"`
+	Metadata  map[string]any `json:"metadata,omitempty"`
+	CreatedAt time.Time      `json:"created_at"`
+}
+
+// Filters for querying events, zero values are ignored
+type Filter struct {
+	UserId    string
+	ActorId   string
+	EventType string
+	Outcome   string
+	IPAddress string
+	From      *time.Time
+	To        *time.Time
+	Limit     int
+	Offset    int
+}
+
+// Appends an event to the audit log. IP & user agent are taken from r if given.
+// Failures are only logged, auditing never fails the request itself.
+// The event is written even if ctx is canceled, e.g. by a client disconnect.
+// Without a database, e.g. in tests using in-memory stores, nothing is recorded.
+func Record(ctx context.Context, db *database.Database, logger *slog.Logger, r *http.Request, e Event) {
+	if db == nil {
+		return
+	}
+
+	if r != nil {
+		e.IPAddress = utils.ClientIP(r)
+		e.UserAgent = r.UserAgent()
+	}
+
+	if e.Outcome == "" {
+		e.Outcome = OutcomeSuccess
+	}
+
+	metadata, err := json.Marshal(e.Metadata)
+	if err != nil || e.Metadata == nil {
+		metadata = []byte("{}")
+	}
+
+	ctx, cancel := db.Timeout(context.WithoutCancel(ctx))
+	defer cancel()
+
+	_, err = db.DBPool.Exec(ctx, `
+		INSERT INTO audit_events (actor_id, user_id, event_type, ip_address, user_agent, outcome, metadata)
+		VALUES (NULLIF($1, '')::uuid, NULLIF($2, '')::uuid, $3, $4, $5, $6, $7)`,
+		e.ActorId, e.UserId, e.EventType, e.IPAddress, e.UserAgent, e.Outcome, metadata)
+	if err != nil {
+		logger.Error("failed to record audit event", "error", err, "event_type", e.EventType, "user_id", e.UserId)
+	}
+}
+
+// Queries events matching the filter, newest first.
+func List(ctx context.Context, db *database.Database, f Filter) ([]Event, error) {
+	ctx, cancel := db.Timeout(ctx)
+	defer cancel()
+
+	conditions := []string{"TRUE"}
+	args := []any{}
+	where := func(condition string, value any) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if f.UserId != "" {
+		where(`user_id = $%d`, f.UserId)
+	}
+	if f.ActorId != "" {
+		where(`actor_id = $%d`, f.ActorId)
+	}
+	if f.EventType != "" {
+		where(`event_type = $%d`, f.EventType)
+	}
+	if f.Outcome != "" {
+		where(`outcome = $%d`, f.Outcome)
+	}
+	if f.IPAddress != "" {
+		where(`ip_address = $%d`, f.IPAddress)
+	}
+	if f.From != nil {
+		where(`created_at >= $%d`, *f.From)
+	}
+	if f.To != nil {
+		where(`created_at < $%d`, *f.To)
+	}
+
+	args = append(args, f.Limit, f.Offset)
+	rows, err := db.DBPool.Query(ctx, fmt.Sprintf(`
+		SELECT id, COALESCE(actor_id::text, ''), COALESCE(user_id::text, ''), event_type,
+		ip_address, user_agent, outcome, metadata, created_at
+		FROM audit_events WHERE %s ORDER BY created_at DESC, id LIMIT $%d OFFSET $%d`,
+		strings.Join(conditions, " AND "), len(args)-1, len(args)), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]Event, 0)
+	for rows.Next() {
+		var e Event
+		var metadata []byte
+		if err := rows.Scan(&e.Id, &e.ActorId, &e.UserId, &e.EventType,
+			&e.IPAddress, &e.UserAgent, &e.Outcome, &metadata, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal(metadata, &e.Metadata); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
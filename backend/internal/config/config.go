@@ -3,6 +3,8 @@ package internal
 import (
 	"context"
 	"log/slog"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	database "fucku/internal/database"
@@ -10,36 +12,172 @@ import (
 	"github.com/jackc/pgx/v5"
 )
 
-type AppConfig struct {
-	DB            *database.Database
-	Logger        *slog.Logger
+// Channel the config table trigger notifies on every change
+const notifyChannel = "config_changed"
+
+// Polling is only a fallback for notifications missed while reconnecting
+const DefaultPollInterval = 30 * time.Second
+
+// The config row at one point in time. Snapshots are never modified,
+// every change replaces the whole snapshot.
+type Snapshot struct {
 	MailingActive bool
-	LastFetched   time.Time
+}
+
+// Holds the current Snapshot of the config table, safe for concurrent use.
+// StartConfigWorker keeps it up to date.
+type AppConfig struct {
+	DB           *database.Database
+	Logger       *slog.Logger
+	PollInterval time.Duration
+
+	current atomic.Pointer[Snapshot]
+	// Serializes loads, so subscribers see changes in order
+	mu          sync.Mutex
+	subscribers []func(old, new Snapshot)
+	wg          sync.WaitGroup
 }
 
 func NewAppConfig(logger *slog.Logger, db *database.Database) *AppConfig {
-	return &AppConfig{
-		DB:     db,
-		Logger: logger,
+	ac := &AppConfig{
+		DB:           db,
+		Logger:       logger,
+		PollInterval: DefaultPollInterval,
+	}
+	ac.current.Store(&Snapshot{})
+
+	return ac
+}
+
+// Returns the current snapshot.
+func (ac *AppConfig) Get() Snapshot {
+	return *ac.current.Load()
+}
+
+// Replaces the snapshot and tells the subscribers if it changed.
+// Used by the worker, but also handy for setting the config in tests.
+func (ac *AppConfig) Set(s Snapshot) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	ac.set(s)
+}
+
+// Registers fn to be called after every change with the previous & the new snapshot.
+// Callbacks run one at a time, on the goroutine that loaded the change, and must not call Set.
+func (ac *AppConfig) OnChange(fn func(old, new Snapshot)) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	ac.subscribers = append(ac.subscribers, fn)
+}
+
+func (ac *AppConfig) set(s Snapshot) {
+	old := ac.current.Swap(&s)
+	if *old == s {
+		return
+	}
+
+	for _, fn := range ac.subscribers {
+		fn(*old, s)
 	}
 }
 
-func (ac *AppConfig) StartConfigWorker() {
+// Loads the config, then keeps it up to date through LISTEN/NOTIFY on a
+// dedicated connection and by polling every PollInterval until ctx is
+// canceled. Wait blocks until the worker stopped.
+func (ac *AppConfig) StartConfigWorker(ctx context.Context) {
+	ac.load(ctx)
+
+	ac.wg.Add(2)
 	go func() {
-		for {
-			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-
-			row := ac.DB.DBPool.QueryRow(ctx, `SELECT mailing_active FROM config WHERE id = 1;`)
-			if err := row.Scan(&ac.MailingActive); err != nil {
-				if err == pgx.ErrNoRows {
-					ac.DB.DBPool.Exec(ctx, `INSERT INTO config (mailing_active) VALUES (true)`)
-				} else {
-					ac.Logger.Error("failed to read config from database", "error", err)
-				}
-			}
-
-			cancel()
-			time.Sleep(5 * time.Second)
-		}
+		defer ac.wg.Done()
+		ac.poll(ctx)
+	}()
+	go func() {
+		defer ac.wg.Done()
+		ac.listen(ctx)
 	}()
 }
+
+// Blocks until the worker stopped after ctx was canceled.
+func (ac *AppConfig) Wait() {
+	ac.wg.Wait()
+}
+
+func (ac *AppConfig) poll(ctx context.Context) {
+	ticker := time.NewTicker(ac.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		ac.load(ctx)
+	}
+}
+
+// Reconnects after errors, polling covers the changes missed meanwhile
+func (ac *AppConfig) listen(ctx context.Context) {
+	for {
+		err := ac.listenOnce(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		ac.Logger.Warn("config listener failed, reconnecting", "error", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func (ac *AppConfig) listenOnce(ctx context.Context) error {
+	// A pooled connection would keep the pool from closing on shutdown
+	conn, err := pgx.ConnectConfig(ctx, ac.DB.DBPool.Config().ConnConfig.Copy())
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.WithoutCancel(ctx))
+
+	if _, err := conn.Exec(ctx, "LISTEN "+notifyChannel); err != nil {
+		return err
+	}
+
+	// Catches changes made before LISTEN took effect
+	ac.load(ctx)
+
+	for {
+		if _, err := conn.WaitForNotification(ctx); err != nil {
+			return err
+		}
+
+		ac.load(ctx)
+	}
+}
+
+func (ac *AppConfig) load(ctx context.Context) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	queryCtx, cancel := ac.DB.Timeout(ctx)
+	defer cancel()
+
+	var s Snapshot
+	row := ac.DB.DBPool.QueryRow(queryCtx, `SELECT mailing_active FROM config WHERE id = 1;`)
+	if err := row.Scan(&s.MailingActive); err != nil {
+		if err == pgx.ErrNoRows {
+			ac.DB.DBPool.Exec(queryCtx, `INSERT INTO config (mailing_active) VALUES (true)`)
+		} else if ctx.Err() == nil {
+			ac.Logger.Error("failed to read config from database", "error", err)
+		}
+		return
+	}
+
+	ac.set(s)
+}
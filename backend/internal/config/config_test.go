@@ -0,0 +1,52 @@
+package internal_test
+
+import (
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+
+	config "fucku/internal/config"
+)
+
+func TestOnChange(t *testing.T) {
+	ac := config.NewAppConfig(slog.New(slog.NewTextHandler(io.Discard, nil)), nil)
+
+	var changes []config.Snapshot
+	ac.OnChange(func(old, new config.Snapshot) {
+		if old == new {
+			t.Errorf("called without a change: %+v", new)
+		}
+		changes = append(changes, new)
+	})
+
+	ac.Set(config.Snapshot{MailingActive: true})
+	ac.Set(config.Snapshot{MailingActive: true})
+	ac.Set(config.Snapshot{MailingActive: false})
+
+	if len(changes) != 2 || !changes[0].MailingActive || changes[1].MailingActive {
+		t.Errorf("unexpected changes %+v", changes)
+	}
+	if ac.Get().MailingActive {
+		t.Error("expected mailing to be inactive")
+	}
+}
+
+// Meant for go test -race
+func TestConcurrentAccess(t *testing.T) {
+	ac := config.NewAppConfig(slog.New(slog.NewTextHandler(io.Discard, nil)), nil)
+
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			ac.Set(config.Snapshot{MailingActive: i%2 == 0})
+		}()
+		go func() {
+			defer wg.Done()
+			_ = ac.Get().MailingActive
+		}()
+	}
+	wg.Wait()
+}
@@ -2,113 +2,100 @@ package internal
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"os"
-	"strings"
 	"time"
 
-	"github.com/jackc/pgx"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 type Database struct {
 	DBPool *pgxpool.Pool
+	// Upper bound for a single query, see Timeout
+	QueryTimeout time.Duration
+	// Upper bound for a transaction including its retries, see WithTx
+	TxTimeout time.Duration
 }
 
+// Used unless DB_QUERY_TIMEOUT & DB_TX_TIMEOUT say otherwise
+const (
+	DefaultQueryTimeout = 2 * time.Second
+	DefaultTxTimeout    = 5 * time.Second
+)
+
+// Postgres error codes handled while creating the database
+const (
+	codeDuplicateDatabase     = "42P04"
+	codeInsufficientPrivilege = "42501"
+)
+
 func NewDatabase(connString string) (*Database, error) {
 	pool, err := pgxpool.New(context.Background(), connString)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize db pool: %w", err)
 	}
 
-	return &Database{DBPool: pool}, nil
+	return &Database{DBPool: pool, QueryTimeout: DefaultQueryTimeout, TxTimeout: DefaultTxTimeout}, nil
+}
+
+// Derives the context of a single query from parent, usually the request
+// context, so the query ends with the request or after QueryTimeout.
+func (db *Database) Timeout(parent context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, db.QueryTimeout)
 }
 
-func SetupDatabase(db *Database) error {
-	conn, err := pgx.Connect(pgx.ConnConfig{
-		Host:     "localhost",
-		Port:     5432,
-		Database: "postgres",
-		User:     "postgres",
-		Password: "postgres",
-	})
+// Creates the database named in connString unless it exists. It connects to
+// maintenanceDB (usually postgres) on the same server with the same credentials,
+// so host, sslmode, sslrootcert, sslcert & sslkey all come from connString.
+// Tables are created by the migrations.
+func SetupDatabase(ctx context.Context, connString, maintenanceDB string) error {
+	config, err := pgx.ParseConfig(connString)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to parse database url: %w", err)
 	}
-	defer conn.Close()
-
-	DB_NAME := os.Getenv("DB_NAME")
 
-	_, err = conn.Exec(fmt.Sprintf("CREATE DATABASE %s", DB_NAME))
-	if err != nil {
-		if !strings.Contains(err.Error(), "already exists") {
-			return err
-		}
+	name := config.Database
+	if name == "" {
+		return errors.New("database url has no database name")
 	}
+	config.Database = maintenanceDB
 
-	err = SetupTables(db)
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	conn, err := pgx.ConnectConfig(ctx, config)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to connect to %s database: %w", maintenanceDB, err)
 	}
+	defer conn.Close(context.Background())
 
-	return nil
-}
-
-func SetupTables(db *Database) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-	defer cancel()
+	var exists bool
+	row := conn.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM pg_database WHERE datname = $1)`, name)
+	if err := row.Scan(&exists); err != nil {
+		return fmt.Errorf("failed to check for database %s: %w", name, err)
+	}
 
-	queries := []struct {
-		name string
-		sql  string
-	}{
-		{
-			name: "uuid-ossp extension",
-			sql:  `CREATE EXTENSION IF NOT EXISTS "uuid-ossp";`,
-		},
-		{
-			name: "users table",
-			sql: `
-                CREATE TABLE IF NOT EXISTS users (
-                    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
-                    email TEXT UNIQUE NOT NULL,
-                    username TEXT UNIQUE NOT NULL,
-                    password TEXT NOT NULL,
-                    verified INTEGER NOT NULL DEFAULT 0,
-                    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-                    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-                );`,
-		},
-		{
-			name: "tokens table",
-			sql: `
-                CREATE TABLE IF NOT EXISTS tokens (
-                    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
-                    user_id UUID NOT NULL,
-                    token_type TEXT NOT NULL,
-                    token TEXT UNIQUE NOT NULL,
-                    expires_at TIMESTAMP,
-                    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-                    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-                );`,
-		},
-		{
-			name: "config table",
-			sql: `
-                CREATE TABLE IF NOT EXISTS config (
-                    id INTEGER PRIMARY KEY DEFAULT 1,
-                    mailing_active BOOLEAN NOT NULL DEFAULT false,
-                    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-                    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-                );`,
-		},
+	if exists {
+		return nil
 	}
 
-	for _, q := range queries {
-		if _, err := db.DBPool.Exec(ctx, q.sql); err != nil {
-			return fmt.Errorf("failed to create %s: %w", q.name, err)
+	_, err = conn.Exec(ctx, "CREATE DATABASE "+pgx.Identifier{name}.Sanitize())
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case codeDuplicateDatabase:
+			// Another instance was faster
+			return nil
+		case codeInsufficientPrivilege:
+			return fmt.Errorf("not allowed to create database %s, create it beforehand and set DB_SKIP_CREATE=true: %w", name, err)
 		}
 	}
+	if err != nil {
+		return fmt.Errorf("failed to create database %s: %w", name, err)
+	}
 
 	return nil
 }
@@ -0,0 +1,327 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Arbitrary key of the advisory lock held while migrating,
+// so concurrently starting instances migrate one after another
+const migrationLockKey int64 = 7_414_623_101
+
+// Migration files are named like 0002_add_user_locale.up.sql & .down.sql
+var migrationName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+var ErrChecksumMismatch = errors.New("migration was changed after it was applied")
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Hash of the up script, stored when the migration is applied
+func (m Migration) Checksum() string {
+	sum := sha256.Sum256([]byte(m.Up))
+	return hex.EncodeToString(sum[:])
+}
+
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+	// The applied migration no longer matches its file
+	Modified bool
+	// Applied, but unknown to this build, e.g. during a rollback
+	Missing bool
+}
+
+type appliedMigration struct {
+	Version   int
+	Name      string
+	Checksum  string
+	AppliedAt time.Time
+}
+
+// Reads all migrations from fsys, ordered by version.
+// Each migration needs both an up & a down script.
+func LoadMigrations(fsys fs.FS) ([]Migration, error) {
+	files, err := fs.Glob(fsys, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, file := range files {
+		match := migrationName.FindStringSubmatch(path.Base(file))
+		if match == nil {
+			return nil, fmt.Errorf("invalid migration file name %q", file)
+		}
+
+		version, _ := strconv.Atoi(match[1])
+		sql, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has two names, %q & %q", version, m.Name, match[2])
+		}
+
+		if match[3] == "up" {
+			m.Up = string(sql)
+		} else {
+			m.Down = string(sql)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs an up & a down script", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+
+	slices.SortFunc(migrations, func(a, b Migration) int { return a.Version - b.Version })
+
+	return migrations, nil
+}
+
+// Applies migrations in the schema_migrations table
+type Migrator struct {
+	DB         *Database
+	Logger     *slog.Logger
+	Migrations []Migration
+}
+
+// Creates a migrator for the migrations embedded in the binary.
+func NewMigrator(logger *slog.Logger, db *Database) (*Migrator, error) {
+	sub, err := fs.Sub(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	migrations, err := LoadMigrations(sub)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{
+		DB:         db,
+		Logger:     logger,
+		Migrations: migrations,
+	}, nil
+}
+
+// Runs fn on a connection holding the migration lock.
+func (m *Migrator) locked(ctx context.Context, fn func(conn *pgx.Conn) error) error {
+	conn, err := m.DB.DBPool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, migrationLockKey); err != nil {
+		return fmt.Errorf("failed to acquire migration lock: %w", err)
+	}
+	defer func() {
+		if _, err := conn.Exec(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLockKey); err != nil {
+			m.Logger.Error("failed to release migration lock", "error", err)
+		}
+	}()
+
+	_, err = conn.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version BIGINT PRIMARY KEY,
+			name TEXT NOT NULL,
+			checksum TEXT NOT NULL,
+			applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	return fn(conn.Conn())
+}
+
+func applied(ctx context.Context, conn *pgx.Conn) (map[int]appliedMigration, error) {
+	rows, err := conn.Query(ctx, `SELECT version, name, checksum, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+
+	list, err := pgx.CollectRows(rows, pgx.RowToStructByPos[appliedMigration])
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]appliedMigration, len(list))
+	for _, a := range list {
+		byVersion[a.Version] = a
+	}
+
+	return byVersion, nil
+}
+
+// Fails if any applied migration differs from its file.
+func (m *Migrator) verify(done map[int]appliedMigration) error {
+	for _, mig := range m.Migrations {
+		if a, ok := done[mig.Version]; ok && a.Checksum != mig.Checksum() {
+			return fmt.Errorf("%d_%s: %w", mig.Version, mig.Name, ErrChecksumMismatch)
+		}
+	}
+
+	return nil
+}
+
+// Applies all pending migrations in order, each in its own transaction.
+// Returns the number of migrations applied.
+func (m *Migrator) Up(ctx context.Context) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+
+	count := 0
+	err := m.locked(ctx, func(conn *pgx.Conn) error {
+		done, err := applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		if err := m.verify(done); err != nil {
+			return err
+		}
+
+		for _, mig := range m.Migrations {
+			if _, ok := done[mig.Version]; ok {
+				continue
+			}
+
+			err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+				if _, err := tx.Exec(ctx, mig.Up); err != nil {
+					return err
+				}
+
+				_, err := tx.Exec(ctx,
+					`INSERT INTO schema_migrations (version, name, checksum) VALUES ($1, $2, $3)`,
+					mig.Version, mig.Name, mig.Checksum())
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("failed to apply migration %d_%s: %w", mig.Version, mig.Name, err)
+			}
+
+			m.Logger.Info("applied migration", "version", mig.Version, "name", mig.Name)
+			count++
+		}
+
+		return nil
+	})
+
+	return count, err
+}
+
+// Reverts the given number of most recently applied migrations.
+// Returns the number of migrations reverted.
+func (m *Migrator) Down(ctx context.Context, steps int) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+
+	count := 0
+	err := m.locked(ctx, func(conn *pgx.Conn) error {
+		done, err := applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		if err := m.verify(done); err != nil {
+			return err
+		}
+
+		for i := len(m.Migrations) - 1; i >= 0 && count < steps; i-- {
+			mig := m.Migrations[i]
+			if _, ok := done[mig.Version]; !ok {
+				continue
+			}
+
+			err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+				if _, err := tx.Exec(ctx, mig.Down); err != nil {
+					return err
+				}
+
+				_, err := tx.Exec(ctx, `DELETE FROM schema_migrations WHERE version = $1`, mig.Version)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("failed to revert migration %d_%s: %w", mig.Version, mig.Name, err)
+			}
+
+			m.Logger.Info("reverted migration", "version", mig.Version, "name", mig.Name)
+			count++
+		}
+
+		return nil
+	})
+
+	return count, err
+}
+
+// Lists all known & applied migrations ordered by version.
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	var statuses []MigrationStatus
+	err := m.locked(ctx, func(conn *pgx.Conn) error {
+		done, err := applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, mig := range m.Migrations {
+			s := MigrationStatus{Version: mig.Version, Name: mig.Name}
+			if a, ok := done[mig.Version]; ok {
+				s.AppliedAt = &a.AppliedAt
+				s.Modified = a.Checksum != mig.Checksum()
+				delete(done, mig.Version)
+			}
+			statuses = append(statuses, s)
+		}
+
+		for _, a := range done {
+			statuses = append(statuses, MigrationStatus{
+				Version:   a.Version,
+				Name:      a.Name,
+				AppliedAt: &a.AppliedAt,
+				Missing:   true,
+			})
+		}
+
+		return nil
+	})
+
+	slices.SortFunc(statuses, func(a, b MigrationStatus) int { return a.Version - b.Version })
+
+	return statuses, err
+}
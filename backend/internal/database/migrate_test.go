@@ -0,0 +1,78 @@
+package internal_test
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+	"testing/fstest"
+
+	database "fucku/internal/database"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	fsys := fstest.MapFS{
+		"0010_add_index.up.sql":   {Data: []byte("CREATE INDEX a ON b (c);")},
+		"0010_add_index.down.sql": {Data: []byte("DROP INDEX a;")},
+		"0002_add_table.up.sql":   {Data: []byte("CREATE TABLE b (c INTEGER);")},
+		"0002_add_table.down.sql": {Data: []byte("DROP TABLE b;")},
+	}
+
+	migrations, err := database.LoadMigrations(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(migrations) != 2 {
+		t.Fatalf("expected 2 migrations, got %d", len(migrations))
+	}
+	if migrations[0].Version != 2 || migrations[1].Version != 10 {
+		t.Errorf("migrations not ordered by version: %d, %d", migrations[0].Version, migrations[1].Version)
+	}
+	if migrations[0].Name != "add_table" || migrations[0].Down != "DROP TABLE b;" {
+		t.Errorf("unexpected migration %+v", migrations[0])
+	}
+}
+
+func TestLoadMigrationsInvalid(t *testing.T) {
+	tests := map[string]fstest.MapFS{
+		"missing down": {
+			"0001_init.up.sql": {Data: []byte("SELECT 1;")},
+		},
+		"bad name": {
+			"init.sql": {Data: []byte("SELECT 1;")},
+		},
+		"two names": {
+			"0001_init.up.sql":    {Data: []byte("SELECT 1;")},
+			"0001_other.down.sql": {Data: []byte("SELECT 1;")},
+		},
+	}
+
+	for name, fsys := range tests {
+		if _, err := database.LoadMigrations(fsys); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestChecksumChangesWithUp(t *testing.T) {
+	m := database.Migration{Version: 1, Name: "init", Up: "SELECT 1;", Down: "SELECT 2;"}
+	changed := m
+	changed.Up = "SELECT 3;"
+
+	if m.Checksum() == changed.Checksum() {
+		t.Error("checksum did not change with the up script")
+	}
+}
+
+func TestEmbeddedMigrations(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	migrator, err := database.NewMigrator(logger, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(migrator.Migrations) == 0 || migrator.Migrations[0].Version != 1 {
+		t.Errorf("expected the initial migration to be embedded")
+	}
+}
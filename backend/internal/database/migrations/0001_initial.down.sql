@@ -0,0 +1,13 @@
+DROP TABLE IF EXISTS config;
+DROP TABLE IF EXISTS rate_limits;
+DROP TABLE IF EXISTS login_attempts;
+DROP TABLE IF EXISTS audit_events;
+DROP FUNCTION IF EXISTS audit_events_append_only();
+DROP TABLE IF EXISTS user_roles;
+DROP TABLE IF EXISTS role_permissions;
+DROP TABLE IF EXISTS permissions;
+DROP TABLE IF EXISTS roles;
+DROP TABLE IF EXISTS webauthn_credentials;
+DROP TABLE IF EXISTS recovery_codes;
+DROP TABLE IF EXISTS tokens;
+DROP TABLE IF EXISTS users;
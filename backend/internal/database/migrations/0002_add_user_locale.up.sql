@@ -0,0 +1,2 @@
+-- Language the users mails are rendered in, see mailer.Templates
+ALTER TABLE users ADD COLUMN IF NOT EXISTS locale TEXT NOT NULL DEFAULT 'en';
@@ -0,0 +1,27 @@
+-- outbox emails table
+-- Rendered mails waiting for, or done with, delivery by the mail workers.
+-- Bodies are cleared once a mail is sent, they contain one time codes.
+CREATE TABLE IF NOT EXISTS outbox_emails (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    idempotency_key TEXT UNIQUE NOT NULL,
+    template TEXT NOT NULL,
+    locale TEXT NOT NULL,
+    from_name TEXT NOT NULL DEFAULT '',
+    from_email TEXT NOT NULL,
+    to_name TEXT NOT NULL DEFAULT '',
+    to_email TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    html TEXT NOT NULL,
+    text TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    max_attempts INTEGER NOT NULL,
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    locked_until TIMESTAMP,
+    last_error TEXT NOT NULL DEFAULT '',
+    sent_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS outbox_emails_due_idx ON outbox_emails (next_attempt_at) WHERE status IN ('pending', 'sending');
+CREATE INDEX IF NOT EXISTS outbox_emails_status_idx ON outbox_emails (status, created_at);
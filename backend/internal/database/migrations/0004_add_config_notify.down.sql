@@ -0,0 +1,2 @@
+DROP TRIGGER IF EXISTS config_notify ON config;
+DROP FUNCTION IF EXISTS config_notify();
@@ -0,0 +1,13 @@
+-- config changed notification
+-- Running instances LISTEN on config_changed & reload their config right away
+CREATE OR REPLACE FUNCTION config_notify() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify('config_changed', '');
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS config_notify ON config;
+CREATE TRIGGER config_notify
+AFTER INSERT OR UPDATE OR DELETE ON config
+FOR EACH STATEMENT EXECUTE FUNCTION config_notify();
@@ -0,0 +1,3 @@
+-- Hashes can't be turned back into tokens, so every token is dropped
+DELETE FROM tokens;
+ALTER TABLE tokens RENAME COLUMN token_hash TO token;
@@ -0,0 +1,5 @@
+-- tokens hashed values
+-- Only the SHA-256 of a token is stored, the raw value lives in the cookie
+-- or mail alone. Existing values are hashed in place, so they keep working.
+ALTER TABLE tokens RENAME COLUMN token TO token_hash;
+UPDATE tokens SET token_hash = encode(sha256(convert_to(token_hash, 'UTF8')), 'hex');
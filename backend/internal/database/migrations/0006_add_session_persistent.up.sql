@@ -0,0 +1,4 @@
+-- remember me sessions
+-- Persistent sessions get the longer SESSION_REMEMBER_* lifetimes & cookies
+-- that survive closing the browser
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS persistent BOOLEAN NOT NULL DEFAULT false;
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS tokens_session_id_idx;
+ALTER TABLE tokens DROP COLUMN IF EXISTS used_at;
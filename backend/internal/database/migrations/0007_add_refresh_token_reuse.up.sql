@@ -0,0 +1,5 @@
+-- bearer token families
+-- Access & refresh tokens point to their session through session_id.
+-- Rotated refresh tokens are kept with used_at set, so a replay is noticed.
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS used_at TIMESTAMP;
+CREATE INDEX IF NOT EXISTS tokens_session_id_idx ON tokens (session_id);
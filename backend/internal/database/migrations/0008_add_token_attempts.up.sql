@@ -0,0 +1,3 @@
+-- token attempts
+-- Wrong codes entered with an MFA pending token, it is deleted after a few.
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS attempts INTEGER NOT NULL DEFAULT 0;
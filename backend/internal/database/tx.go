@@ -0,0 +1,74 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Postgres error codes of conflicts that succeed when retried
+const (
+	codeSerializationFailure = "40001"
+	codeDeadlockDetected     = "40P01"
+	codeUniqueViolation      = "23505"
+)
+
+// Attempts of a transaction before giving up on serialization failures
+const txAttempts = 3
+
+// Implemented by both the pool and transactions, so stores can run on either
+type Querier interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// Runs fn in a serializable transaction, committing if it returns nil and
+// rolling back otherwise. Serialization failures & deadlocks run fn again,
+// so it must not have side effects outside of tx. All attempts together end
+// after TxTimeout.
+func (db *Database) WithTx(ctx context.Context, fn func(tx pgx.Tx) error) error {
+	ctx, cancel := context.WithTimeout(ctx, db.TxTimeout)
+	defer cancel()
+
+	var err error
+	for attempt := range txAttempts {
+		if attempt > 0 {
+			select {
+			case <-time.After(time.Duration(attempt*attempt) * 10 * time.Millisecond):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		err = pgx.BeginTxFunc(ctx, db.DBPool, pgx.TxOptions{IsoLevel: pgx.Serializable}, fn)
+		if !retryable(err) {
+			return err
+		}
+	}
+
+	return err
+}
+
+func retryable(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+
+	return pgErr.Code == codeSerializationFailure || pgErr.Code == codeDeadlockDetected
+}
+
+// Reports whether err violates a unique constraint and which one,
+// e.g. users_email_key.
+func UniqueViolation(err error) (string, bool) {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == codeUniqueViolation {
+		return pgErr.ConstraintName, true
+	}
+
+	return "", false
+}
@@ -0,0 +1,28 @@
+package internal_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	database "fucku/internal/database"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestUniqueViolation(t *testing.T) {
+	err := fmt.Errorf("insert user: %w", &pgconn.PgError{Code: "23505", ConstraintName: "users_email_key"})
+
+	constraint, ok := database.UniqueViolation(err)
+	if !ok || constraint != "users_email_key" {
+		t.Errorf("expected users_email_key, got %q (%t)", constraint, ok)
+	}
+
+	if _, ok := database.UniqueViolation(&pgconn.PgError{Code: "23503"}); ok {
+		t.Error("foreign key violation reported as unique violation")
+	}
+
+	if _, ok := database.UniqueViolation(errors.New("connection refused")); ok {
+		t.Error("plain error reported as unique violation")
+	}
+}
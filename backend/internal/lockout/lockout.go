@@ -0,0 +1,266 @@
+package internal
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	database "fucku/internal/database"
+)
+
+// Thresholds for failed logins, see ConfigFromEnv
+type Config struct {
+	// Failures of one account until it gets locked
+	MaxAccountFailures int
+	// Failures from one IP until it gets locked, across all accounts
+	MaxIPFailures int
+	// Failures older than this are forgotten
+	Window time.Duration
+	// How long a lock lasts
+	LockoutDuration time.Duration
+	// Wait after the first failure, doubled with each further one
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		MaxAccountFailures: 5,
+		MaxIPFailures:      50,
+		Window:             time.Hour,
+		LockoutDuration:    15 * time.Minute,
+		BaseDelay:          time.Second,
+		MaxDelay:           30 * time.Second,
+	}
+}
+
+// Reads the LOGIN_* environment variables, falling back to DefaultConfig.
+func ConfigFromEnv() Config {
+	c := DefaultConfig()
+
+	if v, err := strconv.Atoi(os.Getenv("LOGIN_MAX_ACCOUNT_FAILURES")); err == nil && v > 0 {
+		c.MaxAccountFailures = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("LOGIN_MAX_IP_FAILURES")); err == nil && v > 0 {
+		c.MaxIPFailures = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("LOGIN_FAILURE_WINDOW")); err == nil && v > 0 {
+		c.Window = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("LOGIN_LOCKOUT_DURATION")); err == nil && v > 0 {
+		c.LockoutDuration = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("LOGIN_BACKOFF_BASE")); err == nil && v >= 0 {
+		c.BaseDelay = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("LOGIN_BACKOFF_MAX")); err == nil && v >= 0 {
+		c.MaxDelay = v
+	}
+
+	return c
+}
+
+// Tracks failed logins per account & IP in the login_attempts table,
+// so limits hold across several instances. A nil guard tracks nothing.
+type Guard struct {
+	DB     *database.Database
+	Logger *slog.Logger
+	Config Config
+}
+
+// The result of a failed attempt
+type Failure struct {
+	// The account reached MaxAccountFailures with this attempt
+	AccountLocked bool
+	// The IP reached MaxIPFailures with this attempt
+	IPLocked bool
+}
+
+func NewGuard(logger *slog.Logger, db *database.Database, config Config) *Guard {
+	return &Guard{
+		DB:     db,
+		Logger: logger,
+		Config: config,
+	}
+}
+
+func accountKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// Returns the delay before the next attempt after the given number of failures.
+func Backoff(failures int, base, max time.Duration) time.Duration {
+	if failures <= 0 || base <= 0 {
+		return 0
+	}
+
+	delay := base
+	for i := 1; i < failures && delay < max; i++ {
+		delay *= 2
+	}
+
+	return min(delay, max)
+}
+
+// Returns how long the client has to wait before it may try to log in to
+// the account again and whether that is due to a lockout rather than backoff.
+func (g *Guard) Check(ctx context.Context, email, ip string) (time.Duration, bool, error) {
+	if g == nil {
+		return 0, false, nil
+	}
+
+	ctx, cancel := g.DB.Timeout(ctx)
+	defer cancel()
+
+	now := time.Now().UTC()
+	rows, err := g.DB.DBPool.Query(ctx, `
+		SELECT key, failures, last_failure_at, locked_until FROM login_attempts
+		WHERE key = ANY($1) AND (last_failure_at > $2 OR locked_until > $3)`,
+		[]string{accountKey(email), ipKey(ip)}, now.Add(-g.Config.Window), now)
+	if err != nil {
+		return 0, false, err
+	}
+	defer rows.Close()
+
+	var wait time.Duration
+	var locked bool
+	for rows.Next() {
+		var key string
+		var failures int
+		var lastFailure time.Time
+		var lockedUntil *time.Time
+		if err := rows.Scan(&key, &failures, &lastFailure, &lockedUntil); err != nil {
+			return 0, false, err
+		}
+
+		if lockedUntil != nil && lockedUntil.After(now) {
+			wait = max(wait, lockedUntil.Sub(now))
+			locked = true
+			continue
+		}
+
+		// Backoff only applies per account, an IP may serve many users
+		if strings.HasPrefix(key, "account:") {
+			next := lastFailure.Add(Backoff(failures, g.Config.BaseDelay, g.Config.MaxDelay))
+			if next.After(now) {
+				wait = max(wait, next.Sub(now))
+			}
+		}
+	}
+
+	return wait, locked, rows.Err()
+}
+
+// Counts a failed attempt for the account & IP and locks them once
+// they reach their limit. Failures are counted even if ctx is canceled,
+// so a client can't dodge the limit by disconnecting early.
+func (g *Guard) RecordFailure(ctx context.Context, email, ip string) (Failure, error) {
+	if g == nil {
+		return Failure{}, nil
+	}
+
+	ctx = context.WithoutCancel(ctx)
+
+	accountLocked, err := g.recordFailure(ctx, accountKey(email), g.Config.MaxAccountFailures)
+	if err != nil {
+		return Failure{}, err
+	}
+
+	ipLocked, err := g.recordFailure(ctx, ipKey(ip), g.Config.MaxIPFailures)
+	if err != nil {
+		return Failure{}, err
+	}
+
+	return Failure{AccountLocked: accountLocked, IPLocked: ipLocked}, nil
+}
+
+// Returns true if this failure locked the key
+func (g *Guard) recordFailure(ctx context.Context, key string, limit int) (bool, error) {
+	ctx, cancel := g.DB.Timeout(ctx)
+	defer cancel()
+
+	now := time.Now().UTC()
+
+	// Counting restarts once the window has passed or a lock ran out
+	var failures int
+	row := g.DB.DBPool.QueryRow(ctx, `
+		INSERT INTO login_attempts (key, failures, last_failure_at) VALUES ($1, 1, $2)
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE
+				WHEN login_attempts.last_failure_at <= $3 OR login_attempts.locked_until <= $2 THEN 1
+				ELSE login_attempts.failures + 1
+			END,
+			locked_until = CASE WHEN login_attempts.locked_until <= $2 THEN NULL ELSE login_attempts.locked_until END,
+			last_failure_at = $2
+		RETURNING failures`,
+		key, now, now.Add(-g.Config.Window))
+	if err := row.Scan(&failures); err != nil {
+		return false, err
+	}
+
+	if failures != limit {
+		return false, nil
+	}
+
+	_, err := g.DB.DBPool.Exec(ctx,
+		`UPDATE login_attempts SET locked_until = $1 WHERE key = $2`, now.Add(g.Config.LockoutDuration), key)
+	if err != nil {
+		return false, err
+	}
+
+	g.Logger.Warn("login locked", "key", key, "failures", failures)
+	return true, nil
+}
+
+// Forgets the failures of an account, e.g. after a successful login or
+// when the owner unlocks it by email. IP counters are kept.
+func (g *Guard) Reset(ctx context.Context, email string) error {
+	if g == nil {
+		return nil
+	}
+
+	ctx, cancel := g.DB.Timeout(ctx)
+	defer cancel()
+
+	_, err := g.DB.DBPool.Exec(ctx, `DELETE FROM login_attempts WHERE key = $1`, accountKey(email))
+
+	return err
+}
+
+// Periodically removes attempts that no longer count and expired locks
+// until ctx is canceled.
+func (g *Guard) StartCleanup(ctx context.Context) {
+	ticker := time.NewTicker(1 * time.Hour)
+	defer ticker.Stop()
+
+	for {
+		g.cleanup(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (g *Guard) cleanup(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	now := time.Now().UTC()
+	_, err := g.DB.DBPool.Exec(ctx, `
+		DELETE FROM login_attempts WHERE last_failure_at < $1
+		AND (locked_until IS NULL OR locked_until < $2)`,
+		now.Add(-g.Config.Window), now)
+	if err != nil {
+		g.Logger.Error("error cleaning up login attempts", "error", err)
+	}
+}
@@ -0,0 +1,59 @@
+package internal_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	lockout "fucku/internal/lockout"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{5, 16 * time.Second},
+		{6, 30 * time.Second},
+		{100, 30 * time.Second},
+	}
+
+	for _, tt := range tests {
+		got := lockout.Backoff(tt.failures, time.Second, 30*time.Second)
+		if got != tt.want {
+			t.Errorf("Backoff(%d): expected %s, got: %s", tt.failures, tt.want, got)
+		}
+	}
+
+	if got := lockout.Backoff(3, 0, 30*time.Second); got != 0 {
+		t.Errorf("expected no backoff without a base delay, got: %s", got)
+	}
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	os.Setenv("LOGIN_MAX_ACCOUNT_FAILURES", "3")
+	os.Setenv("LOGIN_LOCKOUT_DURATION", "1h")
+	os.Setenv("LOGIN_BACKOFF_MAX", "not-a-duration")
+	defer func() {
+		os.Unsetenv("LOGIN_MAX_ACCOUNT_FAILURES")
+		os.Unsetenv("LOGIN_LOCKOUT_DURATION")
+		os.Unsetenv("LOGIN_BACKOFF_MAX")
+	}()
+
+	c := lockout.ConfigFromEnv()
+	defaults := lockout.DefaultConfig()
+
+	if c.MaxAccountFailures != 3 {
+		t.Errorf("expected 3 account failures, got: %d", c.MaxAccountFailures)
+	}
+	if c.LockoutDuration != time.Hour {
+		t.Errorf("expected a lockout of 1h, got: %s", c.LockoutDuration)
+	}
+	if c.MaxDelay != defaults.MaxDelay {
+		t.Errorf("expected invalid values to fall back to %s, got: %s", defaults.MaxDelay, c.MaxDelay)
+	}
+}
@@ -0,0 +1,41 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Writes every mail as an .eml file into Dir, handy to inspect mails locally
+type FileTransport struct {
+	Dir string
+}
+
+func NewFileTransport(dir string) *FileTransport {
+	return &FileTransport{Dir: dir}
+}
+
+func (t *FileTransport) Send(ctx context.Context, msg Message) error {
+	data, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(t.Dir, 0o750); err != nil {
+		return err
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+
+	// Sorting by name sorts by time
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000"), hex.EncodeToString(suffix))
+
+	return os.WriteFile(filepath.Join(t.Dir, name), data, 0o640)
+}
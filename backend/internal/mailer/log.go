@@ -0,0 +1,21 @@
+package internal
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Only logs mails instead of sending them, meant for development.
+// Codes & links end up in the log, so don't use it in production.
+type LogTransport struct {
+	Logger *slog.Logger
+}
+
+func NewLogTransport(logger *slog.Logger) *LogTransport {
+	return &LogTransport{Logger: logger}
+}
+
+func (t *LogTransport) Send(ctx context.Context, msg Message) error {
+	t.Logger.Info("mail", "to", msg.To.Email, "subject", msg.Subject, "text", msg.Text)
+	return nil
+}
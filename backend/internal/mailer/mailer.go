@@ -1,94 +1,147 @@
 package internal
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"io"
 	"log/slog"
-	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"time"
 
 	config "fucku/internal/config"
 )
 
+// Queues the apps mails in the Outbox, as long as mailing is active.
+// Every mail is rendered in the locale of its recipient.
 type Mailer struct {
 	AppConfig *config.AppConfig
 	Logger    *slog.Logger
-	key       string
-	secret    string
+	Outbox    *Outbox
+	Templates *Templates
+	From      Address
 }
 
-func NewMailer(logger *slog.Logger, ac *config.AppConfig) *Mailer {
-	key := os.Getenv("MAILJET_KEY")
-	secret := os.Getenv("MAILJET_SECRET")
+func NewMailer(logger *slog.Logger, ac *config.AppConfig, outbox *Outbox, from Address) (*Mailer, error) {
+	templates, err := NewTemplates()
+	if err != nil {
+		return nil, err
+	}
 
 	return &Mailer{
 		AppConfig: ac,
 		Logger:    logger,
-		key:       key,
-		secret:    secret,
+		Outbox:    outbox,
+		Templates: templates,
+		From:      from,
+	}, nil
+}
+
+// Picks the supported locale closest to the preferences, see Templates.MatchLocale
+func (m *Mailer) Locale(preferences ...string) string {
+	return m.Templates.MatchLocale(preferences...)
+}
+
+func (m *Mailer) SendRegistrationMail(ctx context.Context, username, email, locale, token string) error {
+	if !m.AppConfig.Get().MailingActive {
+		return nil
 	}
+
+	data := templateData(username)
+	data.Code = token
+	// Link to the GET /verify endpoint
+	data.Link = appLink("/verify", url.Values{"email": {email}, "code": {token}})
+
+	return m.send(ctx, TemplateVerification, idempotencyKey(TemplateVerification, token), email, username, locale, data)
 }
 
-func (m *Mailer) SendRegistrationMail(username, email, token string) {
-	if !m.AppConfig.MailingActive {
-		return
+func (m *Mailer) SendPasswordResetMail(ctx context.Context, username, email, locale, token string) error {
+	if !m.AppConfig.Get().MailingActive {
+		return nil
 	}
 
-	appName := os.Getenv("APP_NAME")
-
-	body := map[string]any{
-		"Messages": []map[string]any{
-			{
-				"From": map[string]any{
-					"Email": "svenotimm@gmail.com",
-					"Name":  fmt.Sprintf("%s - Email Verification", appName),
-				},
-				"To": []map[string]any{
-					{
-						"Email": email,
-						"Name":  username,
-					},
-				},
-				"Subject":  "Your Email-Verification Code",
-				"HTMLPart": fmt.Sprintf("<h3>Hey %s, welcome to %s!</h3><br />Your verification code is: %s!", username, appName, token),
-				"TextPart": fmt.Sprintf("Hey %s, welcome to %s! Your verification code is: %s!", username, appName, token),
-			},
-		},
+	data := templateData(username)
+	data.Code = token
+
+	return m.send(ctx, TemplatePasswordReset, idempotencyKey(TemplatePasswordReset, token), email, username, locale, data)
+}
+
+func (m *Mailer) SendEmailChangeMail(ctx context.Context, username, email, locale, token string) error {
+	if !m.AppConfig.Get().MailingActive {
+		return nil
 	}
 
-	bodyBytes, err := json.Marshal(body)
-	if err != nil {
-		m.Logger.Error("failed to marshal email JSON", "error", err)
+	data := templateData(username)
+	data.Code = token
+
+	return m.send(ctx, TemplateEmailChange, idempotencyKey(TemplateEmailChange, token), email, username, locale, data)
+}
+
+// Tells the user about a login from a device they had no session on.
+func (m *Mailer) SendNewLoginMail(ctx context.Context, username, email, locale, userAgent, ipAddress string, at time.Time) error {
+	if !m.AppConfig.Get().MailingActive {
+		return nil
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	data := templateData(username)
+	data.UserAgent = userAgent
+	data.IPAddress = ipAddress
+	data.Time = at
 
-	req, err := http.NewRequestWithContext(ctx, "POST", "https://api.mailjet.com/v3.1/send", bytes.NewBuffer(bodyBytes))
-	if err != nil {
-		m.Logger.Error("failed to create email request", "error", err, "email", email)
-		return
+	return m.send(ctx, TemplateNewLogin, idempotencyKey(TemplateNewLogin, email, at.UTC().Format(time.RFC3339Nano)), email, username, locale, data)
+}
+
+func (m *Mailer) SendAccountLockedMail(ctx context.Context, username, email, locale, token string) error {
+	if !m.AppConfig.Get().MailingActive {
+		return nil
 	}
 
-	req.Header.Add("Content-Type", "application/json")
-	req.SetBasicAuth(m.key, m.secret)
+	data := templateData(username)
+	data.Code = token
+	// Link to the confirmation page of GET /login/unlock
+	data.Link = appLink("/login/unlock", url.Values{"token": {token}})
 
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		m.Logger.Error("failed to send email", "error", err, "email", email)
-		return
+	return m.send(ctx, TemplateAccountLocked, idempotencyKey(TemplateAccountLocked, token), email, username, locale, data)
+}
+
+func templateData(username string) TemplateData {
+	return TemplateData{AppName: os.Getenv("APP_NAME"), Username: username}
+}
+
+// Builds a link into the app, empty unless its public URL is configured
+func appLink(path string, query url.Values) string {
+	appURL := os.Getenv("APP_URL")
+	if appURL == "" {
+		return ""
 	}
-	defer res.Body.Close()
 
-	resBody, err := io.ReadAll(res.Body)
+	return strings.TrimRight(appURL, "/") + path + "?" + query.Encode()
+}
+
+// Keys mails by what triggered them, so a retried request doesn't mail twice.
+// The parts are hashed as they may contain tokens.
+func idempotencyKey(template string, parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return template + ":" + hex.EncodeToString(sum[:16])
+}
+
+// Renders a single message and queues it for delivery
+func (m *Mailer) send(ctx context.Context, template, key, email, name, locale string, data TemplateData) error {
+	mail, err := m.Templates.Render(template, locale, data)
 	if err != nil {
-		m.Logger.Error("failed to read response body", "error", err)
-		return
+		return fmt.Errorf("rendering %s/%s: %w", locale, template, err)
 	}
 
-	m.Logger.Info("response body", "info", resBody)
+	return m.Outbox.Enqueue(ctx, OutboxEmail{
+		IdempotencyKey: key,
+		Template:       template,
+		Locale:         locale,
+		From:           m.From,
+		To:             Address{Name: name, Email: email},
+		Subject:        mail.Subject,
+		HTML:           mail.HTML,
+		Text:           mail.Text,
+	})
 }
@@ -0,0 +1,77 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+const mailjetURL = "https://api.mailjet.com/v3.1/send"
+
+// Sends mails through the Mailjet send API
+type MailjetTransport struct {
+	Key    string
+	Secret string
+	URL    string
+	Client *http.Client
+}
+
+func NewMailjetTransport(key, secret string) *MailjetTransport {
+	return &MailjetTransport{
+		Key:    key,
+		Secret: secret,
+		URL:    mailjetURL,
+		Client: &http.Client{},
+	}
+}
+
+func (t *MailjetTransport) Send(ctx context.Context, msg Message) error {
+	body := map[string]any{
+		"Messages": []map[string]any{
+			{
+				"From": map[string]any{
+					"Email": msg.From.Email,
+					"Name":  msg.From.Name,
+				},
+				"To": []map[string]any{
+					{
+						"Email": msg.To.Email,
+						"Name":  msg.To.Name,
+					},
+				},
+				"Subject":  msg.Subject,
+				"HTMLPart": msg.HTML,
+				"TextPart": msg.Text,
+			},
+		},
+	}
+
+	bodyBytes, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to marshal email JSON: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", t.URL, bytes.NewBuffer(bodyBytes))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Add("Content-Type", "application/json")
+	req.SetBasicAuth(t.Key, t.Secret)
+
+	res, err := t.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		resBody, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+		return fmt.Errorf("mailjet answered %d: %s", res.StatusCode, resBody)
+	}
+
+	return nil
+}
@@ -0,0 +1,462 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	database "fucku/internal/database"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Outbox states stored in the status column
+const (
+	StatusPending = "pending"
+	// Claimed by a worker until locked_until
+	StatusSending = "sending"
+	StatusSent    = "sent"
+	// Gave up after max_attempts, only an admin retry sends it again
+	StatusFailed = "failed"
+)
+
+// Upper bound for handing a single mail to the transport
+const sendTimeout = 10 * time.Second
+
+var (
+	ErrMailNotFound  = errors.New("mail not found")
+	ErrMailNotFailed = errors.New("only failed mails can be retried")
+)
+
+// Delivery settings of the outbox, see OutboxConfigFromEnv
+type OutboxConfig struct {
+	// Number of concurrent senders per instance
+	Workers int
+	// Attempts until a mail is marked as failed
+	MaxAttempts int
+	// Wait after the first failed attempt, doubled with each further one
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// How often workers look for due mails, enqueueing wakes them up early
+	PollInterval time.Duration
+	// How long a claimed mail stays claimed, afterwards it is picked up again.
+	// Has to outlast sendTimeout, else slow sends get delivered twice.
+	Lease time.Duration
+	// Sent mails are deleted after this
+	Retention time.Duration
+}
+
+func DefaultOutboxConfig() OutboxConfig {
+	return OutboxConfig{
+		Workers:      2,
+		MaxAttempts:  8,
+		BaseDelay:    30 * time.Second,
+		MaxDelay:     time.Hour,
+		PollInterval: 5 * time.Second,
+		Lease:        time.Minute,
+		Retention:    7 * 24 * time.Hour,
+	}
+}
+
+// Reads the MAIL_* outbox environment variables, falling back to DefaultOutboxConfig.
+func OutboxConfigFromEnv() OutboxConfig {
+	c := DefaultOutboxConfig()
+
+	if v, err := strconv.Atoi(os.Getenv("MAIL_WORKERS")); err == nil && v > 0 {
+		c.Workers = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("MAIL_MAX_ATTEMPTS")); err == nil && v > 0 {
+		c.MaxAttempts = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("MAIL_RETRY_BASE")); err == nil && v > 0 {
+		c.BaseDelay = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("MAIL_RETRY_MAX")); err == nil && v > 0 {
+		c.MaxDelay = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("MAIL_POLL_INTERVAL")); err == nil && v > 0 {
+		c.PollInterval = v
+	}
+
+	return c
+}
+
+// Returns the wait before the next attempt after the given number of failed ones.
+func (c OutboxConfig) RetryDelay(attempts int) time.Duration {
+	if attempts <= 0 {
+		return 0
+	}
+
+	delay := c.BaseDelay
+	for i := 1; i < attempts && delay < c.MaxDelay; i++ {
+		delay *= 2
+	}
+
+	return min(delay, c.MaxDelay)
+}
+
+// A mail in the outbox_emails table. The bodies are never serialized,
+// they contain one time codes.
+type OutboxEmail struct {
+	Id string `json:"id"`
+	// Enqueueing the same key twice only stores the first mail
+	IdempotencyKey string     `json:"idempotency_key"`
+	Template       string     `json:"template"`
+	Locale         string     `json:"locale"`
+	From           Address    `json:"from"`
+	To             Address    `json:"to"`
+	Subject        string     `json:"subject"`
+	HTML           string     `json:"-"`
+	Text           string     `json:"-"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	MaxAttempts    int        `json:"max_attempts"`
+	NextAttemptAt  time.Time  `json:"next_attempt_at"`
+	LastError      string     `json:"last_error,omitempty"`
+	SentAt         *time.Time `json:"sent_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+// Filters for listing mails, zero values are ignored
+type OutboxFilter struct {
+	Status   string
+	Email    string
+	Template string
+	Limit    int
+	Offset   int
+}
+
+// Durable mail queue in the outbox_emails table. Workers on any number of
+// instances share it, each mail is claimed with SKIP LOCKED by one of them.
+// Without a database, e.g. in tests using in-memory stores, mails are sent right away.
+type Outbox struct {
+	DB        *database.Database
+	Logger    *slog.Logger
+	Transport Transport
+	Config    OutboxConfig
+
+	// Wakes up a local worker after Enqueue
+	wake chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewOutbox(logger *slog.Logger, db *database.Database, transport Transport, config OutboxConfig) *Outbox {
+	return &Outbox{
+		DB:        db,
+		Logger:    logger,
+		Transport: transport,
+		Config:    config,
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+// Stores the mail for delivery. It is stored even if ctx is canceled,
+// e.g. by a client disconnect, as the request already did its work.
+func (o *Outbox) Enqueue(ctx context.Context, e OutboxEmail) error {
+	if o.DB == nil {
+		return o.deliver(context.WithoutCancel(ctx), e)
+	}
+
+	ctx, cancel := o.DB.Timeout(context.WithoutCancel(ctx))
+	defer cancel()
+
+	tag, err := o.DB.DBPool.Exec(ctx, `
+		INSERT INTO outbox_emails (idempotency_key, template, locale, from_name, from_email,
+		to_name, to_email, subject, html, text, max_attempts, next_attempt_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		ON CONFLICT (idempotency_key) DO NOTHING`,
+		e.IdempotencyKey, e.Template, e.Locale, e.From.Name, e.From.Email,
+		e.To.Name, e.To.Email, e.Subject, e.HTML, e.Text, o.Config.MaxAttempts, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		o.Logger.Info("skipped duplicate email", "idempotency_key", e.IdempotencyKey)
+		return nil
+	}
+
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Starts the workers & the cleanup of sent mails. They stop once ctx is
+// canceled, Wait blocks until they did.
+func (o *Outbox) Start(ctx context.Context) {
+	if o.DB == nil {
+		return
+	}
+
+	for range o.Config.Workers {
+		o.wg.Add(1)
+		go func() {
+			defer o.wg.Done()
+			o.work(ctx)
+		}()
+	}
+
+	o.wg.Add(1)
+	go func() {
+		defer o.wg.Done()
+		o.startCleanup(ctx)
+	}()
+}
+
+// Blocks until the workers finished their current mail after shutdown.
+func (o *Outbox) Wait() {
+	o.wg.Wait()
+}
+
+func (o *Outbox) work(ctx context.Context) {
+	ticker := time.NewTicker(o.Config.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		// Drain everything that is due before sleeping again
+		for ctx.Err() == nil {
+			e, err := o.claim(ctx)
+			if err != nil {
+				if !errors.Is(err, pgx.ErrNoRows) && ctx.Err() == nil {
+					o.Logger.Error("failed to claim email", "error", err)
+				}
+				break
+			}
+
+			o.process(ctx, e)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-o.wake:
+		}
+	}
+}
+
+// Claims the next due mail, counting the attempt up front so mails that
+// crash their worker still run out of attempts.
+func (o *Outbox) claim(ctx context.Context) (OutboxEmail, error) {
+	ctx, cancel := o.DB.Timeout(ctx)
+	defer cancel()
+
+	now := time.Now().UTC()
+	var e OutboxEmail
+	err := o.DB.DBPool.QueryRow(ctx, `
+		UPDATE outbox_emails SET status = $1, attempts = attempts + 1, locked_until = $2, updated_at = $3
+		WHERE id = (
+			SELECT id FROM outbox_emails
+			WHERE attempts < max_attempts AND (
+				(status = $4 AND next_attempt_at <= $3) OR
+				(status = $1 AND locked_until < $3)
+			)
+			ORDER BY next_attempt_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, idempotency_key, template, locale, from_name, from_email, to_name, to_email,
+		subject, html, text, attempts, max_attempts`,
+		StatusSending, now.Add(o.Config.Lease), now, StatusPending).
+		Scan(&e.Id, &e.IdempotencyKey, &e.Template, &e.Locale, &e.From.Name, &e.From.Email,
+			&e.To.Name, &e.To.Email, &e.Subject, &e.HTML, &e.Text, &e.Attempts, &e.MaxAttempts)
+
+	return e, err
+}
+
+// Sends a claimed mail and records the outcome
+func (o *Outbox) process(ctx context.Context, e OutboxEmail) {
+	// A started send is finished on shutdown, else it might go out twice
+	ctx = context.WithoutCancel(ctx)
+
+	sendErr := o.deliver(ctx, e)
+
+	dbCtx, cancel := o.DB.Timeout(ctx)
+	defer cancel()
+
+	now := time.Now().UTC()
+	var err error
+	switch {
+	case sendErr == nil:
+		_, err = o.DB.DBPool.Exec(dbCtx, `
+			UPDATE outbox_emails SET status = $1, html = '', text = '', last_error = '',
+			locked_until = NULL, sent_at = $2, updated_at = $2 WHERE id = $3`,
+			StatusSent, now, e.Id)
+	case e.Attempts >= e.MaxAttempts:
+		o.Logger.Error("giving up on email", "error", sendErr, "id", e.Id, "attempts", e.Attempts, "email", e.To.Email)
+		_, err = o.DB.DBPool.Exec(dbCtx, `
+			UPDATE outbox_emails SET status = $1, last_error = $2, locked_until = NULL, updated_at = $3
+			WHERE id = $4`,
+			StatusFailed, sendErr.Error(), now, e.Id)
+	default:
+		retryAt := now.Add(o.Config.RetryDelay(e.Attempts))
+		o.Logger.Warn("failed to send email, retrying", "error", sendErr, "id", e.Id, "attempts", e.Attempts, "retry_at", retryAt)
+		_, err = o.DB.DBPool.Exec(dbCtx, `
+			UPDATE outbox_emails SET status = $1, last_error = $2, locked_until = NULL,
+			next_attempt_at = $3, updated_at = $4 WHERE id = $5`,
+			StatusPending, sendErr.Error(), retryAt, now, e.Id)
+	}
+	if err != nil {
+		o.Logger.Error("failed to update email status", "error", err, "id", e.Id)
+	}
+}
+
+func (o *Outbox) deliver(ctx context.Context, e OutboxEmail) error {
+	ctx, cancel := context.WithTimeout(ctx, sendTimeout)
+	defer cancel()
+
+	err := o.Transport.Send(ctx, Message{
+		From:    e.From,
+		To:      e.To,
+		Subject: e.Subject,
+		HTML:    e.HTML,
+		Text:    e.Text,
+	})
+	if err != nil {
+		return err
+	}
+
+	o.Logger.Info("sent email", "email", e.To.Email, "template", e.Template, "locale", e.Locale)
+	return nil
+}
+
+func (o *Outbox) startCleanup(ctx context.Context) {
+	ticker := time.NewTicker(1 * time.Hour)
+	defer ticker.Stop()
+
+	for {
+		o.cleanup(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Deletes old sent mails and fails claimed ones whose worker died on their last attempt
+func (o *Outbox) cleanup(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	now := time.Now().UTC()
+	_, err := o.DB.DBPool.Exec(ctx, `DELETE FROM outbox_emails WHERE status = $1 AND sent_at < $2`,
+		StatusSent, now.Add(-o.Config.Retention))
+	if err != nil {
+		o.Logger.Error("error cleaning up sent emails", "error", err)
+	}
+
+	_, err = o.DB.DBPool.Exec(ctx, `
+		UPDATE outbox_emails SET status = $1, last_error = 'lease expired', locked_until = NULL, updated_at = $2
+		WHERE status = $3 AND locked_until < $2 AND attempts >= max_attempts`,
+		StatusFailed, now, StatusSending)
+	if err != nil {
+		o.Logger.Error("error failing abandoned emails", "error", err)
+	}
+}
+
+const outboxColumns = `id, idempotency_key, template, locale, from_name, from_email, to_name, to_email,
+	subject, status, attempts, max_attempts, next_attempt_at, last_error, sent_at, created_at`
+
+func scanOutboxEmail(row pgx.Row) (OutboxEmail, error) {
+	var e OutboxEmail
+	err := row.Scan(&e.Id, &e.IdempotencyKey, &e.Template, &e.Locale, &e.From.Name, &e.From.Email,
+		&e.To.Name, &e.To.Email, &e.Subject, &e.Status, &e.Attempts, &e.MaxAttempts,
+		&e.NextAttemptAt, &e.LastError, &e.SentAt, &e.CreatedAt)
+	return e, err
+}
+
+// Lists mails matching the filter, newest first. Bodies are not loaded.
+func (o *Outbox) List(ctx context.Context, f OutboxFilter) ([]OutboxEmail, error) {
+	ctx, cancel := o.DB.Timeout(ctx)
+	defer cancel()
+
+	conditions := []string{"TRUE"}
+	args := []any{}
+	where := func(condition string, value any) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if f.Status != "" {
+		where(`status = $%d`, f.Status)
+	}
+	if f.Email != "" {
+		where(`to_email = $%d`, f.Email)
+	}
+	if f.Template != "" {
+		where(`template = $%d`, f.Template)
+	}
+
+	args = append(args, f.Limit, f.Offset)
+	rows, err := o.DB.DBPool.Query(ctx, fmt.Sprintf(`
+		SELECT %s FROM outbox_emails WHERE %s ORDER BY created_at DESC, id LIMIT $%d OFFSET $%d`,
+		outboxColumns, strings.Join(conditions, " AND "), len(args)-1, len(args)), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	mails := make([]OutboxEmail, 0)
+	for rows.Next() {
+		e, err := scanOutboxEmail(rows)
+		if err != nil {
+			return nil, err
+		}
+		mails = append(mails, e)
+	}
+
+	return mails, rows.Err()
+}
+
+func (o *Outbox) Get(ctx context.Context, id string) (OutboxEmail, error) {
+	ctx, cancel := o.DB.Timeout(ctx)
+	defer cancel()
+
+	e, err := scanOutboxEmail(o.DB.DBPool.QueryRow(ctx,
+		`SELECT `+outboxColumns+` FROM outbox_emails WHERE id = $1`, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return e, ErrMailNotFound
+	}
+
+	return e, err
+}
+
+// Queues a failed mail again with a fresh set of attempts.
+func (o *Outbox) Retry(ctx context.Context, id string) error {
+	ctx, cancel := o.DB.Timeout(ctx)
+	defer cancel()
+
+	now := time.Now().UTC()
+	tag, err := o.DB.DBPool.Exec(ctx, `
+		UPDATE outbox_emails SET status = $1, attempts = 0, max_attempts = $2,
+		next_attempt_at = $3, updated_at = $3 WHERE id = $4 AND status = $5`,
+		StatusPending, o.Config.MaxAttempts, now, id, StatusFailed)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		if _, err := o.Get(ctx, id); err != nil {
+			return err
+		}
+		return ErrMailNotFailed
+	}
+
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
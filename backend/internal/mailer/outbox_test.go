@@ -0,0 +1,104 @@
+package internal_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	config "fucku/internal/config"
+	mailer "fucku/internal/mailer"
+)
+
+type recordingTransport struct {
+	sent []mailer.Message
+	err  error
+}
+
+func (t *recordingTransport) Send(ctx context.Context, msg mailer.Message) error {
+	if t.err != nil {
+		return t.err
+	}
+	t.sent = append(t.sent, msg)
+	return nil
+}
+
+func TestRetryDelay(t *testing.T) {
+	c := mailer.OutboxConfig{BaseDelay: 30 * time.Second, MaxDelay: 5 * time.Minute}
+
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, 0},
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{4, 4 * time.Minute},
+		{5, 5 * time.Minute},
+		{50, 5 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		if got := c.RetryDelay(tt.attempts); got != tt.want {
+			t.Errorf("RetryDelay(%d) = %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestMailerWithoutDatabaseSendsRightAway(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	transport := &recordingTransport{}
+	outbox := mailer.NewOutbox(logger, nil, transport, mailer.DefaultOutboxConfig())
+
+	ac := config.NewAppConfig(logger, nil)
+	ac.Set(config.Snapshot{MailingActive: true})
+
+	from := mailer.Address{Name: "Some App", Email: "noreply@example.com"}
+	m, err := mailer.NewMailer(logger, ac, outbox, from)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.SendPasswordResetMail(context.Background(), "jane", "jane@example.com", "de", "Ab3dE6gH")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(transport.sent) != 1 {
+		t.Fatalf("expected 1 sent mail, got %d", len(transport.sent))
+	}
+	msg := transport.sent[0]
+	if msg.From != from || msg.To.Email != "jane@example.com" || msg.To.Name != "jane" {
+		t.Errorf("unexpected addresses %+v -> %+v", msg.From, msg.To)
+	}
+	if !strings.Contains(msg.Text, "Ab3dE6gH") || !strings.Contains(msg.HTML, "Ab3dE6gH") {
+		t.Errorf("expected the code in both bodies: %+v", msg)
+	}
+
+	// Nothing is sent while mailing is turned off
+	ac.Set(config.Snapshot{MailingActive: false})
+	if err := m.SendPasswordResetMail(context.Background(), "jane", "jane@example.com", "de", "Xy9zW8vU"); err != nil {
+		t.Fatal(err)
+	}
+	if len(transport.sent) != 1 {
+		t.Errorf("expected no mail while mailing is inactive, got %d", len(transport.sent))
+	}
+}
+
+func TestOutboxWithoutDatabaseReturnsSendErrors(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	transport := &recordingTransport{err: errors.New("connection refused")}
+	outbox := mailer.NewOutbox(logger, nil, transport, mailer.DefaultOutboxConfig())
+
+	err := outbox.Enqueue(context.Background(), mailer.OutboxEmail{
+		IdempotencyKey: "test:1",
+		To:             mailer.Address{Email: "jane@example.com"},
+	})
+	if err == nil {
+		t.Error("expected the transport error")
+	}
+}
@@ -0,0 +1,60 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+)
+
+// Renders any mail template with sample data, meant for development only.
+// Takes the template from the {template} path value and supports
+// locale (defaults to the default locale) & format (html or text).
+func (m *Mailer) PreviewHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("template")
+		if !slices.Contains(templateNames, name) {
+			http.Error(w, "unknown template", http.StatusNotFound)
+			return
+		}
+
+		locale := r.URL.Query().Get("locale")
+		if locale == "" {
+			locale = DefaultLocale
+		} else {
+			locale = m.Locale(locale)
+		}
+
+		mail, err := m.Templates.Render(name, locale, sampleData())
+		if err != nil {
+			m.Logger.Error("failed to render email preview", "error", err, "template", name, "locale", locale)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		switch r.URL.Query().Get("format") {
+		case "", "html":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(200)
+			fmt.Fprint(w, mail.HTML)
+		case "text":
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(200)
+			fmt.Fprintf(w, "Subject: %s\n\n%s", mail.Subject, mail.Text)
+		default:
+			http.Error(w, "format must be html or text", http.StatusBadRequest)
+		}
+	})
+}
+
+func sampleData() TemplateData {
+	data := templateData("jane")
+	data.Code = "Ab3dE6gH"
+	data.Link = appLink("/verify", url.Values{"email": {"jane@example.com"}, "code": {data.Code}})
+	data.UserAgent = "Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0"
+	data.IPAddress = "203.0.113.7"
+	data.Time = time.Now()
+
+	return data
+}
@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/smtp"
+	"strconv"
+	"time"
+)
+
+// Sends mails through an SMTP server. STARTTLS is used whenever the server
+// offers it, AUTH PLAIN whenever a username is set.
+type SMTPTransport struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	// Refuse to send over a connection without STARTTLS
+	RequireTLS bool
+	// Defaults to verifying the certificate against Host
+	TLSConfig *tls.Config
+}
+
+func (t *SMTPTransport) Send(ctx context.Context, msg Message) error {
+	data, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(t.Host, strconv.Itoa(t.Port)))
+	if err != nil {
+		return err
+	}
+
+	// Abort the conversation once ctx is done, net/smtp knows no contexts
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	c, err := smtp.NewClient(conn, t.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		config := t.TLSConfig
+		if config == nil {
+			config = &tls.Config{ServerName: t.Host}
+		}
+		if err := c.StartTLS(config); err != nil {
+			return err
+		}
+	} else if t.RequireTLS {
+		return errors.New("smtp server does not offer STARTTLS")
+	}
+
+	if t.Username != "" {
+		// PlainAuth refuses to send the password unencrypted, except to localhost
+		if err := c.Auth(smtp.PlainAuth("", t.Username, t.Password, t.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(msg.From.Email); err != nil {
+		return err
+	}
+	if err := c.Rcpt(msg.To.Email); err != nil {
+		return err
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
@@ -0,0 +1,215 @@
+package internal
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"golang.org/x/text/language"
+)
+
+//go:embed templates
+var templateFiles embed.FS
+
+// Used for users without a preference and for messages missing in a locale
+const DefaultLocale = "en"
+
+// Every locale directory may contain these, the default locale has to contain all of them
+const (
+	TemplateVerification  = "verification"
+	TemplatePasswordReset = "password_reset"
+	TemplateEmailChange   = "email_change"
+	TemplateNewLogin      = "new_login"
+	TemplateAccountLocked = "account_locked"
+)
+
+var templateNames = []string{
+	TemplateVerification,
+	TemplatePasswordReset,
+	TemplateEmailChange,
+	TemplateNewLogin,
+	TemplateAccountLocked,
+}
+
+// Everything a template may show, fields a message doesn't use stay empty
+type TemplateData struct {
+	AppName  string
+	Username string
+	Code     string
+	// Confirms from the mail instead of typing the code, needs APP_URL
+	Link string
+	// The login a new-login alert is about
+	UserAgent string
+	IPAddress string
+	Time      time.Time
+}
+
+type layoutData struct {
+	TemplateData
+	Locale  string
+	Subject string
+}
+
+type RenderedMail struct {
+	Subject string
+	HTML    string
+	Text    string
+}
+
+// Mail templates by locale. Each message is a templates/<locale>/<name>.tmpl
+// file defining "subject", "text" & "html", wrapped in the shared layouts.
+type Templates struct {
+	locales []string
+	matcher language.Matcher
+	html    map[string]*htmltemplate.Template
+	text    map[string]*texttemplate.Template
+}
+
+// Parses the templates embedded in the binary.
+func NewTemplates() (*Templates, error) {
+	sub, err := fs.Sub(templateFiles, "templates")
+	if err != nil {
+		return nil, err
+	}
+
+	return LoadTemplates(sub)
+}
+
+// Parses the layouts & every locale directory in fsys.
+func LoadTemplates(fsys fs.FS) (*Templates, error) {
+	dirs, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Templates{
+		html: make(map[string]*htmltemplate.Template),
+		text: make(map[string]*texttemplate.Template),
+	}
+
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		locale := dir.Name()
+		if _, err := language.Parse(locale); err != nil {
+			return nil, fmt.Errorf("invalid locale directory %q: %w", locale, err)
+		}
+
+		for _, name := range templateNames {
+			file := path.Join(locale, name+".tmpl")
+			if _, err := fs.Stat(fsys, file); err != nil {
+				continue
+			}
+
+			html, err := htmltemplate.ParseFS(fsys, "layout.html.tmpl", file)
+			if err != nil {
+				return nil, err
+			}
+
+			text, err := texttemplate.ParseFS(fsys, "layout.txt.tmpl", file)
+			if err != nil {
+				return nil, err
+			}
+
+			t.html[locale+"/"+name] = html
+			t.text[locale+"/"+name] = text
+		}
+
+		t.locales = append(t.locales, locale)
+	}
+
+	for _, name := range templateNames {
+		if _, ok := t.text[DefaultLocale+"/"+name]; !ok {
+			return nil, fmt.Errorf("template %s is missing for the default locale %s", name, DefaultLocale)
+		}
+	}
+
+	// The matcher falls back to its first tag
+	slices.SortFunc(t.locales, func(a, b string) int {
+		switch {
+		case a == DefaultLocale:
+			return -1
+		case b == DefaultLocale:
+			return 1
+		}
+		return strings.Compare(a, b)
+	})
+
+	tags := make([]language.Tag, len(t.locales))
+	for i, locale := range t.locales {
+		tags[i] = language.MustParse(locale)
+	}
+	t.matcher = language.NewMatcher(tags)
+
+	return t, nil
+}
+
+// The locales templates exist for, the default one first
+func (t *Templates) Locales() []string {
+	return slices.Clone(t.locales)
+}
+
+// Picks the best supported locale for the given preferences, each either a
+// language tag like de-AT or an Accept-Language header. The first one that
+// matches wins, without any match the default locale is returned.
+func (t *Templates) MatchLocale(preferences ...string) string {
+	for _, preference := range preferences {
+		tags, _, err := language.ParseAcceptLanguage(preference)
+		if err != nil || len(tags) == 0 {
+			continue
+		}
+
+		_, index, confidence := t.matcher.Match(tags...)
+		if confidence != language.No {
+			return t.locales[index]
+		}
+	}
+
+	return DefaultLocale
+}
+
+// Renders the named message in the locale, falling back to the default locale.
+func (t *Templates) Render(name, locale string, data TemplateData) (RenderedMail, error) {
+	key := locale + "/" + name
+	if _, ok := t.text[key]; !ok {
+		locale = DefaultLocale
+		key = DefaultLocale + "/" + name
+	}
+
+	text, ok := t.text[key]
+	if !ok {
+		return RenderedMail{}, fmt.Errorf("unknown mail template %q", name)
+	}
+
+	layout := layoutData{TemplateData: data, Locale: locale}
+
+	var subject bytes.Buffer
+	if err := text.ExecuteTemplate(&subject, "subject", layout); err != nil {
+		return RenderedMail{}, err
+	}
+	layout.Subject = strings.TrimSpace(subject.String())
+
+	var textBody bytes.Buffer
+	if err := text.ExecuteTemplate(&textBody, "layout.txt", layout); err != nil {
+		return RenderedMail{}, err
+	}
+
+	var htmlBody bytes.Buffer
+	if err := t.html[key].ExecuteTemplate(&htmlBody, "layout.html", layout); err != nil {
+		return RenderedMail{}, err
+	}
+
+	return RenderedMail{
+		Subject: layout.Subject,
+		HTML:    htmlBody.String(),
+		Text:    textBody.String(),
+	}, nil
+}
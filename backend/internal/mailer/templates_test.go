@@ -0,0 +1,133 @@
+package internal_test
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	mailer "fucku/internal/mailer"
+)
+
+func TestRenderEscapesHTML(t *testing.T) {
+	templates, err := mailer.NewTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := mailer.TemplateData{AppName: "Some App", Username: `<script>alert("hi")</script>`, Code: "abc"}
+	mail, err := templates.Render(mailer.TemplateVerification, "en", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(mail.HTML, "<script>") {
+		t.Errorf("username not escaped in html: %s", mail.HTML)
+	}
+	if !strings.Contains(mail.HTML, "&lt;script&gt;") {
+		t.Errorf("expected escaped username in html: %s", mail.HTML)
+	}
+	if !strings.Contains(mail.Text, data.Username) {
+		t.Errorf("expected raw username in text: %s", mail.Text)
+	}
+	if !strings.Contains(mail.Subject, "Some App") {
+		t.Errorf("unexpected subject %q", mail.Subject)
+	}
+}
+
+func TestRenderAllTemplates(t *testing.T) {
+	templates, err := mailer.NewTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{
+		mailer.TemplateVerification,
+		mailer.TemplatePasswordReset,
+		mailer.TemplateEmailChange,
+		mailer.TemplateNewLogin,
+		mailer.TemplateAccountLocked,
+	}
+
+	for _, locale := range templates.Locales() {
+		for _, name := range names {
+			mail, err := templates.Render(name, locale, mailer.TemplateData{AppName: "Some App", Username: "jane", Code: "abc"})
+			if err != nil {
+				t.Errorf("%s/%s: %v", locale, name, err)
+				continue
+			}
+			if mail.Subject == "" || mail.HTML == "" || mail.Text == "" {
+				t.Errorf("%s/%s rendered empty parts: %+v", locale, name, mail)
+			}
+		}
+	}
+}
+
+func TestRenderFallsBackToDefaultLocale(t *testing.T) {
+	templates, err := mailer.LoadTemplates(fstest.MapFS{
+		"layout.html.tmpl":       {Data: []byte(`{{define "layout.html"}}{{template "html" .}}{{end}}`)},
+		"layout.txt.tmpl":        {Data: []byte(`{{define "layout.txt"}}{{template "text" .}}{{end}}`)},
+		"en/verification.tmpl":   {Data: []byte(`{{define "subject"}}Verify{{end}}{{define "text"}}en{{end}}{{define "html"}}en{{end}}`)},
+		"en/password_reset.tmpl": {Data: []byte(`{{define "subject"}}Reset{{end}}{{define "text"}}en{{end}}{{define "html"}}en{{end}}`)},
+		"en/email_change.tmpl":   {Data: []byte(`{{define "subject"}}Change{{end}}{{define "text"}}en{{end}}{{define "html"}}en{{end}}`)},
+		"en/new_login.tmpl":      {Data: []byte(`{{define "subject"}}Login{{end}}{{define "text"}}en{{end}}{{define "html"}}en{{end}}`)},
+		"en/account_locked.tmpl": {Data: []byte(`{{define "subject"}}Locked{{end}}{{define "text"}}en{{end}}{{define "html"}}en{{end}}`)},
+		"de/verification.tmpl":   {Data: []byte(`{{define "subject"}}Bestätigen{{end}}{{define "text"}}de{{end}}{{define "html"}}de{{end}}`)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mail, err := templates.Render(mailer.TemplateVerification, "de", mailer.TemplateData{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mail.Text != "de" || mail.Subject != "Bestätigen" {
+		t.Errorf("expected the german template, got %+v", mail)
+	}
+
+	mail, err = templates.Render(mailer.TemplatePasswordReset, "de", mailer.TemplateData{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mail.Text != "en" || mail.Subject != "Reset" {
+		t.Errorf("expected the english fallback, got %+v", mail)
+	}
+}
+
+func TestLoadTemplatesRequiresDefaultLocale(t *testing.T) {
+	_, err := mailer.LoadTemplates(fstest.MapFS{
+		"layout.html.tmpl":     {Data: []byte(`{{define "layout.html"}}{{template "html" .}}{{end}}`)},
+		"layout.txt.tmpl":      {Data: []byte(`{{define "layout.txt"}}{{template "text" .}}{{end}}`)},
+		"de/verification.tmpl": {Data: []byte(`{{define "subject"}}x{{end}}{{define "text"}}x{{end}}{{define "html"}}x{{end}}`)},
+	})
+	if err == nil {
+		t.Error("expected an error without default locale templates")
+	}
+}
+
+func TestMatchLocale(t *testing.T) {
+	templates, err := mailer.NewTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		preferences []string
+		want        string
+	}{
+		{nil, "en"},
+		{[]string{""}, "en"},
+		{[]string{"de"}, "de"},
+		{[]string{"de-AT"}, "de"},
+		{[]string{"fr-FR,de;q=0.8,en;q=0.5"}, "de"},
+		{[]string{"fr"}, "en"},
+		{[]string{"", "de-CH,en;q=0.5"}, "de"},
+		{[]string{"en", "de"}, "en"},
+	}
+
+	for _, tt := range tests {
+		if got := templates.MatchLocale(tt.preferences...); got != tt.want {
+			t.Errorf("MatchLocale(%q) = %q, want %q", tt.preferences, got, tt.want)
+		}
+	}
+}
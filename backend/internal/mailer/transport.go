@@ -0,0 +1,156 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Delivers a single message, e.g. through an API, an SMTP server or the disk
+type Transport interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+type Address struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+// Formats the address for a header, encoding the name if needed
+func (a Address) String() string {
+	return (&mail.Address{Name: a.Name, Address: a.Email}).String()
+}
+
+type Message struct {
+	From    Address
+	To      Address
+	Subject string
+	HTML    string
+	Text    string
+}
+
+// Encodes the message as multipart/alternative MIME, as expected by SMTP & .eml files.
+func (m Message) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	domain := "localhost"
+	if at := strings.LastIndex(m.From.Email, "@"); at >= 0 {
+		domain = m.From.Email[at+1:]
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	header := []string{
+		"From: " + m.From.String(),
+		"To: " + m.To.String(),
+		"Subject: " + mime.QEncoding.Encode("utf-8", m.Subject),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		fmt.Sprintf("Message-ID: <%s@%s>", hex.EncodeToString(id), domain),
+		"MIME-Version: 1.0",
+		fmt.Sprintf("Content-Type: multipart/alternative; boundary=%q", mw.Boundary()),
+	}
+	buf.WriteString(strings.Join(header, "\r\n") + "\r\n\r\n")
+
+	// Clients show the last part they understand, so HTML goes last
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain", m.Text},
+		{"text/html", m.HTML},
+	} {
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType + "; charset=utf-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		qw := quotedprintable.NewWriter(w)
+		if _, err := qw.Write([]byte(part.body)); err != nil {
+			return nil, err
+		}
+		if err := qw.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// The address mails are sent from, MAIL_FROM_NAME defaults to APP_NAME
+func SenderFromEnv() Address {
+	name := os.Getenv("MAIL_FROM_NAME")
+	if name == "" {
+		name = os.Getenv("APP_NAME")
+	}
+
+	return Address{Name: name, Email: os.Getenv("MAIL_FROM_ADDRESS")}
+}
+
+// Creates the transport named in MAIL_TRANSPORT: mailjet, smtp, file or log.
+// Without a name Mailjet is used if MAILJET_KEY is set, otherwise mails are only logged.
+func TransportFromEnv(logger *slog.Logger) (Transport, error) {
+	name := os.Getenv("MAIL_TRANSPORT")
+	if name == "" {
+		name = "log"
+		if os.Getenv("MAILJET_KEY") != "" {
+			name = "mailjet"
+		}
+	}
+
+	switch name {
+	case "mailjet":
+		return NewMailjetTransport(os.Getenv("MAILJET_KEY"), os.Getenv("MAILJET_SECRET")), nil
+	case "smtp":
+		port := 587
+		if v := os.Getenv("SMTP_PORT"); v != "" {
+			p, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid SMTP_PORT %q", v)
+			}
+			port = p
+		}
+
+		if os.Getenv("SMTP_HOST") == "" {
+			return nil, errors.New("SMTP_HOST is required for the smtp mail transport")
+		}
+
+		return &SMTPTransport{
+			Host:       os.Getenv("SMTP_HOST"),
+			Port:       port,
+			Username:   os.Getenv("SMTP_USERNAME"),
+			Password:   os.Getenv("SMTP_PASSWORD"),
+			RequireTLS: os.Getenv("SMTP_REQUIRE_TLS") == "true",
+		}, nil
+	case "file":
+		dir := os.Getenv("MAIL_DIR")
+		if dir == "" {
+			dir = "mails"
+		}
+		return NewFileTransport(dir), nil
+	case "log":
+		return NewLogTransport(logger), nil
+	default:
+		return nil, fmt.Errorf("unknown MAIL_TRANSPORT %q", name)
+	}
+}
@@ -0,0 +1,196 @@
+package internal_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	mailer "fucku/internal/mailer"
+)
+
+var message = mailer.Message{
+	From:    mailer.Address{Name: "Some App", Email: "noreply@example.com"},
+	To:      mailer.Address{Name: "Jürgen", Email: "jurgen@example.com"},
+	Subject: "Your Password-Reset Code",
+	HTML:    "<h3>Hey Jürgen,</h3>your code is: abc",
+	Text:    "Hey Jürgen, your code is: abc",
+}
+
+// Parses an encoded message and returns its headers & the text and html parts
+func parseMessage(t *testing.T, data []byte) (mail.Header, map[string]string) {
+	t.Helper()
+
+	msg, err := mail.ReadMessage(strings.NewReader(string(data)))
+	if err != nil {
+		t.Fatalf("invalid message: %v", err)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("expected multipart/alternative, got %q (%v)", mediaType, err)
+	}
+
+	parts := make(map[string]string)
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("invalid part: %v", err)
+		}
+
+		body, _ := io.ReadAll(p)
+		contentType, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		parts[contentType] = string(body)
+	}
+
+	return msg.Header, parts
+}
+
+func TestMessageBytes(t *testing.T) {
+	data, err := message.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, parts := parseMessage(t, data)
+
+	subject, _ := new(mime.WordDecoder).DecodeHeader(header.Get("Subject"))
+	if subject != message.Subject {
+		t.Errorf("expected subject %q, got %q", message.Subject, subject)
+	}
+
+	to, err := header.AddressList("To")
+	if err != nil || len(to) != 1 || to[0].Name != "Jürgen" || to[0].Address != "jurgen@example.com" {
+		t.Errorf("unexpected recipient %v (%v)", to, err)
+	}
+
+	if !strings.HasSuffix(header.Get("Message-ID"), "@example.com>") {
+		t.Errorf("expected a message id of the senders domain, got %q", header.Get("Message-ID"))
+	}
+
+	// multipart.Reader decodes quoted-printable
+	if parts["text/plain"] != message.Text || parts["text/html"] != message.HTML {
+		t.Errorf("unexpected parts %q", parts)
+	}
+}
+
+func TestFileTransport(t *testing.T) {
+	dir := t.TempDir()
+	transport := mailer.NewFileTransport(filepath.Join(dir, "mails"))
+
+	if err := transport.Send(context.Background(), message); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "mails", "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("expected one .eml file, got %v", files)
+	}
+
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, parts := parseMessage(t, data); parts["text/plain"] != message.Text {
+		t.Errorf("unexpected text %q", parts["text/plain"])
+	}
+}
+
+// Accepts a single mail like a local catch-all server without TLS & AUTH
+func fakeSMTPServer(t *testing.T) (string, <-chan string) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+		reply("220 localhost ready")
+
+		var envelope, data strings.Builder
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(cmd, "EHLO"):
+				reply("250 localhost")
+			case strings.HasPrefix(cmd, "MAIL FROM"), strings.HasPrefix(cmd, "RCPT TO"):
+				envelope.WriteString(strings.TrimSpace(line) + "\n")
+				reply("250 OK")
+			case cmd == "DATA":
+				reply("354 go ahead")
+				for {
+					l, err := r.ReadString('\n')
+					if err != nil || l == ".\r\n" {
+						break
+					}
+					data.WriteString(l)
+				}
+				reply("250 OK")
+			case cmd == "QUIT":
+				reply("221 bye")
+				received <- envelope.String() + "\n" + data.String()
+				return
+			default:
+				reply("502 not implemented")
+			}
+		}
+	}()
+
+	return ln.Addr().String(), received
+}
+
+func TestSMTPTransport(t *testing.T) {
+	addr, received := fakeSMTPServer(t)
+	host, port, _ := net.SplitHostPort(addr)
+
+	transport := &mailer.SMTPTransport{Host: host}
+	transport.Port, _ = strconv.Atoi(port)
+
+	if err := transport.Send(context.Background(), message); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+
+	got := <-received
+	if !strings.Contains(got, "MAIL FROM:<noreply@example.com>") || !strings.Contains(got, "RCPT TO:<jurgen@example.com>") {
+		t.Errorf("unexpected envelope:\n%s", got)
+	}
+	if !strings.Contains(got, "Subject: Your Password-Reset Code") {
+		t.Errorf("expected the message after DATA, got:\n%s", got)
+	}
+
+	transport.RequireTLS = true
+	addr, _ = fakeSMTPServer(t)
+	_, port, _ = net.SplitHostPort(addr)
+	transport.Port, _ = strconv.Atoi(port)
+	if err := transport.Send(context.Background(), message); err == nil {
+		t.Error("expected an error without STARTTLS when TLS is required")
+	}
+}
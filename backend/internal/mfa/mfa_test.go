@@ -0,0 +1,84 @@
+package internal_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	mfa "fucku/internal/mfa"
+)
+
+// Base32 of the RFC 6238 SHA1 test secret "12345678901234567890"
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestGenerateCodeRFCVectors(t *testing.T) {
+	vectors := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	for _, v := range vectors {
+		code, err := mfa.GenerateCode(rfcSecret, time.Unix(v.unix, 0))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if code != v.code {
+			t.Errorf("expected code %s at %d, got: %s", v.code, v.unix, code)
+		}
+	}
+}
+
+func TestValidateCodeSkew(t *testing.T) {
+	secret, err := mfa.GenerateSecret()
+	if err != nil {
+		t.Fatalf("failed to generate secret: %v", err)
+	}
+
+	now := time.Now()
+	previous, _ := mfa.GenerateCode(secret, now.Add(-30*time.Second))
+	if _, ok := mfa.ValidateCode(secret, previous, now); !ok {
+		t.Errorf("expected code of the previous period to be accepted")
+	}
+
+	old, _ := mfa.GenerateCode(secret, now.Add(-5*time.Minute))
+	if _, ok := mfa.ValidateCode(secret, old, now); ok {
+		t.Errorf("expected code from five minutes ago to be rejected")
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := mfa.GenerateRecoveryCodes(10)
+	if err != nil {
+		t.Fatalf("failed to generate recovery codes: %v", err)
+	}
+
+	if len(codes) != 10 {
+		t.Fatalf("expected 10 codes, got: %d", len(codes))
+	}
+
+	if mfa.HashRecoveryCode(codes[0]) != mfa.HashRecoveryCode(strings.ToUpper(strings.ReplaceAll(codes[0], "-", ""))) {
+		t.Errorf("expected hash to ignore dashes and case")
+	}
+
+	if mfa.HashRecoveryCode(codes[0]) == mfa.HashRecoveryCode(codes[1]) {
+		t.Errorf("expected different codes to have different hashes")
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	uri := mfa.TOTPURI("Some App", "user@example.com", rfcSecret)
+	if !strings.HasPrefix(uri, "otpauth://totp/Some%20App:user@example.com?") {
+		t.Errorf("unexpected uri: %s", uri)
+	}
+
+	if !strings.Contains(uri, "secret="+rfcSecret) {
+		t.Errorf("expected uri to contain the secret, got: %s", uri)
+	}
+}
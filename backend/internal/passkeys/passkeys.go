@@ -0,0 +1,286 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	database "fucku/internal/database"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// Adapts a user and its stored credentials to webauthn.User
+type User struct {
+	Id          string
+	Username    string
+	Email       string
+	Credentials []webauthn.Credential
+}
+
+func (u *User) WebAuthnID() []byte {
+	return []byte(u.Id)
+}
+
+func (u *User) WebAuthnName() string {
+	return u.Email
+}
+
+func (u *User) WebAuthnDisplayName() string {
+	return u.Username
+}
+
+func (u *User) WebAuthnCredentials() []webauthn.Credential {
+	return u.Credentials
+}
+
+// A passkey as shown to its owner
+type Passkey struct {
+	Id         string     `json:"id"`
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+// Creates the relying party used for all ceremonies.
+func NewWebAuthn(displayName, rpId string, origins []string) (*webauthn.WebAuthn, error) {
+	return webauthn.New(&webauthn.Config{
+		RPID:          rpId,
+		RPDisplayName: displayName,
+		RPOrigins:     origins,
+	})
+}
+
+// Reads APP_NAME, WEBAUTHN_RP_ID and the comma separated WEBAUTHN_ORIGINS.
+// Passkeys are optional: without a relying party id or origins nil is returned.
+func WebAuthnFromEnv() (*webauthn.WebAuthn, error) {
+	rpId := os.Getenv("WEBAUTHN_RP_ID")
+	origins := os.Getenv("WEBAUTHN_ORIGINS")
+	if rpId == "" || origins == "" {
+		return nil, nil
+	}
+
+	return NewWebAuthn(os.Getenv("APP_NAME"), rpId, strings.Split(origins, ","))
+}
+
+// Starts a registration ceremony. Returns the options for the browser
+// and the serialized session data that has to be kept until the ceremony finishes.
+func BeginRegistration(wa *webauthn.WebAuthn, user *User) (*protocol.CredentialCreation, string, error) {
+	// Don't register the same authenticator twice
+	exclusions := webauthn.Credentials(user.Credentials).CredentialDescriptors()
+
+	creation, session, err := wa.BeginRegistration(user,
+		webauthn.WithExclusions(exclusions),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+	)
+	if err != nil {
+		return nil, "", err
+	}
+
+	sessionData, err := json.Marshal(session)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return creation, string(sessionData), nil
+}
+
+// Verifies the authenticators attestation response and returns the new credential.
+func FinishRegistration(wa *webauthn.WebAuthn, user *User, sessionData string, response []byte) (*webauthn.Credential, error) {
+	var session webauthn.SessionData
+	if err := json.Unmarshal([]byte(sessionData), &session); err != nil {
+		return nil, err
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBytes(response)
+	if err != nil {
+		return nil, err
+	}
+
+	return wa.CreateCredential(user, session, parsed)
+}
+
+// Starts a discoverable login: the authenticator picks the passkey, so the
+// options are the same for every account and tell nothing about which exist.
+// A passkey login replaces the password and the second factor, so the user
+// has to be verified (PIN, biometrics), being present isn't enough.
+// Returns the options and the serialized session data.
+func BeginLogin(wa *webauthn.WebAuthn) (*protocol.CredentialAssertion, string, error) {
+	assertion, session, err := wa.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+	if err != nil {
+		return nil, "", err
+	}
+
+	sessionData, err := json.Marshal(session)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return assertion, string(sessionData), nil
+}
+
+// Loads the owner of a passkey by the user handle the authenticator returned,
+// which is the user id.
+type UserLoader func(userId string) (*User, error)
+
+// Verifies the authenticators assertion and returns the user it belongs to
+// and the used credential with its updated sign counter.
+func FinishLogin(wa *webauthn.WebAuthn, sessionData string, response []byte, load UserLoader) (*User, *webauthn.Credential, error) {
+	var session webauthn.SessionData
+	if err := json.Unmarshal([]byte(sessionData), &session); err != nil {
+		return nil, nil, err
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBytes(response)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var user *User
+	_, credential, err := wa.ValidatePasskeyLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+		u, err := load(string(userHandle))
+		if err != nil {
+			return nil, err
+		}
+		user = u
+		return u, nil
+	}, session, parsed)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !credential.Flags.UserVerified {
+		return nil, nil, errors.New("authenticator did not verify the user")
+	}
+
+	if credential.Authenticator.CloneWarning {
+		return nil, nil, errors.New("authenticator sign count went backwards, possible cloned authenticator")
+	}
+
+	return user, credential, nil
+}
+
+// Loads all WebAuthn credentials of a user.
+func LoadCredentials(ctx context.Context, db *database.Database, userId string) ([]webauthn.Credential, error) {
+	ctx, cancel := db.Timeout(ctx)
+	defer cancel()
+
+	rows, err := db.DBPool.Query(ctx, `SELECT credential FROM webauthn_credentials WHERE user_id = $1`, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	credentials := make([]webauthn.Credential, 0)
+	for rows.Next() {
+		var raw []byte
+		if err := rows.Scan(&raw); err != nil {
+			return nil, err
+		}
+
+		var c webauthn.Credential
+		if err := json.Unmarshal(raw, &c); err != nil {
+			return nil, err
+		}
+		credentials = append(credentials, c)
+	}
+
+	return credentials, rows.Err()
+}
+
+// Stores a newly registered credential.
+func SaveCredential(ctx context.Context, db *database.Database, userId, name string, credential *webauthn.Credential) (*Passkey, error) {
+	ctx, cancel := db.Timeout(ctx)
+	defer cancel()
+
+	raw, err := json.Marshal(credential)
+	if err != nil {
+		return nil, err
+	}
+
+	var p Passkey
+	row := db.DBPool.QueryRow(ctx, `
+		INSERT INTO webauthn_credentials (user_id, credential_id, name, credential)
+		VALUES ($1, $2, $3, $4) RETURNING id, name, created_at, last_used_at`,
+		userId, credential.ID, name, raw)
+	if err := row.Scan(&p.Id, &p.Name, &p.CreatedAt, &p.LastUsedAt); err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+// Persists the sign counter & flags of a credential after a login.
+func UpdateCredential(ctx context.Context, db *database.Database, userId string, credential *webauthn.Credential) error {
+	ctx, cancel := db.Timeout(ctx)
+	defer cancel()
+
+	raw, err := json.Marshal(credential)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.DBPool.Exec(ctx, `
+		UPDATE webauthn_credentials SET credential = $1, last_used_at = CURRENT_TIMESTAMP
+		WHERE user_id = $2 AND credential_id = $3`,
+		raw, userId, credential.ID)
+
+	return err
+}
+
+// Lists the passkeys of a user, oldest first.
+func ListPasskeys(ctx context.Context, db *database.Database, userId string) ([]Passkey, error) {
+	ctx, cancel := db.Timeout(ctx)
+	defer cancel()
+
+	rows, err := db.DBPool.Query(ctx, `
+		SELECT id, name, created_at, last_used_at FROM webauthn_credentials
+		WHERE user_id = $1 ORDER BY created_at`, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	passkeys := make([]Passkey, 0)
+	for rows.Next() {
+		var p Passkey
+		if err := rows.Scan(&p.Id, &p.Name, &p.CreatedAt, &p.LastUsedAt); err != nil {
+			return nil, err
+		}
+		passkeys = append(passkeys, p)
+	}
+
+	return passkeys, rows.Err()
+}
+
+// Renames a passkey of a user. Returns false if the user has no such passkey.
+func RenamePasskey(ctx context.Context, db *database.Database, userId, id, name string) (bool, error) {
+	ctx, cancel := db.Timeout(ctx)
+	defer cancel()
+
+	tag, err := db.DBPool.Exec(ctx,
+		`UPDATE webauthn_credentials SET name = $1 WHERE id = $2 AND user_id = $3`, name, id, userId)
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
+
+// Removes a passkey of a user. Returns false if the user has no such passkey.
+func DeletePasskey(ctx context.Context, db *database.Database, userId, id string) (bool, error) {
+	ctx, cancel := db.Timeout(ctx)
+	defer cancel()
+
+	tag, err := db.DBPool.Exec(ctx,
+		`DELETE FROM webauthn_credentials WHERE id = $1 AND user_id = $2`, id, userId)
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
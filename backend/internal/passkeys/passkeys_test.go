@@ -0,0 +1,333 @@
+package internal_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	passkeys "fucku/internal/passkeys"
+
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+const (
+	testRPID   = "localhost"
+	testOrigin = "http://localhost:5173"
+)
+
+var b64 = base64.RawURLEncoding
+
+// A minimal software authenticator using "none" attestation and a P-256 key
+type softAuthenticator struct {
+	credentialId []byte
+	key          *ecdsa.PrivateKey
+	signCount    uint32
+	// Like a security key without PIN, only the user presence flag is set
+	presenceOnly bool
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	return &softAuthenticator{credentialId: id, key: key}
+}
+
+func (a *softAuthenticator) authData(flags byte, attested []byte) []byte {
+	rpHash := sha256.Sum256([]byte(testRPID))
+
+	data := append([]byte{}, rpHash[:]...)
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+
+	return append(data, attested...)
+}
+
+func clientData(t *testing.T, ceremony, challenge string) []byte {
+	raw, err := json.Marshal(map[string]any{
+		"type":      ceremony,
+		"challenge": challenge,
+		"origin":    testOrigin,
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal client data: %v", err)
+	}
+
+	return raw
+}
+
+// Answers navigator.credentials.create()
+func (a *softAuthenticator) create(t *testing.T, challenge string) []byte {
+	x, y := a.key.PublicKey.X.FillBytes(make([]byte, 32)), a.key.PublicKey.Y.FillBytes(make([]byte, 32))
+	coseKey, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  1, // P-256
+		XCoord: x,
+		YCoord: y,
+	})
+	if err != nil {
+		t.Fatalf("failed to encode cose key: %v", err)
+	}
+
+	attested := make([]byte, 16) // zero AAGUID
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.credentialId)))
+	attested = append(attested, a.credentialId...)
+	attested = append(attested, coseKey...)
+
+	// User present, user verified, attested credential data included
+	authData := a.authData(0x01|0x04|0x40, attested)
+
+	attestation, err := webauthncbor.Marshal(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": authData,
+	})
+	if err != nil {
+		t.Fatalf("failed to encode attestation object: %v", err)
+	}
+
+	raw, err := json.Marshal(map[string]any{
+		"id":    b64.EncodeToString(a.credentialId),
+		"rawId": b64.EncodeToString(a.credentialId),
+		"type":  "public-key",
+		"response": map[string]any{
+			"clientDataJSON":    b64.EncodeToString(clientData(t, "webauthn.create", challenge)),
+			"attestationObject": b64.EncodeToString(attestation),
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal creation response: %v", err)
+	}
+
+	return raw
+}
+
+// Answers navigator.credentials.get()
+func (a *softAuthenticator) get(t *testing.T, challenge string, userHandle []byte) []byte {
+	a.signCount++
+
+	flags := byte(0x01 | 0x04)
+	if a.presenceOnly {
+		flags = 0x01
+	}
+	authData := a.authData(flags, nil)
+	cd := clientData(t, "webauthn.get", challenge)
+	cdHash := sha256.Sum256(cd)
+
+	digest := sha256.Sum256(append(append([]byte{}, authData...), cdHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatalf("failed to sign assertion: %v", err)
+	}
+
+	raw, err := json.Marshal(map[string]any{
+		"id":    b64.EncodeToString(a.credentialId),
+		"rawId": b64.EncodeToString(a.credentialId),
+		"type":  "public-key",
+		"response": map[string]any{
+			"clientDataJSON":    b64.EncodeToString(cd),
+			"authenticatorData": b64.EncodeToString(authData),
+			"signature":         b64.EncodeToString(signature),
+			"userHandle":        b64.EncodeToString(userHandle),
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal assertion response: %v", err)
+	}
+
+	return raw
+}
+
+func challengeOf(t *testing.T, sessionData string) string {
+	var session webauthn.SessionData
+	if err := json.Unmarshal([]byte(sessionData), &session); err != nil {
+		t.Fatalf("failed to parse session data: %v", err)
+	}
+
+	return session.Challenge
+}
+
+func TestPasskeyRegistrationAndLogin(t *testing.T) {
+	wa, err := passkeys.NewWebAuthn("Test App", testRPID, []string{testOrigin})
+	if err != nil {
+		t.Fatalf("failed to create webauthn: %v", err)
+	}
+
+	user := &passkeys.User{Id: "4c8fc246-38a3-4605-8b1e-f42544e008b6", Username: "testuser", Email: "test@example.com"}
+	authenticator := newSoftAuthenticator(t)
+
+	// Registration
+	creation, sessionData, err := passkeys.BeginRegistration(wa, user)
+	if err != nil {
+		t.Fatalf("failed to begin registration: %v", err)
+	}
+
+	if creation.Response.RelyingParty.ID != testRPID {
+		t.Errorf("expected rp id %s, got: %s", testRPID, creation.Response.RelyingParty.ID)
+	}
+
+	credential, err := passkeys.FinishRegistration(wa, user, sessionData, authenticator.create(t, challengeOf(t, sessionData)))
+	if err != nil {
+		t.Fatalf("failed to finish registration: %v", err)
+	}
+
+	// Credentials are stored as JSON, make sure they survive the round trip
+	stored, err := json.Marshal(credential)
+	if err != nil {
+		t.Fatalf("failed to marshal credential: %v", err)
+	}
+
+	var loaded webauthn.Credential
+	if err = json.Unmarshal(stored, &loaded); err != nil {
+		t.Fatalf("failed to unmarshal credential: %v", err)
+	}
+	user.Credentials = []webauthn.Credential{loaded}
+
+	// Login
+	assertion, sessionData, err := passkeys.BeginLogin(wa)
+	if err != nil {
+		t.Fatalf("failed to begin login: %v", err)
+	}
+
+	// Discoverable, so nothing about the account is in the options
+	if len(assertion.Response.AllowedCredentials) != 0 {
+		t.Errorf("expected no allowed credentials, got: %d", len(assertion.Response.AllowedCredentials))
+	}
+
+	found, used, err := passkeys.FinishLogin(wa, sessionData, authenticator.get(t, challengeOf(t, sessionData), user.WebAuthnID()), loadUser(user))
+	if err != nil {
+		t.Fatalf("failed to finish login: %v", err)
+	}
+
+	if found.Id != user.Id {
+		t.Errorf("expected the passkey owner %s, got: %s", user.Id, found.Id)
+	}
+
+	if used.Authenticator.SignCount != 1 {
+		t.Errorf("expected sign count 1, got: %d", used.Authenticator.SignCount)
+	}
+}
+
+func TestPasskeyLoginWrongChallenge(t *testing.T) {
+	wa, err := passkeys.NewWebAuthn("Test App", testRPID, []string{testOrigin})
+	if err != nil {
+		t.Fatalf("failed to create webauthn: %v", err)
+	}
+
+	user := &passkeys.User{Id: "4c8fc246-38a3-4605-8b1e-f42544e008b6", Username: "testuser", Email: "test@example.com"}
+	authenticator := newSoftAuthenticator(t)
+
+	_, sessionData, err := passkeys.BeginRegistration(wa, user)
+	if err != nil {
+		t.Fatalf("failed to begin registration: %v", err)
+	}
+
+	credential, err := passkeys.FinishRegistration(wa, user, sessionData, authenticator.create(t, challengeOf(t, sessionData)))
+	if err != nil {
+		t.Fatalf("failed to finish registration: %v", err)
+	}
+	user.Credentials = []webauthn.Credential{*credential}
+
+	_, sessionData, err = passkeys.BeginLogin(wa)
+	if err != nil {
+		t.Fatalf("failed to begin login: %v", err)
+	}
+
+	// Replay an assertion signed for a different challenge
+	stale := b64.EncodeToString([]byte("some-other-challenge-value-12345"))
+	_, _, err = passkeys.FinishLogin(wa, sessionData, authenticator.get(t, stale, user.WebAuthnID()), loadUser(user))
+	if err == nil {
+		t.Fatalf("expected login with a foreign challenge to fail")
+	}
+}
+
+func TestPasskeyLoginUnknownUser(t *testing.T) {
+	wa, err := passkeys.NewWebAuthn("Test App", testRPID, []string{testOrigin})
+	if err != nil {
+		t.Fatalf("failed to create webauthn: %v", err)
+	}
+
+	user := &passkeys.User{Id: "4c8fc246-38a3-4605-8b1e-f42544e008b6", Username: "testuser", Email: "test@example.com"}
+	authenticator := newSoftAuthenticator(t)
+
+	_, sessionData, err := passkeys.BeginRegistration(wa, user)
+	if err != nil {
+		t.Fatalf("failed to begin registration: %v", err)
+	}
+
+	if _, err = passkeys.FinishRegistration(wa, user, sessionData, authenticator.create(t, challengeOf(t, sessionData))); err != nil {
+		t.Fatalf("failed to finish registration: %v", err)
+	}
+
+	_, sessionData, err = passkeys.BeginLogin(wa)
+	if err != nil {
+		t.Fatalf("failed to begin login: %v", err)
+	}
+
+	// The account was deleted since, so the user handle leads nowhere
+	_, _, err = passkeys.FinishLogin(wa, sessionData, authenticator.get(t, challengeOf(t, sessionData), user.WebAuthnID()), func(userId string) (*passkeys.User, error) {
+		return nil, errors.New("unknown user")
+	})
+	if err == nil {
+		t.Fatalf("expected login of an unknown user to fail")
+	}
+}
+
+func TestPasskeyLoginRequiresUserVerification(t *testing.T) {
+	wa, err := passkeys.NewWebAuthn("Test App", testRPID, []string{testOrigin})
+	if err != nil {
+		t.Fatalf("failed to create webauthn: %v", err)
+	}
+
+	user := &passkeys.User{Id: "4c8fc246-38a3-4605-8b1e-f42544e008b6", Username: "testuser", Email: "test@example.com"}
+	authenticator := newSoftAuthenticator(t)
+
+	_, sessionData, err := passkeys.BeginRegistration(wa, user)
+	if err != nil {
+		t.Fatalf("failed to begin registration: %v", err)
+	}
+
+	credential, err := passkeys.FinishRegistration(wa, user, sessionData, authenticator.create(t, challengeOf(t, sessionData)))
+	if err != nil {
+		t.Fatalf("failed to finish registration: %v", err)
+	}
+	user.Credentials = []webauthn.Credential{*credential}
+
+	_, sessionData, err = passkeys.BeginLogin(wa)
+	if err != nil {
+		t.Fatalf("failed to begin login: %v", err)
+	}
+
+	// Would skip the second factor of the user without a PIN or biometrics
+	authenticator.presenceOnly = true
+	_, _, err = passkeys.FinishLogin(wa, sessionData, authenticator.get(t, challengeOf(t, sessionData), user.WebAuthnID()), loadUser(user))
+	if err == nil {
+		t.Fatalf("expected login without user verification to fail")
+	}
+}
+
+// Resolves the user handle to user only
+func loadUser(user *passkeys.User) passkeys.UserLoader {
+	return func(userId string) (*passkeys.User, error) {
+		if userId != user.Id {
+			return nil, errors.New("unknown user")
+		}
+		return user, nil
+	}
+}
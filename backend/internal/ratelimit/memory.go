@@ -0,0 +1,75 @@
+package internal
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Keeps limits in process memory. Each instance counts on its own,
+// use PostgresStore when running several.
+type MemoryStore struct {
+	// Overridable for tests
+	Now func() time.Time
+
+	mu     sync.Mutex
+	states map[string]*memoryState
+}
+
+type memoryState struct {
+	state
+	expires time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		Now:    time.Now,
+		states: make(map[string]*memoryState),
+	}
+}
+
+func (s *MemoryStore) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.Now()
+
+	st, ok := s.states[key]
+	if !ok || now.After(st.expires) {
+		st = &memoryState{}
+		s.states[key] = st
+	}
+
+	res := take(&st.state, limit, now)
+	// Past two periods neither algorithm remembers anything
+	st.expires = now.Add(2 * limit.Period)
+
+	return res, nil
+}
+
+// Periodically drops keys that are back at their full limit until ctx is canceled.
+func (s *MemoryStore) StartCleanup(ctx context.Context) {
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.cleanup()
+		}
+	}
+}
+
+func (s *MemoryStore) cleanup() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.Now()
+	for key, st := range s.states {
+		if now.After(st.expires) {
+			delete(s.states, key)
+		}
+	}
+}
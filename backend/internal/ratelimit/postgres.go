@@ -0,0 +1,112 @@
+package internal
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	database "fucku/internal/database"
+)
+
+// Keeps limits in the rate_limits table, so all instances share them.
+// Every take locks the key's row for the duration of a short transaction.
+type PostgresStore struct {
+	DB     *database.Database
+	Logger *slog.Logger
+}
+
+func NewPostgresStore(logger *slog.Logger, db *database.Database) *PostgresStore {
+	return &PostgresStore{
+		DB:     db,
+		Logger: logger,
+	}
+}
+
+func (s *PostgresStore) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	ctx, cancel := s.DB.Timeout(ctx)
+	defer cancel()
+
+	tx, err := s.DB.DBPool.Begin(ctx)
+	if err != nil {
+		return Result{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	now := time.Now().UTC()
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO rate_limits (key, expires_at) VALUES ($1, $2)
+		ON CONFLICT (key) DO NOTHING`, key, now)
+	if err != nil {
+		return Result{}, err
+	}
+
+	var st state
+	var updated, windowStart *time.Time
+	var expires time.Time
+	row := tx.QueryRow(ctx, `
+		SELECT tokens, updated_at, window_start, current_count, previous_count, expires_at
+		FROM rate_limits WHERE key = $1 FOR UPDATE`, key)
+	if err := row.Scan(&st.Tokens, &updated, &windowStart, &st.Current, &st.Previous, &expires); err != nil {
+		return Result{}, err
+	}
+
+	// Expired rows count as new, the cleanup may not have removed them yet
+	if !expires.Before(now) {
+		if updated != nil {
+			st.Updated = *updated
+		}
+		if windowStart != nil {
+			st.WindowStart = *windowStart
+		}
+	} else {
+		st = state{}
+	}
+
+	res := take(&st, limit, now)
+
+	_, err = tx.Exec(ctx, `
+		UPDATE rate_limits SET tokens = $1, updated_at = $2, window_start = $3,
+		current_count = $4, previous_count = $5, expires_at = $6 WHERE key = $7`,
+		st.Tokens, nullTime(st.Updated), nullTime(st.WindowStart), st.Current, st.Previous,
+		now.Add(2*limit.Period), key)
+	if err != nil {
+		return Result{}, err
+	}
+
+	return res, tx.Commit(ctx)
+}
+
+func nullTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+
+	return &t
+}
+
+// Periodically removes keys that are back at their full limit until ctx is canceled.
+func (s *PostgresStore) StartCleanup(ctx context.Context) {
+	ticker := time.NewTicker(10 * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		s.cleanup(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *PostgresStore) cleanup(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	_, err := s.DB.DBPool.Exec(ctx, `DELETE FROM rate_limits WHERE expires_at < $1`, time.Now().UTC())
+	if err != nil {
+		s.Logger.Error("error cleaning up rate limits", "error", err)
+	}
+}
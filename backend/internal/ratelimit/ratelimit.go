@@ -0,0 +1,159 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	utils "fucku/internal/utils"
+)
+
+type Algorithm int
+
+const (
+	// Allows bursts of up to Requests, refilled evenly over Period
+	TokenBucket Algorithm = iota
+	// Allows Requests per rolling Period, weighting the previous window
+	SlidingWindow
+)
+
+type Limit struct {
+	Algorithm Algorithm
+	Requests  int
+	Period    time.Duration
+}
+
+func (l Limit) String() string {
+	return fmt.Sprintf("%d;w=%d", l.Requests, int(l.Period.Seconds()))
+}
+
+// The outcome of taking one request from a limit
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Time until the limit is fully available again
+	Reset time.Duration
+	// Time until the next request would be allowed, zero if allowed
+	RetryAfter time.Duration
+}
+
+// Keeps the state of all limits. Implementations have to be safe for
+// concurrent use and apply a take atomically.
+type Store interface {
+	Take(ctx context.Context, key string, limit Limit) (Result, error)
+}
+
+// Derives the key a request is counted under
+type KeyFunc func(r *http.Request) string
+
+// Counts requests per client IP.
+func ByIP(r *http.Request) string {
+	return "ip:" + utils.ClientIP(r)
+}
+
+// Counts all requests to a route together.
+func ByRoute(r *http.Request) string {
+	return "route:" + r.Pattern
+}
+
+// Sets the RateLimit-* headers and Retry-After if the request was denied.
+func WriteHeaders(w http.ResponseWriter, limit Limit, res Result) {
+	w.Header().Set("RateLimit-Policy", limit.String())
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(seconds(res.Reset)))
+
+	if !res.Allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(max(seconds(res.RetryAfter), 1)))
+	}
+}
+
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// State of one key. Token buckets use Tokens & Updated,
+// sliding windows use WindowStart, Current & Previous.
+type state struct {
+	Tokens      float64
+	Updated     time.Time
+	WindowStart time.Time
+	Current     int
+	Previous    int
+}
+
+func take(s *state, limit Limit, now time.Time) Result {
+	if limit.Algorithm == SlidingWindow {
+		return takeSlidingWindow(s, limit, now)
+	}
+
+	return takeTokenBucket(s, limit, now)
+}
+
+func takeTokenBucket(s *state, limit Limit, now time.Time) Result {
+	capacity := float64(limit.Requests)
+	rate := capacity / limit.Period.Seconds()
+
+	if s.Updated.IsZero() {
+		s.Tokens = capacity
+	} else if elapsed := now.Sub(s.Updated).Seconds(); elapsed > 0 {
+		s.Tokens = math.Min(capacity, s.Tokens+elapsed*rate)
+	}
+	s.Updated = now
+
+	res := Result{Limit: limit.Requests}
+	if s.Tokens >= 1 {
+		s.Tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = duration((1 - s.Tokens) / rate)
+	}
+
+	res.Remaining = int(math.Floor(s.Tokens))
+	res.Reset = duration((capacity - s.Tokens) / rate)
+
+	return res
+}
+
+func takeSlidingWindow(s *state, limit Limit, now time.Time) Result {
+	start := now.Truncate(limit.Period)
+
+	if !s.WindowStart.Equal(start) {
+		if start.Sub(s.WindowStart) == limit.Period {
+			s.Previous = s.Current
+		} else {
+			s.Previous = 0
+		}
+		s.Current = 0
+		s.WindowStart = start
+	}
+
+	elapsed := now.Sub(start)
+	weight := 1 - elapsed.Seconds()/limit.Period.Seconds()
+	estimate := float64(s.Previous)*weight + float64(s.Current)
+
+	res := Result{Limit: limit.Requests, Reset: limit.Period - elapsed}
+	if estimate+1 <= float64(limit.Requests) {
+		s.Current++
+		estimate++
+		res.Allowed = true
+	} else if s.Current+1 <= limit.Requests && s.Previous > 0 {
+		// Wait until the previous window weighs little enough
+		target := float64(limit.Requests-s.Current-1) / float64(s.Previous)
+		res.RetryAfter = duration((1-target)*limit.Period.Seconds()) - elapsed
+	} else {
+		res.RetryAfter = limit.Period - elapsed
+	}
+
+	res.Remaining = max(limit.Requests-int(math.Ceil(estimate)), 0)
+
+	return res
+}
+
+func duration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
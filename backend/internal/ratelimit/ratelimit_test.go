@@ -0,0 +1,112 @@
+package internal_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	ratelimit "fucku/internal/ratelimit"
+)
+
+func newStore(now *time.Time) *ratelimit.MemoryStore {
+	store := ratelimit.NewMemoryStore()
+	store.Now = func() time.Time { return *now }
+	return store
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	store := newStore(&now)
+	limit := ratelimit.Limit{Algorithm: ratelimit.TokenBucket, Requests: 3, Period: 3 * time.Second}
+
+	for i := range 3 {
+		res, _ := store.Take(context.Background(), "key", limit)
+		if !res.Allowed {
+			t.Fatalf("request %d denied within burst", i+1)
+		}
+		if res.Remaining != 2-i {
+			t.Errorf("remaining = %d, want %d", res.Remaining, 2-i)
+		}
+	}
+
+	res, _ := store.Take(context.Background(), "key", limit)
+	if res.Allowed {
+		t.Fatal("request allowed after burst was used up")
+	}
+	if res.RetryAfter != time.Second {
+		t.Errorf("retry after = %s, want 1s", res.RetryAfter)
+	}
+
+	now = now.Add(time.Second)
+	if res, _ := store.Take(context.Background(), "key", limit); !res.Allowed {
+		t.Error("request denied after a token was refilled")
+	}
+
+	if res, _ := store.Take(context.Background(), "other", limit); !res.Allowed {
+		t.Error("keys are not counted separately")
+	}
+}
+
+func TestSlidingWindow(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	store := newStore(&now)
+	limit := ratelimit.Limit{Algorithm: ratelimit.SlidingWindow, Requests: 4, Period: time.Minute}
+
+	for i := range 4 {
+		if res, _ := store.Take(context.Background(), "key", limit); !res.Allowed {
+			t.Fatalf("request %d denied within limit", i+1)
+		}
+	}
+
+	res, _ := store.Take(context.Background(), "key", limit)
+	if res.Allowed {
+		t.Fatal("request allowed over limit")
+	}
+	if res.RetryAfter != time.Minute {
+		t.Errorf("retry after = %s, want 1m", res.RetryAfter)
+	}
+
+	// Halfway into the next window the previous one still counts half
+	now = now.Add(90 * time.Second)
+	for i := range 2 {
+		if res, _ := store.Take(context.Background(), "key", limit); !res.Allowed {
+			t.Fatalf("request %d denied although previous window weighs half", i+1)
+		}
+	}
+	if res, _ := store.Take(context.Background(), "key", limit); res.Allowed {
+		t.Error("request allowed over weighted limit")
+	}
+
+	// Two windows later everything is forgotten
+	now = now.Add(2 * time.Minute)
+	res, _ = store.Take(context.Background(), "key", limit)
+	if !res.Allowed || res.Remaining != 3 {
+		t.Errorf("allowed = %t, remaining = %d, want true & 3", res.Allowed, res.Remaining)
+	}
+}
+
+func TestWriteHeaders(t *testing.T) {
+	limit := ratelimit.Limit{Algorithm: ratelimit.TokenBucket, Requests: 10, Period: time.Minute}
+	w := httptest.NewRecorder()
+
+	ratelimit.WriteHeaders(w, limit, ratelimit.Result{
+		Limit:      10,
+		Remaining:  0,
+		Reset:      59500 * time.Millisecond,
+		RetryAfter: 200 * time.Millisecond,
+	})
+
+	want := map[string]string{
+		"RateLimit-Policy":    "10;w=60",
+		"RateLimit-Limit":     "10",
+		"RateLimit-Remaining": "0",
+		"RateLimit-Reset":     "60",
+		"Retry-After":         "1",
+	}
+	for header, value := range want {
+		if got := w.Header().Get(header); got != value {
+			t.Errorf("%s = %q, want %q", header, got, value)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"slices"
+
+	database "fucku/internal/database"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	PermUsersRead   = "users:read"
+	PermUsersWrite  = "users:write"
+	PermUsersDelete = "users:delete"
+	PermAuditRead   = "audit:read"
+	PermMailRead    = "mail:read"
+	PermMailWrite   = "mail:write"
+)
+
+const (
+	RoleAdmin   = "admin"
+	RoleSupport = "support"
+)
+
+var ErrRoleNotFound = errors.New("role not found")
+
+// Roles and their permissions created on startup.
+// Existing grants are kept, so permissions can only be added here.
+var DefaultRoles = map[string][]string{
+	RoleAdmin:   {PermUsersRead, PermUsersWrite, PermUsersDelete, PermAuditRead, PermMailRead, PermMailWrite},
+	RoleSupport: {PermUsersRead, PermUsersWrite, PermAuditRead, PermMailRead, PermMailWrite},
+}
+
+// The permission names granted to a user through their roles
+type Permissions []string
+
+func (p Permissions) Has(permission string) bool {
+	return slices.Contains(p, permission)
+}
+
+// Creates the default roles & permissions if they don't exist yet.
+func SeedRoles(ctx context.Context, db *database.Database) error {
+	ctx, cancel := db.Timeout(ctx)
+	defer cancel()
+
+	for role, permissions := range DefaultRoles {
+		_, err := db.DBPool.Exec(ctx, `INSERT INTO roles (name) VALUES ($1) ON CONFLICT (name) DO NOTHING`, role)
+		if err != nil {
+			return err
+		}
+
+		for _, permission := range permissions {
+			_, err = db.DBPool.Exec(ctx, `INSERT INTO permissions (name) VALUES ($1) ON CONFLICT (name) DO NOTHING`, permission)
+			if err != nil {
+				return err
+			}
+
+			_, err = db.DBPool.Exec(ctx, `
+				INSERT INTO role_permissions (role_id, permission_id)
+				SELECT r.id, p.id FROM roles r, permissions p WHERE r.name = $1 AND p.name = $2
+				ON CONFLICT DO NOTHING`, role, permission)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Loads all permissions a user has through their roles.
+func LoadPermissions(ctx context.Context, db *database.Database, userId string) (Permissions, error) {
+	ctx, cancel := db.Timeout(ctx)
+	defer cancel()
+
+	rows, err := db.DBPool.Query(ctx, `
+		SELECT DISTINCT p.name FROM user_roles ur
+		JOIN role_permissions rp ON rp.role_id = ur.role_id
+		JOIN permissions p ON p.id = rp.permission_id
+		WHERE ur.user_id = $1 ORDER BY p.name`, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	permissions, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, err
+	}
+
+	return Permissions(permissions), nil
+}
+
+// Lists the role names of a user.
+func UserRoles(ctx context.Context, db *database.Database, userId string) ([]string, error) {
+	ctx, cancel := db.Timeout(ctx)
+	defer cancel()
+
+	rows, err := db.DBPool.Query(ctx, `
+		SELECT r.name FROM user_roles ur JOIN roles r ON r.id = ur.role_id
+		WHERE ur.user_id = $1 ORDER BY r.name`, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+// Grants a role to a user. Granting a role twice is a no-op.
+func AssignRole(ctx context.Context, db *database.Database, userId, role string) error {
+	ctx, cancel := db.Timeout(ctx)
+	defer cancel()
+
+	tag, err := db.DBPool.Exec(ctx, `
+		INSERT INTO user_roles (user_id, role_id)
+		SELECT $1, id FROM roles WHERE name = $2
+		ON CONFLICT DO NOTHING`, userId, role)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		// Either the role is missing or the user already has it
+		var exists bool
+		row := db.DBPool.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM roles WHERE name = $1)`, role)
+		if err = row.Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return ErrRoleNotFound
+		}
+	}
+
+	return nil
+}
+
+// Takes a role away from a user.
+func RemoveRole(ctx context.Context, db *database.Database, userId, role string) error {
+	ctx, cancel := db.Timeout(ctx)
+	defer cancel()
+
+	_, err := db.DBPool.Exec(ctx, `
+		DELETE FROM user_roles WHERE user_id = $1
+		AND role_id = (SELECT id FROM roles WHERE name = $2)`, userId, role)
+
+	return err
+}
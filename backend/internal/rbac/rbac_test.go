@@ -0,0 +1,38 @@
+package internal_test
+
+import (
+	"testing"
+
+	rbac "fucku/internal/rbac"
+)
+
+func TestPermissionsHas(t *testing.T) {
+	p := rbac.Permissions{rbac.PermUsersRead, rbac.PermAuditRead}
+
+	if !p.Has(rbac.PermUsersRead) {
+		t.Errorf("expected %s to be granted", rbac.PermUsersRead)
+	}
+
+	if p.Has(rbac.PermUsersDelete) {
+		t.Errorf("expected %s to be denied", rbac.PermUsersDelete)
+	}
+
+	if (rbac.Permissions)(nil).Has(rbac.PermUsersRead) {
+		t.Errorf("expected no permissions to deny everything")
+	}
+}
+
+func TestDefaultRoles(t *testing.T) {
+	admin := rbac.Permissions(rbac.DefaultRoles[rbac.RoleAdmin])
+	for _, permissions := range rbac.DefaultRoles {
+		for _, permission := range permissions {
+			if !admin.Has(permission) {
+				t.Errorf("expected admin to have %s", permission)
+			}
+		}
+	}
+
+	if rbac.Permissions(rbac.DefaultRoles[rbac.RoleSupport]).Has(rbac.PermUsersDelete) {
+		t.Errorf("expected support to not be able to delete users")
+	}
+}
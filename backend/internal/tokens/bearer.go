@@ -0,0 +1,148 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	audit "fucku/internal/audit"
+)
+
+var (
+	ErrRefreshTokenReused = errors.New("refresh token reused")
+	ErrUserInactive       = errors.New("user may not log in")
+)
+
+// Reports whether a user may still log in, returns ErrUserInactive if they
+// were deleted or suspended. See users.UserActive
+type UserActiveFunc func(ctx context.Context, userId string) error
+
+// Access & refresh token of a bearer login, for clients that can't keep
+// cookies. Both belong to a session row, which makes them one family.
+type BearerTokens struct {
+	Access  *Token
+	Refresh *Token
+}
+
+// Starts a bearer login: a session for the device plus its first pair of
+// access & refresh token.
+func (ts *TokenService) NewBearerTokens(ctx context.Context, userId, userAgent, ipAddress string) (*BearerTokens, error) {
+	now := time.Now().UTC()
+	session, err := ts.newSession(ctx, userId, userAgent, ipAddress, true, true, now.Add(ts.sessionConfig().RefreshTokenTTL))
+	if err != nil {
+		return nil, err
+	}
+
+	return ts.issueBearerTokens(ctx, userId, session.Id, now)
+}
+
+// Exchanges a refresh token for a new pair. Every refresh token works once,
+// presenting a used one again means it was stolen: the whole family is
+// revoked and ErrRefreshTokenReused returned. Fails with ErrTokenNotFound if
+// the session was logged out, and ErrUserInactive if its user was suspended.
+func (ts *TokenService) RefreshBearerTokens(ctx context.Context, value string) (*BearerTokens, error) {
+	refresh, err := ts.Store.Find(ctx, TypeRefresh, value)
+	if err != nil {
+		return nil, err
+	}
+
+	if refresh.UsedAt != nil {
+		return nil, ts.revokeFamily(ctx, refresh)
+	}
+
+	now := time.Now().UTC()
+	if refresh.ExpiresAt.Before(now) {
+		return nil, ErrTokenExpired
+	}
+
+	// Lost a race against another refresh with the same token
+	marked, err := ts.Store.MarkUsed(ctx, refresh.Id)
+	if err != nil {
+		return nil, err
+	}
+	if !marked {
+		return nil, ts.revokeFamily(ctx, refresh)
+	}
+
+	// The refresh token may outlive its session by a race with a logout
+	if _, err := ts.Store.FindSession(ctx, refresh.SessionId); err != nil {
+		return nil, err
+	}
+
+	if ts.UserActive != nil {
+		if err := ts.UserActive(ctx, refresh.UserId); err != nil {
+			return nil, err
+		}
+	}
+
+	// Keeps the session listed as long as the new refresh token is valid
+	if _, err := ts.Store.TouchSession(ctx, refresh.SessionId, now.Add(ts.sessionConfig().RefreshTokenTTL)); err != nil {
+		return nil, err
+	}
+
+	return ts.issueBearerTokens(ctx, refresh.UserId, refresh.SessionId, now)
+}
+
+func (ts *TokenService) issueBearerTokens(ctx context.Context, userId, sessionId string, now time.Time) (*BearerTokens, error) {
+	sessions := ts.sessionConfig()
+
+	var access *Token
+	if ts.JWTKeys != nil {
+		jwtAccess, err := ts.newJWTAccessToken(ctx, userId, sessionId, now)
+		if err != nil {
+			return nil, err
+		}
+		access = jwtAccess
+	} else {
+		accessValue, err := ts.newUniqueToken(32)
+		if err != nil {
+			return nil, err
+		}
+
+		access, err = ts.Store.Insert(ctx, TokenParams{
+			UserId:    userId,
+			TokenType: TypeAccess,
+			Token:     accessValue,
+			SessionId: sessionId,
+			ExpiresAt: now.Add(sessions.AccessTokenTTL),
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	refreshValue, err := ts.newUniqueToken(48)
+	if err != nil {
+		return nil, err
+	}
+
+	refresh, err := ts.Store.Insert(ctx, TokenParams{
+		UserId:    userId,
+		TokenType: TypeRefresh,
+		Token:     refreshValue,
+		SessionId: sessionId,
+		ExpiresAt: now.Add(sessions.RefreshTokenTTL),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &BearerTokens{Access: access, Refresh: refresh}, nil
+}
+
+// Revokes the session a reused refresh token belongs to, with all its tokens
+func (ts *TokenService) revokeFamily(ctx context.Context, refresh *Token) error {
+	if _, err := ts.Store.DeleteSession(ctx, refresh.UserId, refresh.SessionId); err != nil {
+		return err
+	}
+
+	audit.Record(ctx, ts.DB, ts.Logger, nil, audit.Event{
+		UserId:    refresh.UserId,
+		EventType: audit.EventRefreshTokenReused,
+		Outcome:   audit.OutcomeFailure,
+		Metadata:  map[string]any{"session_id": refresh.SessionId},
+	})
+	ts.Logger.Warn("refresh token reused, revoked its session", "user_id", refresh.UserId, "session_id", refresh.SessionId)
+
+	return ErrRefreshTokenReused
+}
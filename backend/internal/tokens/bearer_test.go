@@ -0,0 +1,75 @@
+package internal_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	token "fucku/internal/tokens"
+)
+
+func TestMemoryBearerTokens(t *testing.T) {
+	mts := newMemoryTokenService()
+	userId := "4c8fc246-38a3-4605-8b1e-f42544e008b6"
+
+	first, err := mts.NewBearerTokens(context.Background(), userId, "cli", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("failed to create bearer tokens: %v", err)
+	}
+
+	if first.Access.SessionId == "" || first.Access.SessionId != first.Refresh.SessionId {
+		t.Fatalf("expected both tokens to belong to one session, got: %+v", first)
+	}
+
+	sessions, err := mts.ListSessions(context.Background(), userId)
+	if err != nil || len(sessions) != 1 || sessions[0].Id != first.Access.SessionId {
+		t.Errorf("expected the bearer login to be listed as session, got: %+v (%v)", sessions, err)
+	}
+
+	second, err := mts.RefreshBearerTokens(context.Background(), first.Refresh.Token)
+	if err != nil {
+		t.Fatalf("failed to refresh: %v", err)
+	}
+	if second.Refresh.SessionId != first.Refresh.SessionId || second.Refresh.Token == first.Refresh.Token {
+		t.Errorf("expected a new refresh token of the same session, got: %+v", second.Refresh)
+	}
+
+	if _, err := mts.RefreshBearerTokens(context.Background(), first.Refresh.Token); !errors.Is(err, token.ErrRefreshTokenReused) {
+		t.Fatalf("expected ErrRefreshTokenReused, got: %v", err)
+	}
+
+	for _, value := range []string{second.Access.Token, first.Access.Token} {
+		if _, err := mts.GetToken(context.Background(), token.TypeAccess, value); !errors.Is(err, token.ErrTokenNotFound) {
+			t.Errorf("expected access tokens of the family to be revoked, got: %v", err)
+		}
+	}
+	if _, err := mts.RefreshBearerTokens(context.Background(), second.Refresh.Token); !errors.Is(err, token.ErrTokenNotFound) {
+		t.Errorf("expected the latest refresh token to be revoked, got: %v", err)
+	}
+}
+
+func TestMemoryRevokeBearerSession(t *testing.T) {
+	mts := newMemoryTokenService()
+	userId := "4c8fc246-38a3-4605-8b1e-f42544e008b6"
+
+	laptop, err := mts.NewSessionToken(context.Background(), userId, "laptop", "127.0.0.1", false)
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+
+	cli, err := mts.NewBearerTokens(context.Background(), userId, "cli", "127.0.0.2")
+	if err != nil {
+		t.Fatalf("failed to create bearer tokens: %v", err)
+	}
+
+	if err := mts.RevokeOtherSessions(context.Background(), userId, laptop.Id); err != nil {
+		t.Fatalf("failed to revoke other sessions: %v", err)
+	}
+
+	if _, err := mts.GetToken(context.Background(), token.TypeRefresh, cli.Refresh.Token); !errors.Is(err, token.ErrTokenNotFound) {
+		t.Errorf("expected the bearer login to be revoked, got: %v", err)
+	}
+	if _, err := mts.GetToken(context.Background(), token.TypeSession, laptop.Token); err != nil {
+		t.Errorf("expected the kept session to stay valid, got: %v", err)
+	}
+}
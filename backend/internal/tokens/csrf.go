@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+)
+
+var ErrNoCSRFSecret = errors.New("no CSRF secret configured")
+
+// Keys CSRF tokens are signed with. The first one signs new tokens, the
+// retired ones are only accepted, so a secret can be rotated by retiring
+// it. A CSRF token lives as long as its session, so a retired secret can
+// go once the sessions from before the rotation expired, at the latest
+// after SessionConfig.RememberLifetime.
+type CSRFSecrets struct {
+	keys [][]byte
+}
+
+// Takes the active secret first, followed by the retired ones.
+func NewCSRFSecrets(active string, retired ...string) (*CSRFSecrets, error) {
+	if active == "" {
+		return nil, ErrNoCSRFSecret
+	}
+
+	s := &CSRFSecrets{keys: [][]byte{[]byte(active)}}
+	for _, secret := range retired {
+		if secret != "" {
+			s.keys = append(s.keys, []byte(secret))
+		}
+	}
+
+	return s, nil
+}
+
+// Reads CSRF_SECRET and the comma separated CSRF_RETIRED_SECRETS.
+func CSRFSecretsFromEnv() (*CSRFSecrets, error) {
+	var retired []string
+	if v := os.Getenv("CSRF_RETIRED_SECRETS"); v != "" {
+		for _, secret := range strings.Split(v, ",") {
+			retired = append(retired, strings.TrimSpace(secret))
+		}
+	}
+
+	return NewCSRFSecrets(os.Getenv("CSRF_SECRET"), retired...)
+}
+
+// Creates a token of a random nonce and its signature over the session id,
+// so the token is worthless for any other session.
+func (s *CSRFSecrets) Sign(sessionId string) (string, error) {
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	n := hex.EncodeToString(nonce)
+	return n + "." + hex.EncodeToString(csrfMAC(s.keys[0], sessionId, n)), nil
+}
+
+// Reports whether value was signed for sessionId by any of the secrets.
+func (s *CSRFSecrets) Verify(value, sessionId string) bool {
+	nonce, sig, ok := strings.Cut(value, ".")
+	if !ok || nonce == "" {
+		return false
+	}
+
+	mac, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+
+	for _, key := range s.keys {
+		if hmac.Equal(mac, csrfMAC(key, sessionId, nonce)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func csrfMAC(key []byte, sessionId, nonce string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(sessionId))
+	h.Write([]byte{0})
+	h.Write([]byte(nonce))
+	return h.Sum(nil)
+}
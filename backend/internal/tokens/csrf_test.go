@@ -0,0 +1,73 @@
+package internal_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	token "fucku/internal/tokens"
+)
+
+func TestCSRFTokenBoundToSession(t *testing.T) {
+	secrets, err := token.NewCSRFSecrets("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := secrets.Sign("session-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !secrets.Verify(value, "session-a") {
+		t.Error("expected the token to verify for its session")
+	}
+	if secrets.Verify(value, "session-b") {
+		t.Error("expected the token to be rejected for another session")
+	}
+
+	for _, forged := range []string{"", "abc", value + "00", "." + value, "nonce.zz"} {
+		if secrets.Verify(forged, "session-a") {
+			t.Errorf("expected %q to be rejected", forged)
+		}
+	}
+}
+
+func TestCSRFSecretRotation(t *testing.T) {
+	old, _ := token.NewCSRFSecrets("old")
+	value, err := old.Sign("session-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, _ := token.NewCSRFSecrets("new", "old")
+	if !rotated.Verify(value, "session-a") {
+		t.Error("expected tokens of a retired secret to stay valid")
+	}
+
+	fresh, _ := rotated.Sign("session-a")
+	if old.Verify(fresh, "session-a") {
+		t.Error("expected new tokens to be signed with the active secret")
+	}
+
+	dropped, _ := token.NewCSRFSecrets("new")
+	if dropped.Verify(value, "session-a") {
+		t.Error("expected tokens of a removed secret to be rejected")
+	}
+}
+
+func TestCSRFSecretRequired(t *testing.T) {
+	if _, err := token.NewCSRFSecrets("", "old"); !errors.Is(err, token.ErrNoCSRFSecret) {
+		t.Errorf("expected ErrNoCSRFSecret, got: %v", err)
+	}
+
+	t.Setenv("CSRF_SECRET", "")
+	if _, err := token.CSRFSecretsFromEnv(); !errors.Is(err, token.ErrNoCSRFSecret) {
+		t.Errorf("expected ErrNoCSRFSecret from env, got: %v", err)
+	}
+
+	mts := &token.TokenService{Logger: logger, Store: token.NewMemoryTokenStore()}
+	if _, err := mts.NewCSRFToken(context.Background(), &token.Token{Id: "session", UserId: "user"}); !errors.Is(err, token.ErrNoCSRFSecret) {
+		t.Errorf("expected NewCSRFToken to fail without secrets, got: %v", err)
+	}
+}
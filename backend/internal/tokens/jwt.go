@@ -0,0 +1,258 @@
+package internal
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"fucku/pkg/jwtverify"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+var ErrNoJWTIssuer = errors.New("no JWT issuer configured")
+
+// Keys JWT access tokens are signed with, Ed25519 (EdDSA) or RSA (RS256).
+// The first one signs new tokens, the retired ones are only published in
+// the JWKS, so a key can be rotated by retiring it. Once the tokens signed
+// with it expired (after SESSION_ACCESS_TOKEN_TTL) it can go.
+type JWTKeys struct {
+	issuer string
+	// Optional aud claim
+	audience string
+	keys     []jwtKey
+	verifier *jwtverify.Verifier
+}
+
+type jwtKey struct {
+	jwk    jwtverify.JWK
+	signer crypto.Signer
+	method jwt.SigningMethod
+}
+
+// What a JWT access token tells about its user
+type JWTSubject struct {
+	Username string
+	Verified bool
+	Roles    []string
+}
+
+// Looks up the user of a JWT access token, see users.JWTSubjects
+type JWTSubjectFunc func(ctx context.Context, userId string) (JWTSubject, error)
+
+// Takes the active key first, followed by the retired ones. Every key is
+// identified by its RFC 7638 thumbprint in the kid header.
+func NewJWTKeys(issuer, audience string, active crypto.Signer, retired ...crypto.Signer) (*JWTKeys, error) {
+	if issuer == "" {
+		return nil, ErrNoJWTIssuer
+	}
+
+	k := &JWTKeys{issuer: issuer, audience: audience}
+	for _, signer := range append([]crypto.Signer{active}, retired...) {
+		var method jwt.SigningMethod
+		switch signer.Public().(type) {
+		case ed25519.PublicKey:
+			method = jwt.SigningMethodEdDSA
+		case *rsa.PublicKey:
+			method = jwt.SigningMethodRS256
+		default:
+			return nil, jwtverify.ErrUnsupportedKey
+		}
+
+		jwk, err := jwtverify.NewJWK("", signer.Public())
+		if err != nil {
+			return nil, err
+		}
+
+		k.keys = append(k.keys, jwtKey{jwk: jwk, signer: signer, method: method})
+	}
+
+	verifier, err := jwtverify.NewStaticVerifier(k.JWKS(), issuer, audience)
+	if err != nil {
+		return nil, err
+	}
+	k.verifier = verifier
+
+	return k, nil
+}
+
+// Reads the PEM encoded PKCS #8 key in JWT_SIGNING_KEY_FILE and the comma
+// separated JWT_RETIRED_KEY_FILES. Without a signing key JWT access tokens
+// are off and nil is returned. The issuer defaults to APP_URL.
+func JWTKeysFromEnv() (*JWTKeys, error) {
+	path := os.Getenv("JWT_SIGNING_KEY_FILE")
+	if path == "" {
+		return nil, nil
+	}
+
+	active, err := loadJWTKey(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var retired []crypto.Signer
+	if v := os.Getenv("JWT_RETIRED_KEY_FILES"); v != "" {
+		for _, path := range strings.Split(v, ",") {
+			key, err := loadJWTKey(strings.TrimSpace(path))
+			if err != nil {
+				return nil, err
+			}
+			retired = append(retired, key)
+		}
+	}
+
+	issuer := os.Getenv("JWT_ISSUER")
+	if issuer == "" {
+		issuer = os.Getenv("APP_URL")
+	}
+
+	return NewJWTKeys(issuer, os.Getenv("JWT_AUDIENCE"), active, retired...)
+}
+
+func loadJWTKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block in %s", path)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", path, jwtverify.ErrUnsupportedKey)
+	}
+
+	return signer, nil
+}
+
+// Signs an access token with the active key.
+func (k *JWTKeys) Sign(claims jwtverify.Claims) (string, error) {
+	active := k.keys[0]
+
+	t := jwt.NewWithClaims(active.method, claims)
+	t.Header["kid"] = active.jwk.Kid
+	t.Header["typ"] = jwtverify.TokenType
+
+	return t.SignedString(active.signer)
+}
+
+// Returns the public keys of all keys, active & retired.
+func (k *JWTKeys) JWKS() jwtverify.JWKS {
+	set := jwtverify.JWKS{Keys: make([]jwtverify.JWK, 0, len(k.keys))}
+	for _, key := range k.keys {
+		set.Keys = append(set.Keys, key.jwk)
+	}
+
+	return set
+}
+
+// Checks an access token signed with any of the keys and returns its claims.
+func (k *JWTKeys) Verify(ctx context.Context, value string) (*jwtverify.Claims, error) {
+	return k.verifier.Verify(ctx, value)
+}
+
+// Signs a JWT access token of a bearer login. It isn't stored, GetAccessToken
+// rejects it once its session is gone, other services only once it expires.
+func (ts *TokenService) newJWTAccessToken(ctx context.Context, userId, sessionId string, now time.Time) (*Token, error) {
+	if ts.JWTSubjects == nil {
+		return nil, errors.New("JWTKeys set without JWTSubjects")
+	}
+
+	subject, err := ts.JWTSubjects(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := jwtverify.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(),
+			Issuer:    ts.JWTKeys.issuer,
+			Subject:   userId,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ts.sessionConfig().AccessTokenTTL)),
+		},
+		SessionId: sessionId,
+		Username:  subject.Username,
+		Verified:  subject.Verified,
+		Roles:     subject.Roles,
+	}
+	if ts.JWTKeys.audience != "" {
+		claims.Audience = jwt.ClaimStrings{ts.JWTKeys.audience}
+	}
+
+	value, err := ts.JWTKeys.Sign(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Token{
+		Id:        claims.ID,
+		UserId:    userId,
+		TokenType: TypeAccess,
+		Token:     value,
+		SessionId: sessionId,
+		ExpiresAt: claims.ExpiresAt.Time,
+		CreatedAt: now,
+	}, nil
+}
+
+// Looks up the access token of a bearer request. Tokens shaped like a JWT
+// are checked against JWTKeys and their session, so a logout revokes them
+// here right away. All others are looked up in the store.
+func (ts *TokenService) GetAccessToken(ctx context.Context, value string) (*Token, error) {
+	if ts.JWTKeys == nil || strings.Count(value, ".") != 2 {
+		access, err := ts.Store.Find(ctx, TypeAccess, value)
+		if err != nil {
+			return nil, err
+		}
+
+		if access.ExpiresAt.Before(time.Now().UTC()) {
+			return nil, ErrTokenExpired
+		}
+
+		return access, nil
+	}
+
+	claims, err := ts.JWTKeys.Verify(ctx, value)
+	if err != nil {
+		if errors.Is(err, jwt.ErrTokenExpired) {
+			return nil, ErrTokenExpired
+		}
+		ts.Logger.Debug("rejected JWT access token", "error", err)
+		return nil, ErrTokenNotFound
+	}
+
+	if _, err := ts.Store.FindSession(ctx, claims.SessionId); err != nil {
+		return nil, err
+	}
+
+	access := &Token{
+		Id:        claims.ID,
+		UserId:    claims.Subject,
+		TokenType: TypeAccess,
+		SessionId: claims.SessionId,
+		ExpiresAt: claims.ExpiresAt.Time,
+	}
+	if claims.IssuedAt != nil {
+		access.CreatedAt = claims.IssuedAt.Time
+	}
+
+	return access, nil
+}
@@ -0,0 +1,136 @@
+package internal_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	token "fucku/internal/tokens"
+	"fucku/pkg/jwtverify"
+)
+
+func newJWTTokenService(t *testing.T, keys *token.JWTKeys) *token.TokenService {
+	t.Helper()
+
+	mts := newMemoryTokenService()
+	mts.JWTKeys = keys
+	mts.JWTSubjects = func(ctx context.Context, userId string) (token.JWTSubject, error) {
+		return token.JWTSubject{Username: "jwtuser", Verified: true, Roles: []string{"admin"}}, nil
+	}
+	return mts
+}
+
+func TestJWTAccessTokens(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	keys, err := token.NewJWTKeys("https://auth.example.com", "api", edKey)
+	if err != nil {
+		t.Fatalf("failed to create keys: %v", err)
+	}
+
+	mts := newJWTTokenService(t, keys)
+	userId := "4c8fc246-38a3-4605-8b1e-f42544e008b6"
+
+	tokens, err := mts.NewBearerTokens(context.Background(), userId, "cli", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("failed to create bearer tokens: %v", err)
+	}
+
+	// Only the refresh token is stored
+	if _, err := mts.GetToken(context.Background(), token.TypeAccess, tokens.Access.Token); !errors.Is(err, token.ErrTokenNotFound) {
+		t.Errorf("expected the JWT access token not to be stored, got: %v", err)
+	}
+
+	access, err := mts.GetAccessToken(context.Background(), tokens.Access.Token)
+	if err != nil {
+		t.Fatalf("failed to verify access token: %v", err)
+	}
+	if access.UserId != userId || access.SessionId != tokens.Refresh.SessionId || access.TokenType != token.TypeAccess {
+		t.Errorf("unexpected access token: %+v", access)
+	}
+
+	claims, err := keys.Verify(context.Background(), tokens.Access.Token)
+	if err != nil {
+		t.Fatalf("failed to verify claims: %v", err)
+	}
+	if claims.Username != "jwtuser" || !claims.Verified || !slices.Equal(claims.Roles, []string{"admin"}) {
+		t.Errorf("unexpected claims: %+v", claims)
+	}
+
+	if _, err := mts.GetAccessToken(context.Background(), tokens.Access.Token+"x"); !errors.Is(err, token.ErrTokenNotFound) {
+		t.Errorf("expected a tampered token to be rejected, got: %v", err)
+	}
+
+	// The signature stays valid, but the logout is noticed here
+	if _, err := mts.RevokeSession(context.Background(), userId, tokens.Refresh.SessionId); err != nil {
+		t.Fatalf("failed to revoke session: %v", err)
+	}
+	if _, err := mts.GetAccessToken(context.Background(), tokens.Access.Token); !errors.Is(err, token.ErrTokenNotFound) {
+		t.Errorf("expected the token of a revoked session to be rejected, got: %v", err)
+	}
+	if _, err := keys.Verify(context.Background(), tokens.Access.Token); err != nil {
+		t.Errorf("expected the signature to still verify, got: %v", err)
+	}
+}
+
+func TestJWTKeyRotation(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	old, err := token.NewJWTKeys("https://auth.example.com", "", edKey)
+	if err != nil {
+		t.Fatalf("failed to create keys: %v", err)
+	}
+	tokens, err := newJWTTokenService(t, old).NewBearerTokens(context.Background(), "4c8fc246-38a3-4605-8b1e-f42544e008b6", "cli", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("failed to create bearer tokens: %v", err)
+	}
+
+	// The Ed25519 key is retired, the RSA key signs from now on
+	rotated, err := token.NewJWTKeys("https://auth.example.com", "", rsaKey, edKey)
+	if err != nil {
+		t.Fatalf("failed to create keys: %v", err)
+	}
+
+	jwks := rotated.JWKS()
+	if len(jwks.Keys) != 2 || jwks.Keys[0].Alg != jwtverify.AlgRS256 || jwks.Keys[1].Kid != old.JWKS().Keys[0].Kid {
+		t.Fatalf("expected the active & the retired key to be published, got: %+v", jwks)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(rotated.JWKS())
+	}))
+	defer server.Close()
+
+	verifier := jwtverify.NewVerifier(server.URL, "https://auth.example.com", "")
+	if _, err := verifier.Verify(context.Background(), tokens.Access.Token); err != nil {
+		t.Errorf("expected a token of the retired key to verify, got: %v", err)
+	}
+
+	fresh, err := newJWTTokenService(t, rotated).NewBearerTokens(context.Background(), "4c8fc246-38a3-4605-8b1e-f42544e008b6", "cli", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("failed to create bearer tokens: %v", err)
+	}
+	if _, err := verifier.Verify(context.Background(), fresh.Access.Token); err != nil {
+		t.Errorf("expected a token of the active key to verify, got: %v", err)
+	}
+
+	if _, err := old.Verify(context.Background(), fresh.Access.Token); !errors.Is(err, jwtverify.ErrUnknownKey) {
+		t.Errorf("expected the old key set not to know the new key, got: %v", err)
+	}
+}
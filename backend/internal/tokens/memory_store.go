@@ -0,0 +1,291 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var errDuplicateToken = errors.New("duplicate token value")
+
+// Keeps tokens in process memory, meant for tests without a database.
+type MemoryTokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]*memoryToken
+}
+
+// Like the tokens table, only the hash of the value is kept
+type memoryToken struct {
+	Token
+	Hash       string
+	UserAgent  string
+	IPAddress  string
+	LastSeenAt time.Time
+	Attempts   int
+}
+
+func NewMemoryTokenStore() *MemoryTokenStore {
+	return &MemoryTokenStore{tokens: make(map[string]*memoryToken)}
+}
+
+func (s *MemoryTokenStore) Insert(ctx context.Context, p TokenParams) (*Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hash := HashToken(p.Token)
+	for _, t := range s.tokens {
+		if t.Hash == hash {
+			return nil, errDuplicateToken
+		}
+	}
+
+	now := time.Now()
+	t := &memoryToken{
+		Token: Token{
+			Id:         uuid.NewString(),
+			UserId:     p.UserId,
+			TokenType:  p.TokenType,
+			Payload:    p.Payload,
+			SessionId:  p.SessionId,
+			Persistent: p.Persistent,
+			ExpiresAt:  p.ExpiresAt,
+			CreatedAt:  now,
+			UpdatedAt:  now,
+		},
+		Hash:       hash,
+		UserAgent:  p.UserAgent,
+		IPAddress:  p.IPAddress,
+		LastSeenAt: now,
+	}
+	s.tokens[t.Id] = t
+
+	token := t.Token
+	token.Token = p.Token
+	return &token, nil
+}
+
+// Returns a copy of the first token matching, ErrTokenNotFound if none does
+func (s *MemoryTokenStore) find(match func(t *memoryToken) bool) (*Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, t := range s.tokens {
+		if match(t) {
+			token := t.Token
+			return &token, nil
+		}
+	}
+
+	return nil, ErrTokenNotFound
+}
+
+func (s *MemoryTokenStore) Find(ctx context.Context, tokenType, value string) (*Token, error) {
+	hash := HashToken(value)
+	token, err := s.find(func(t *memoryToken) bool {
+		return t.TokenType == tokenType && t.Hash == hash
+	})
+
+	return withValue(token, err, value)
+}
+
+func (s *MemoryTokenStore) FindForUser(ctx context.Context, userId, tokenType, value string) (*Token, error) {
+	hash := HashToken(value)
+	token, err := s.find(func(t *memoryToken) bool {
+		return t.UserId == userId && t.TokenType == tokenType && t.Hash == hash
+	})
+
+	return withValue(token, err, value)
+}
+
+func (s *MemoryTokenStore) Latest(ctx context.Context, userId, tokenType string) (*Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var latest *memoryToken
+	for _, t := range s.tokens {
+		if t.UserId == userId && t.TokenType == tokenType && (latest == nil || t.CreatedAt.After(latest.CreatedAt)) {
+			latest = t
+		}
+	}
+
+	if latest == nil {
+		return nil, ErrTokenNotFound
+	}
+
+	token := latest.Token
+	return &token, nil
+}
+
+func (s *MemoryTokenStore) List(ctx context.Context, userId string) ([]Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	tokens := make([]Token, 0)
+	for _, t := range s.tokens {
+		if t.UserId == userId && t.ExpiresAt.After(now) {
+			token := t.Token
+			token.Token, token.Payload = "", ""
+			tokens = append(tokens, token)
+		}
+	}
+
+	slices.SortFunc(tokens, func(a, b Token) int { return b.CreatedAt.Compare(a.CreatedAt) })
+
+	return tokens, nil
+}
+
+func (s *MemoryTokenStore) FindSession(ctx context.Context, id string) (*Token, error) {
+	return s.find(func(t *memoryToken) bool {
+		return t.Id == id && t.TokenType == TypeSession
+	})
+}
+
+func (s *MemoryTokenStore) ListSessions(ctx context.Context, userId string) ([]Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	sessions := make([]Session, 0)
+	for _, t := range s.tokens {
+		if t.UserId == userId && t.TokenType == TypeSession && t.ExpiresAt.After(now) {
+			sessions = append(sessions, Session{
+				Id:         t.Id,
+				UserAgent:  t.UserAgent,
+				IPAddress:  t.IPAddress,
+				CreatedAt:  t.CreatedAt,
+				LastSeenAt: t.LastSeenAt,
+				ExpiresAt:  t.ExpiresAt,
+				Persistent: t.Persistent,
+			})
+		}
+	}
+
+	slices.SortFunc(sessions, func(a, b Session) int { return b.LastSeenAt.Compare(a.LastSeenAt) })
+
+	return sessions, nil
+}
+
+func (s *MemoryTokenStore) TouchSession(ctx context.Context, id string, expiresAt time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tokens[id]
+	if !ok || t.TokenType != TypeSession || time.Since(t.LastSeenAt) < sessionTouchInterval {
+		return false, nil
+	}
+
+	t.LastSeenAt = time.Now()
+	t.ExpiresAt = expiresAt
+	for _, csrf := range s.tokens {
+		if csrf.TokenType == TypeCSRF && csrf.SessionId == id {
+			csrf.ExpiresAt = expiresAt
+		}
+	}
+
+	return true, nil
+}
+
+// Deletes all tokens matching and returns how many there were
+func (s *MemoryTokenStore) delete(match func(t *memoryToken) bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deleted := 0
+	for id, t := range s.tokens {
+		if match(t) {
+			delete(s.tokens, id)
+			deleted++
+		}
+	}
+
+	return deleted
+}
+
+func (s *MemoryTokenStore) Delete(ctx context.Context, id string) error {
+	s.delete(func(t *memoryToken) bool { return t.Id == id })
+	return nil
+}
+
+func (s *MemoryTokenStore) Consume(ctx context.Context, tokenType, value string) (*Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hash := HashToken(value)
+	for id, t := range s.tokens {
+		if t.TokenType == tokenType && t.Hash == hash {
+			delete(s.tokens, id)
+			token := t.Token
+			token.Token = value
+			return &token, nil
+		}
+	}
+
+	return nil, ErrTokenNotFound
+}
+
+func (s *MemoryTokenStore) DeleteTypes(ctx context.Context, userId string, tokenTypes ...string) error {
+	s.delete(func(t *memoryToken) bool {
+		return t.UserId == userId && slices.Contains(tokenTypes, t.TokenType)
+	})
+	return nil
+}
+
+func (s *MemoryTokenStore) MarkUsed(ctx context.Context, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tokens[id]
+	if !ok || t.UsedAt != nil {
+		return false, nil
+	}
+
+	now := time.Now()
+	t.UsedAt = &now
+	return true, nil
+}
+
+func (s *MemoryTokenStore) CountAttempt(ctx context.Context, id string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tokens[id]
+	if !ok {
+		return 0, ErrTokenNotFound
+	}
+
+	t.Attempts++
+	return t.Attempts, nil
+}
+
+func (s *MemoryTokenStore) DeleteCSRF(ctx context.Context, sessionId string) error {
+	s.delete(func(t *memoryToken) bool {
+		return t.TokenType == TypeCSRF && t.SessionId == sessionId
+	})
+	return nil
+}
+
+func (s *MemoryTokenStore) DeleteSession(ctx context.Context, userId, sessionId string) (bool, error) {
+	deleted := s.delete(func(t *memoryToken) bool {
+		return t.UserId == userId &&
+			((t.Id == sessionId && t.TokenType == TypeSession) || (t.SessionId == sessionId && t.TokenType != TypeSession))
+	})
+	return deleted > 0, nil
+}
+
+func (s *MemoryTokenStore) DeleteOtherSessions(ctx context.Context, userId, keepId string) error {
+	s.delete(func(t *memoryToken) bool {
+		return t.UserId == userId && slices.Contains(SessionTypes, t.TokenType) &&
+			t.Id != keepId && t.SessionId != keepId
+	})
+	return nil
+}
+
+func (s *MemoryTokenStore) DeleteAll(ctx context.Context, userId string) error {
+	s.delete(func(t *memoryToken) bool { return t.UserId == userId })
+	return nil
+}
@@ -0,0 +1,160 @@
+package internal_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	token "fucku/internal/tokens"
+)
+
+func newMemoryTokenService() *token.TokenService {
+	secrets, _ := token.NewCSRFSecrets("test-secret")
+	return &token.TokenService{
+		Logger:      logger,
+		Store:       token.NewMemoryTokenStore(),
+		CSRFSecrets: secrets,
+	}
+}
+
+func TestMemorySessions(t *testing.T) {
+	mts := newMemoryTokenService()
+	userId := "4c8fc246-38a3-4605-8b1e-f42544e008b6"
+
+	laptop, err := mts.NewSessionToken(context.Background(), userId, "laptop", "127.0.0.1", false)
+	if err != nil {
+		t.Fatalf("failed to create session one: %v", err)
+	}
+
+	phone, err := mts.NewSessionToken(context.Background(), userId, "phone", "127.0.0.2", false)
+	if err != nil {
+		t.Fatalf("failed to create session two: %v", err)
+	}
+
+	csrf, err := mts.NewCSRFToken(context.Background(), laptop)
+	if err != nil {
+		t.Fatalf("failed to create csrf token: %v", err)
+	}
+
+	sessions, err := mts.ListSessions(context.Background(), userId)
+	if err != nil || len(sessions) != 2 {
+		t.Fatalf("expected 2 sessions, got: %d (%v)", len(sessions), err)
+	}
+
+	found, err := mts.RevokeSession(context.Background(), userId, laptop.Id)
+	if err != nil || !found {
+		t.Fatalf("failed to revoke session one: %v", err)
+	}
+
+	if _, err := mts.GetToken(context.Background(), token.TypeCSRF, csrf.Token); !errors.Is(err, token.ErrTokenNotFound) {
+		t.Errorf("expected the csrf token to be revoked with its session, got: %v", err)
+	}
+
+	sessions, _ = mts.ListSessions(context.Background(), userId)
+	if len(sessions) != 1 || sessions[0].Id != phone.Id {
+		t.Errorf("expected only session two to remain, got: %+v", sessions)
+	}
+}
+
+func TestMemorySingleSession(t *testing.T) {
+	mts := newMemoryTokenService()
+	mts.SingleSession = true
+	userId := "4c8fc246-38a3-4605-8b1e-f42544e008b6"
+
+	first, _ := mts.NewSessionToken(context.Background(), userId, "laptop", "127.0.0.1", false)
+	second, err := mts.NewSessionToken(context.Background(), userId, "phone", "127.0.0.2", false)
+	if err != nil {
+		t.Fatalf("failed to create session two: %v", err)
+	}
+
+	if _, err := mts.GetToken(context.Background(), token.TypeSession, first.Token); !errors.Is(err, token.ErrTokenNotFound) {
+		t.Errorf("expected the first session to be revoked, got: %v", err)
+	}
+
+	if _, err := mts.GetToken(context.Background(), token.TypeSession, second.Token); err != nil {
+		t.Errorf("expected the second session to be valid, got: %v", err)
+	}
+}
+
+func TestMemoryPasswordResetToken(t *testing.T) {
+	mts := newMemoryTokenService()
+	userId := "4c8fc246-38a3-4605-8b1e-f42544e008b6"
+
+	first, _ := mts.NewPasswordResetToken(context.Background(), userId)
+	second, err := mts.NewPasswordResetToken(context.Background(), userId)
+	if err != nil {
+		t.Fatalf("failed to create reset token: %v", err)
+	}
+
+	if _, err := mts.GetUserToken(context.Background(), userId, token.TypePasswordReset, first.Token); !errors.Is(err, token.ErrTokenNotFound) {
+		t.Errorf("expected the first reset token to be replaced, got: %v", err)
+	}
+
+	latest, err := mts.LatestToken(context.Background(), userId, token.TypePasswordReset)
+	if err != nil || latest.Id != second.Id {
+		t.Errorf("expected the second reset token to be the latest, got: %+v (%v)", latest, err)
+	}
+
+	consumed, err := mts.ConsumeToken(context.Background(), token.TypePasswordReset, second.Token)
+	if err != nil || consumed.Id != second.Id {
+		t.Fatalf("failed to consume reset token: %+v (%v)", consumed, err)
+	}
+	if _, err := mts.ConsumeToken(context.Background(), token.TypePasswordReset, second.Token); !errors.Is(err, token.ErrTokenNotFound) {
+		t.Errorf("expected a reset token to be consumed once only, got: %v", err)
+	}
+}
+
+func TestMemoryStoresOnlyHashes(t *testing.T) {
+	mts := newMemoryTokenService()
+	userId := "4c8fc246-38a3-4605-8b1e-f42544e008b6"
+
+	session, err := mts.NewSessionToken(context.Background(), userId, "laptop", "127.0.0.1", false)
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+	if session.Token == "" {
+		t.Fatal("expected the raw value on the created token")
+	}
+
+	found, err := mts.GetToken(context.Background(), token.TypeSession, session.Token)
+	if err != nil || found.Id != session.Id || found.Token != session.Token {
+		t.Errorf("expected to find the session by its value, got: %+v (%v)", found, err)
+	}
+
+	latest, err := mts.LatestToken(context.Background(), userId, token.TypeSession)
+	if err != nil || latest.Token != "" {
+		t.Errorf("expected the stored token without its value, got: %+v (%v)", latest, err)
+	}
+
+	if _, err := mts.GetToken(context.Background(), token.TypeSession, token.HashToken(session.Token)); !errors.Is(err, token.ErrTokenNotFound) {
+		t.Errorf("expected the hash not to work as a token, got: %v", err)
+	}
+}
+
+func TestMemoryMFAPendingAttempts(t *testing.T) {
+	mts := newMemoryTokenService()
+	userId := "4c8fc246-38a3-4605-8b1e-f42544e008b6"
+
+	pending, err := mts.NewMFAPendingToken(context.Background(), userId, false)
+	if err != nil {
+		t.Fatalf("failed to create mfa pending token: %v", err)
+	}
+
+	for i := range token.MaxMFAAttempts {
+		left, err := mts.CountMFAAttempt(context.Background(), pending)
+		if err != nil {
+			t.Fatalf("attempt %d: unexpected error: %v", i+1, err)
+		}
+		if left != token.MaxMFAAttempts-i-1 {
+			t.Errorf("attempt %d: expected %d attempts left, got: %d", i+1, token.MaxMFAAttempts-i-1, left)
+		}
+	}
+
+	if _, err := mts.CountMFAAttempt(context.Background(), pending); !errors.Is(err, token.ErrTokenNotFound) {
+		t.Fatalf("expected ErrTokenNotFound once the attempts are used up, got: %v", err)
+	}
+
+	if _, err := mts.GetToken(context.Background(), token.TypeMFAPending, pending.Token); !errors.Is(err, token.ErrTokenNotFound) {
+		t.Errorf("expected the mfa pending token to be deleted, got: %v", err)
+	}
+}
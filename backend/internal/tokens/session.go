@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"os"
+	"time"
+)
+
+// Sessions are extended on activity, but written at most this often.
+// PostgresTokenStore.TouchSession has it in its query.
+const sessionTouchInterval = time.Minute
+
+// Lifetimes of sessions. A session expires once it was idle for the idle
+// timeout, but no later than its lifetime after the login. "Remember me"
+// logins get the longer persistent lifetimes.
+// Bearer logins hand out access tokens instead, their session lives as
+// long as the refresh token, which is renewed on every refresh.
+type SessionConfig struct {
+	IdleTimeout         time.Duration
+	Lifetime            time.Duration
+	RememberIdleTimeout time.Duration
+	RememberLifetime    time.Duration
+	AccessTokenTTL      time.Duration
+	RefreshTokenTTL     time.Duration
+}
+
+func DefaultSessionConfig() SessionConfig {
+	return SessionConfig{
+		IdleTimeout:         2 * time.Hour,
+		Lifetime:            24 * time.Hour,
+		RememberIdleTimeout: 7 * 24 * time.Hour,
+		RememberLifetime:    30 * 24 * time.Hour,
+		AccessTokenTTL:      15 * time.Minute,
+		RefreshTokenTTL:     30 * 24 * time.Hour,
+	}
+}
+
+// Reads the SESSION_* variables, falling back to the defaults.
+func SessionConfigFromEnv() SessionConfig {
+	c := DefaultSessionConfig()
+
+	if v, err := time.ParseDuration(os.Getenv("SESSION_IDLE_TIMEOUT")); err == nil && v > 0 {
+		c.IdleTimeout = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("SESSION_LIFETIME")); err == nil && v > 0 {
+		c.Lifetime = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("SESSION_REMEMBER_IDLE_TIMEOUT")); err == nil && v > 0 {
+		c.RememberIdleTimeout = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("SESSION_REMEMBER_LIFETIME")); err == nil && v > 0 {
+		c.RememberLifetime = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("SESSION_ACCESS_TOKEN_TTL")); err == nil && v > 0 {
+		c.AccessTokenTTL = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("SESSION_REFRESH_TOKEN_TTL")); err == nil && v > 0 {
+		c.RefreshTokenTTL = v
+	}
+
+	return c
+}
+
+// Returns when a session created at createdAt expires after being used at now.
+func (c SessionConfig) ExpiresAt(createdAt, now time.Time, persistent bool) time.Time {
+	expiresAt := now.Add(c.idleTimeout(persistent))
+	if limit := c.LifetimeEnd(createdAt, persistent); limit.Before(expiresAt) {
+		return limit
+	}
+
+	return expiresAt
+}
+
+// Returns when a session created at createdAt expires at the latest,
+// no matter how active it is.
+func (c SessionConfig) LifetimeEnd(createdAt time.Time, persistent bool) time.Time {
+	if persistent {
+		return createdAt.Add(c.RememberLifetime)
+	}
+
+	return createdAt.Add(c.Lifetime)
+}
+
+func (c SessionConfig) idleTimeout(persistent bool) time.Duration {
+	if persistent {
+		return c.RememberIdleTimeout
+	}
+
+	return c.IdleTimeout
+}
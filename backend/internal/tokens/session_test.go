@@ -0,0 +1,71 @@
+package internal_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	token "fucku/internal/tokens"
+)
+
+func TestSessionExpiresAt(t *testing.T) {
+	c := token.SessionConfig{
+		IdleTimeout:         time.Hour,
+		Lifetime:            8 * time.Hour,
+		RememberIdleTimeout: 24 * time.Hour,
+		RememberLifetime:    72 * time.Hour,
+	}
+	login := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		usedAfter  time.Duration
+		persistent bool
+		want       time.Duration
+	}{
+		{"fresh", 0, false, time.Hour},
+		{"active", 3 * time.Hour, false, 4 * time.Hour},
+		{"capped by lifetime", 7*time.Hour + 30*time.Minute, false, 8 * time.Hour},
+		{"past lifetime", 9 * time.Hour, false, 8 * time.Hour},
+		{"remembered", 0, true, 24 * time.Hour},
+		{"remembered capped", 60 * time.Hour, true, 72 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		got := c.ExpiresAt(login, login.Add(tt.usedAfter), tt.persistent)
+		if want := login.Add(tt.want); !got.Equal(want) {
+			t.Errorf("%s: got %s, want %s", tt.name, got, want)
+		}
+	}
+}
+
+func TestMemoryPersistentSession(t *testing.T) {
+	mts := newMemoryTokenService()
+	mts.Sessions = token.DefaultSessionConfig()
+	userId := "4c8fc246-38a3-4605-8b1e-f42544e008b6"
+
+	session, err := mts.NewSessionToken(context.Background(), userId, "laptop", "127.0.0.1", true)
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+
+	if !session.Persistent || session.ExpiresAt.Before(time.Now().Add(mts.Sessions.IdleTimeout)) {
+		t.Errorf("expected a persistent session with the remember me lifetime, got: %+v", session)
+	}
+
+	csrf, err := mts.NewCSRFToken(context.Background(), session)
+	if err != nil || !csrf.ExpiresAt.Equal(session.ExpiresAt) {
+		t.Errorf("expected the csrf token to expire with the session, got: %+v (%v)", csrf, err)
+	}
+
+	sessions, err := mts.ListSessions(context.Background(), userId)
+	if err != nil || len(sessions) != 1 || !sessions[0].Persistent {
+		t.Errorf("expected the persistent session to be listed, got: %+v (%v)", sessions, err)
+	}
+
+	// Just created, so touching it is throttled
+	touched, err := mts.Store.TouchSession(context.Background(), session.Id, time.Now().Add(time.Hour))
+	if err != nil || touched {
+		t.Errorf("expected no write right after login, got: %v (%v)", touched, err)
+	}
+}
@@ -0,0 +1,384 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	database "fucku/internal/database"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Persists tokens for the TokenService. Lookups return ErrTokenNotFound if
+// nothing matches, expiry is checked by the caller unless stated otherwise.
+// Stores keep only HashToken of a value, so tokens they return carry the raw
+// value only if the caller passed it in, i.e. from Insert, Find & FindForUser.
+type TokenStore interface {
+	Insert(ctx context.Context, p TokenParams) (*Token, error)
+	Find(ctx context.Context, tokenType, value string) (*Token, error)
+	FindForUser(ctx context.Context, userId, tokenType, value string) (*Token, error)
+	// The most recently created token of the type
+	Latest(ctx context.Context, userId, tokenType string) (*Token, error)
+	// Unexpired tokens of a user, newest first, without values & payloads
+	List(ctx context.Context, userId string) ([]Token, error)
+	// A session by its id, ErrTokenNotFound once it was revoked
+	FindSession(ctx context.Context, id string) (*Token, error)
+	// Unexpired sessions of a user, most recently used first
+	ListSessions(ctx context.Context, userId string) ([]Session, error)
+	// Updates when a session was last used & moves its expiry, together with
+	// the one of its CSRF token, to expiresAt. Writes at most once a minute
+	// and reports whether it did.
+	TouchSession(ctx context.Context, id string, expiresAt time.Time) (bool, error)
+	Delete(ctx context.Context, id string) error
+	// Deletes a token & returns it, so only one caller ever gets it
+	Consume(ctx context.Context, tokenType, value string) (*Token, error)
+	DeleteTypes(ctx context.Context, userId string, tokenTypes ...string) error
+	// Marks a refresh token as rotated. Returns false if it already was.
+	MarkUsed(ctx context.Context, id string) (bool, error)
+	// Counts an attempt at a token, e.g. a code entered with it, and
+	// returns the attempts so far
+	CountAttempt(ctx context.Context, id string) (int, error)
+	// Deletes the CSRF token belonging to a session
+	DeleteCSRF(ctx context.Context, sessionId string) error
+	// Deletes a session & its CSRF or bearer tokens. Returns false if the user has no such session.
+	DeleteSession(ctx context.Context, userId, sessionId string) (bool, error)
+	// Deletes all sessions, CSRF & bearer tokens of a user except those of keepId
+	DeleteOtherSessions(ctx context.Context, userId, keepId string) error
+	DeleteAll(ctx context.Context, userId string) error
+}
+
+// Everything needed to store a new token
+type TokenParams struct {
+	UserId    string
+	TokenType string
+	Token     string
+	Payload   string
+	// Set for CSRF, access & refresh tokens, the session they belong to
+	SessionId string
+	// Set for sessions, the device they were created on
+	UserAgent string
+	IPAddress string
+	// Set for "remember me" sessions
+	Persistent bool
+	ExpiresAt  time.Time
+}
+
+// Keeps tokens in the tokens table
+type PostgresTokenStore struct {
+	DB *database.Database
+	// Set on stores returned by WithTx
+	tx pgx.Tx
+}
+
+func NewPostgresTokenStore(db *database.Database) *PostgresTokenStore {
+	return &PostgresTokenStore{DB: db}
+}
+
+// Returns a store running its queries in tx, see database.WithTx.
+func (s *PostgresTokenStore) WithTx(tx pgx.Tx) *PostgresTokenStore {
+	return &PostgresTokenStore{DB: s.DB, tx: tx}
+}
+
+func (s *PostgresTokenStore) conn() database.Querier {
+	if s.tx != nil {
+		return s.tx
+	}
+
+	return s.DB.DBPool
+}
+
+// Columns read by scanToken. The raw value isn't stored, so it is selected
+// empty, List leaves out the payload as well.
+const (
+	tokenColumns     = `id, user_id, token_type, '', payload, ` + tokenMetaColumns
+	listTokenColumns = `id, user_id, token_type, '', '', ` + tokenMetaColumns
+	tokenMetaColumns = `COALESCE(session_id::text, ''), persistent, used_at, expires_at, created_at, updated_at`
+)
+
+func (s *PostgresTokenStore) Insert(ctx context.Context, p TokenParams) (*Token, error) {
+	ctx, cancel := s.DB.Timeout(ctx)
+	defer cancel()
+
+	row := s.conn().QueryRow(ctx, `
+		INSERT INTO tokens (user_id, token_type, token_hash, payload, session_id, user_agent, ip_address, persistent, expires_at)
+		VALUES ($1, $2, $3, $4, NULLIF($5, '')::uuid, $6, $7, $8, $9) RETURNING `+tokenColumns,
+		p.UserId,
+		p.TokenType,
+		HashToken(p.Token),
+		p.Payload,
+		p.SessionId,
+		p.UserAgent,
+		p.IPAddress,
+		p.Persistent,
+		p.ExpiresAt)
+
+	token, err := scanToken(row)
+	if err != nil {
+		return nil, err
+	}
+
+	token.Token = p.Token
+	return token, nil
+}
+
+func (s *PostgresTokenStore) Find(ctx context.Context, tokenType, value string) (*Token, error) {
+	ctx, cancel := s.DB.Timeout(ctx)
+	defer cancel()
+
+	row := s.conn().QueryRow(ctx, `
+		SELECT `+tokenColumns+` FROM tokens WHERE token_type = $1 AND token_hash = $2`,
+		tokenType, HashToken(value))
+
+	token, err := scanFoundToken(row)
+	return withValue(token, err, value)
+}
+
+func (s *PostgresTokenStore) FindForUser(ctx context.Context, userId, tokenType, value string) (*Token, error) {
+	ctx, cancel := s.DB.Timeout(ctx)
+	defer cancel()
+
+	row := s.conn().QueryRow(ctx, `
+		SELECT `+tokenColumns+` FROM tokens WHERE user_id = $1 AND token_type = $2 AND token_hash = $3`,
+		userId, tokenType, HashToken(value))
+
+	token, err := scanFoundToken(row)
+	return withValue(token, err, value)
+}
+
+func (s *PostgresTokenStore) Latest(ctx context.Context, userId, tokenType string) (*Token, error) {
+	ctx, cancel := s.DB.Timeout(ctx)
+	defer cancel()
+
+	row := s.conn().QueryRow(ctx, `
+		SELECT `+tokenColumns+` FROM tokens WHERE user_id = $1 AND token_type = $2
+		ORDER BY created_at DESC LIMIT 1`,
+		userId, tokenType)
+
+	return scanFoundToken(row)
+}
+
+func (s *PostgresTokenStore) List(ctx context.Context, userId string) ([]Token, error) {
+	ctx, cancel := s.DB.Timeout(ctx)
+	defer cancel()
+
+	rows, err := s.conn().Query(ctx, `
+		SELECT `+listTokenColumns+`
+		FROM tokens WHERE user_id = $1 AND expires_at > $2
+		ORDER BY created_at DESC`,
+		userId, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := make([]Token, 0)
+	for rows.Next() {
+		token, err := scanToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, *token)
+	}
+
+	return tokens, rows.Err()
+}
+
+func (s *PostgresTokenStore) FindSession(ctx context.Context, id string) (*Token, error) {
+	ctx, cancel := s.DB.Timeout(ctx)
+	defer cancel()
+
+	row := s.conn().QueryRow(ctx, `
+		SELECT `+tokenColumns+` FROM tokens WHERE id = $1 AND token_type = 'session'`, id)
+
+	return scanFoundToken(row)
+}
+
+func (s *PostgresTokenStore) ListSessions(ctx context.Context, userId string) ([]Session, error) {
+	ctx, cancel := s.DB.Timeout(ctx)
+	defer cancel()
+
+	rows, err := s.conn().Query(ctx, `
+		SELECT id, user_agent, ip_address, created_at, last_seen_at, expires_at, persistent
+		FROM tokens WHERE user_id = $1 AND token_type = 'session' AND expires_at > $2
+		ORDER BY last_seen_at DESC`,
+		userId, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := make([]Session, 0)
+	for rows.Next() {
+		var s Session
+		if err := rows.Scan(&s.Id, &s.UserAgent, &s.IPAddress, &s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt, &s.Persistent); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+
+	return sessions, rows.Err()
+}
+
+func (s *PostgresTokenStore) TouchSession(ctx context.Context, id string, expiresAt time.Time) (bool, error) {
+	ctx, cancel := s.DB.Timeout(ctx)
+	defer cancel()
+
+	var touched int
+	err := s.conn().QueryRow(ctx, `
+		WITH session AS (
+			UPDATE tokens SET last_seen_at = CURRENT_TIMESTAMP, expires_at = $2
+			WHERE id = $1 AND token_type = 'session' AND last_seen_at < CURRENT_TIMESTAMP - INTERVAL '1 minute'
+			RETURNING id
+		), csrf AS (
+			UPDATE tokens SET expires_at = $2
+			WHERE token_type = 'csrf' AND session_id IN (SELECT id FROM session)
+		)
+		SELECT count(*) FROM session`,
+		id, expiresAt).Scan(&touched)
+
+	return touched > 0, err
+}
+
+func (s *PostgresTokenStore) Delete(ctx context.Context, id string) error {
+	ctx, cancel := s.DB.Timeout(ctx)
+	defer cancel()
+
+	_, err := s.conn().Exec(ctx, `DELETE FROM tokens WHERE id = $1`, id)
+
+	return err
+}
+
+func (s *PostgresTokenStore) Consume(ctx context.Context, tokenType, value string) (*Token, error) {
+	ctx, cancel := s.DB.Timeout(ctx)
+	defer cancel()
+
+	row := s.conn().QueryRow(ctx, `
+		DELETE FROM tokens WHERE token_type = $1 AND token_hash = $2 RETURNING `+tokenColumns,
+		tokenType, HashToken(value))
+
+	token, err := scanFoundToken(row)
+	return withValue(token, err, value)
+}
+
+func (s *PostgresTokenStore) DeleteTypes(ctx context.Context, userId string, tokenTypes ...string) error {
+	ctx, cancel := s.DB.Timeout(ctx)
+	defer cancel()
+
+	_, err := s.conn().Exec(ctx,
+		`DELETE FROM tokens WHERE user_id = $1 AND token_type = ANY($2)`, userId, tokenTypes)
+
+	return err
+}
+
+func (s *PostgresTokenStore) MarkUsed(ctx context.Context, id string) (bool, error) {
+	ctx, cancel := s.DB.Timeout(ctx)
+	defer cancel()
+
+	tag, err := s.conn().Exec(ctx,
+		`UPDATE tokens SET used_at = $2 WHERE id = $1 AND used_at IS NULL`, id, time.Now().UTC())
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
+
+func (s *PostgresTokenStore) CountAttempt(ctx context.Context, id string) (int, error) {
+	ctx, cancel := s.DB.Timeout(ctx)
+	defer cancel()
+
+	var attempts int
+	err := s.conn().QueryRow(ctx,
+		`UPDATE tokens SET attempts = attempts + 1 WHERE id = $1 RETURNING attempts`, id).Scan(&attempts)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, ErrTokenNotFound
+	}
+
+	return attempts, err
+}
+
+func (s *PostgresTokenStore) DeleteCSRF(ctx context.Context, sessionId string) error {
+	ctx, cancel := s.DB.Timeout(ctx)
+	defer cancel()
+
+	_, err := s.conn().Exec(ctx, `DELETE FROM tokens WHERE token_type = 'csrf' AND session_id = $1`, sessionId)
+
+	return err
+}
+
+func (s *PostgresTokenStore) DeleteSession(ctx context.Context, userId, sessionId string) (bool, error) {
+	ctx, cancel := s.DB.Timeout(ctx)
+	defer cancel()
+
+	tag, err := s.conn().Exec(ctx, `
+		DELETE FROM tokens WHERE user_id = $1
+		AND ((id = $2 AND token_type = 'session') OR (session_id = $2 AND token_type IN ('csrf', 'access', 'refresh')))`,
+		userId, sessionId)
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
+
+func (s *PostgresTokenStore) DeleteOtherSessions(ctx context.Context, userId, keepId string) error {
+	ctx, cancel := s.DB.Timeout(ctx)
+	defer cancel()
+
+	_, err := s.conn().Exec(ctx, `
+		DELETE FROM tokens WHERE user_id = $1 AND token_type = ANY($3)
+		AND id <> $2 AND (session_id IS NULL OR session_id <> $2)`,
+		userId, keepId, SessionTypes)
+
+	return err
+}
+
+func (s *PostgresTokenStore) DeleteAll(ctx context.Context, userId string) error {
+	ctx, cancel := s.DB.Timeout(ctx)
+	defer cancel()
+
+	_, err := s.conn().Exec(ctx, `DELETE FROM tokens WHERE user_id = $1`, userId)
+
+	return err
+}
+
+// Sets the raw value the caller looked the token up by
+func withValue(token *Token, err error, value string) (*Token, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	token.Token = value
+	return token, nil
+}
+
+func scanFoundToken(row pgx.Row) (*Token, error) {
+	token, err := scanToken(row)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrTokenNotFound
+	}
+
+	return token, err
+}
+
+func scanToken(row pgx.Row) (*Token, error) {
+	var token Token
+	if err := row.Scan(
+		&token.Id,
+		&token.UserId,
+		&token.TokenType,
+		&token.Token,
+		&token.Payload,
+		&token.SessionId,
+		&token.Persistent,
+		&token.UsedAt,
+		&token.ExpiresAt,
+		&token.CreatedAt,
+		&token.UpdatedAt,
+	); err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
@@ -0,0 +1,58 @@
+package internal_test
+
+import (
+	"context"
+	"testing"
+
+	token "fucku/internal/tokens"
+	"fucku/testhelpers"
+)
+
+// Runs against a real Postgres, the memory store can't catch a query
+// selecting other columns than scanToken reads.
+func TestPostgresListTokens(t *testing.T) {
+	pdb := testhelpers.SetupPostgres(t)
+	secrets, _ := token.NewCSRFSecrets("test-secret")
+	pts := &token.TokenService{
+		DB:          pdb,
+		Logger:      logger,
+		Store:       token.NewPostgresTokenStore(pdb),
+		CSRFSecrets: secrets,
+	}
+	userId := "4c8fc246-38a3-4605-8b1e-f42544e008b6"
+
+	session, err := pts.NewSessionToken(context.Background(), userId, "laptop", "127.0.0.1", true)
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+	if _, err := pts.NewCSRFToken(context.Background(), session); err != nil {
+		t.Fatalf("failed to create csrf token: %v", err)
+	}
+	if _, err := pts.NewEmailChangeToken(context.Background(), userId, "new@example.com"); err != nil {
+		t.Fatalf("failed to create email change token: %v", err)
+	}
+
+	tokens, err := pts.ListTokens(context.Background(), userId)
+	if err != nil {
+		t.Fatalf("failed to list tokens: %v", err)
+	}
+	if len(tokens) != 3 {
+		t.Fatalf("expected 3 tokens, got: %+v", tokens)
+	}
+
+	for _, tok := range tokens {
+		if tok.Token != "" || tok.Payload != "" {
+			t.Errorf("expected no value & payload, got: %+v", tok)
+		}
+		switch tok.TokenType {
+		case token.TypeSession:
+			if !tok.Persistent {
+				t.Errorf("expected the session to be persistent, got: %+v", tok)
+			}
+		case token.TypeCSRF:
+			if tok.SessionId != session.Id {
+				t.Errorf("expected the csrf token to belong to the session, got: %+v", tok)
+			}
+		}
+	}
+}
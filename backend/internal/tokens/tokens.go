@@ -2,155 +2,473 @@ package internal
 
 import (
 	"context"
-	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"log/slog"
 	"math/big"
-	"os"
+	"slices"
 	"time"
 
+	audit "fucku/internal/audit"
 	database "fucku/internal/database"
 )
 
 const tokenCharset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 
+// Token types stored in the token_type column
+const (
+	TypeEmailVerification = "email_verification"
+	TypeSession           = "session"
+	TypeCSRF              = "csrf"
+	TypePasswordReset     = "password_reset"
+	TypeEmailChange       = "email_change"
+	TypeMFAPending        = "mfa_pending"
+	TypeAccountUnlock     = "account_unlock"
+	// WebAuthn ceremony state, the payload holds the serialized session data
+	TypeWebAuthnRegistration = "webauthn_registration"
+	TypeWebAuthnLogin        = "webauthn_login"
+	// Bearer logins, both belong to the session they were issued for
+	TypeAccess  = "access"
+	TypeRefresh = "refresh"
+)
+
+// Token types making up the logins of a user, revoked to log them out everywhere
+var SessionTypes = []string{TypeSession, TypeCSRF, TypeAccess, TypeRefresh}
+
+// Reset tokens grant a password change, so they are kept short lived
+const passwordResetTTL = 30 * time.Minute
+
+// Time a user has to enter the second factor after the password
+const mfaPendingTTL = 5 * time.Minute
+
+// Codes that may be entered with an MFA pending token before it is deleted
+const MaxMFAAttempts = 5
+
+// Payload of an MFA pending token whose login asked to be remembered
+const PayloadRememberMe = "remember_me"
+
+// Time a user has to complete a WebAuthn ceremony
+const challengeTTL = 5 * time.Minute
+
+// Owner of tokens not yet tied to a user, like the challenge of a passkey
+// login before the authenticator said whose passkey it is
+const NoUserId = "00000000-0000-0000-0000-000000000000"
+
+var (
+	ErrTokenNotFound = errors.New("token not found")
+	ErrTokenExpired  = errors.New("token expired")
+)
+
 type TokenService struct {
 	Logger *slog.Logger
-	DB     *database.Database
+	// Used for the audit log, may be nil when testing with a MemoryTokenStore
+	DB    *database.Database
+	Store TokenStore
+	// Revoke all other sessions of a user on login
+	SingleSession bool
+	// Signs the CSRF tokens, required for NewCSRFToken
+	CSRFSecrets *CSRFSecrets
+	Sessions    SessionConfig
+	// Set to hand out signed JWT access tokens on bearer logins instead of
+	// stored ones, requires JWTSubjects
+	JWTKeys     *JWTKeys
+	JWTSubjects JWTSubjectFunc
+	// Checked on every refresh of bearer tokens, nil lets all users refresh
+	UserActive UserActiveFunc
 }
 
 type Token struct {
-	Id        string    `json:"id"`
-	UserId    string    `json:"user_id"`
-	TokenType string    `json:"token_type"`
-	Token     string    `json:"token"`
-	ExpiresAt time.Time `json:"expires_at"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	Id        string `json:"id"`
+	UserId    string `json:"user_id"`
+	TokenType string `json:"token_type"`
+	Token     string `json:"token"`
+	Payload   string `json:"payload,omitempty"`
+	// Set for CSRF, access & refresh tokens, the session they belong to
+	SessionId string `json:"session_id,omitempty"`
+	// Set for "remember me" sessions
+	Persistent bool `json:"persistent,omitempty"`
+	// Set once a refresh token was rotated
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// A session as shown to its owner, without the secret token value
+type Session struct {
+	Id         string    `json:"id"`
+	UserAgent  string    `json:"user_agent"`
+	IPAddress  string    `json:"ip_address"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Persistent bool      `json:"persistent"`
+	Current    bool      `json:"current"`
 }
 
 func NewTokenService(logger *slog.Logger, db *database.Database) *TokenService {
 	return &TokenService{
-		DB:     db,
-		Logger: logger,
+		DB:       db,
+		Logger:   logger,
+		Store:    NewPostgresTokenStore(db),
+		Sessions: DefaultSessionConfig(),
 	}
 }
 
-func (ts *TokenService) NewVerificationToken(userId string) (*Token, error) {
+// Returns a copy of the service writing to store, e.g. one bound to a transaction.
+func (ts *TokenService) WithStore(store TokenStore) *TokenService {
+	bound := *ts
+	bound.Store = store
+	return &bound
+}
+
+func (ts *TokenService) NewVerificationToken(ctx context.Context, userId string) (*Token, error) {
 	uniqueToken, err := ts.newUniqueToken(8)
 	if err != nil {
 		return nil, err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-	defer cancel()
+	return ts.insertToken(ctx, userId, TypeEmailVerification, uniqueToken, "", time.Now().Add(time.Hour*12))
+}
 
-	row := ts.DB.DBPool.QueryRow(ctx, `
-		INSERT INTO tokens (user_id, token_type, token, expires_at)
-		VALUES ($1, $2, $3, $4) RETURNING id, user_id, token_type, token, expires_at, created_at, updated_at`,
-		userId,
-		"email_verification",
-		uniqueToken,
-		time.Now().Add(time.Hour*12))
+// Creates a single use password reset token, revoking any previous one.
+func (ts *TokenService) NewPasswordResetToken(ctx context.Context, userId string) (*Token, error) {
+	err := ts.Store.DeleteTypes(ctx, userId, TypePasswordReset)
+	if err != nil {
+		return nil, err
+	}
 
-	var token Token
-	if err := row.Scan(
-		&token.Id,
-		&token.UserId,
-		&token.TokenType,
-		&token.Token,
-		&token.ExpiresAt,
-		&token.CreatedAt,
-		&token.UpdatedAt,
-	); err != nil {
+	uniqueToken, err := ts.newUniqueToken(32)
+	if err != nil {
 		return nil, err
 	}
 
-	return &token, nil
+	return ts.insertToken(ctx, userId, TypePasswordReset, uniqueToken, "", time.Now().Add(passwordResetTTL))
 }
 
-func (ts *TokenService) NewSessionToken(userId string) (*Token, error) {
-	// Check if old token exists and revoke it
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-	defer cancel()
+// Creates the token handed out after a correct password when the user has
+// 2FA enabled. It is exchanged for a session once the second factor is checked,
+// a persistent one if remember is set.
+func (ts *TokenService) NewMFAPendingToken(ctx context.Context, userId string, remember bool) (*Token, error) {
+	uniqueToken, err := ts.newUniqueToken(32)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := ""
+	if remember {
+		payload = PayloadRememberMe
+	}
+
+	return ts.insertToken(ctx, userId, TypeMFAPending, uniqueToken, payload, time.Now().Add(mfaPendingTTL))
+}
+
+// Counts an attempt at the second factor with an MFA pending token and
+// returns how many are left after it. It is counted before the code is
+// checked, so parallel guesses count as well. Once none are left the token
+// is deleted and ErrTokenNotFound returned, the login has to start over.
+func (ts *TokenService) CountMFAAttempt(ctx context.Context, pending *Token) (int, error) {
+	attempts, err := ts.Store.CountAttempt(ctx, pending.Id)
+	if err != nil {
+		return 0, err
+	}
 
-	_, err := ts.DB.DBPool.Exec(ctx, `DELETE FROM tokens WHERE token_type = 'session' AND user_id = $1`, userId)
+	if attempts > MaxMFAAttempts {
+		if err := ts.Store.Delete(ctx, pending.Id); err != nil {
+			return 0, err
+		}
+		return 0, ErrTokenNotFound
+	}
+
+	return MaxMFAAttempts - attempts, nil
+}
+
+// Creates the token of an unlock link, mailed when an account gets locked.
+// It stays valid as long as the lock could last.
+func (ts *TokenService) NewAccountUnlockToken(ctx context.Context, userId string, ttl time.Duration) (*Token, error) {
+	err := ts.Store.DeleteTypes(ctx, userId, TypeAccountUnlock)
+	if err != nil {
+		return nil, err
+	}
+
+	uniqueToken, err := ts.newUniqueToken(32)
 	if err != nil {
 		return nil, err
 	}
 
+	return ts.insertToken(ctx, userId, TypeAccountUnlock, uniqueToken, "", time.Now().Add(ttl))
+}
+
+// Stores the state of a challenge-response ceremony (e.g. WebAuthn) in payload.
+// Older challenges of the same type are kept. Logins look theirs up by value,
+// so parallel ones work, while a registration only finishes the latest one
+// and revokes all others (see users.FinishPasskeyRegistration).
+func (ts *TokenService) NewChallengeToken(ctx context.Context, userId, tokenType, payload string) (*Token, error) {
 	uniqueToken, err := ts.newUniqueToken(32)
 	if err != nil {
 		return nil, err
 	}
 
-	row := ts.DB.DBPool.QueryRow(ctx, `
-		INSERT INTO tokens (user_id, token_type, token, expires_at)
-		VALUES ($1, $2, $3, $4) RETURNING id, user_id, token_type, token, expires_at, created_at, updated_at`,
-		userId,
-		"session",
-		uniqueToken,
-		time.Now().Add(time.Hour*24))
+	return ts.insertToken(ctx, userId, tokenType, uniqueToken, payload, time.Now().Add(challengeTTL))
+}
+
+// Deletes a single token by its id.
+func (ts *TokenService) DeleteToken(ctx context.Context, id string) error {
+	return ts.Store.Delete(ctx, id)
+}
+
+// Creates a confirmation code for switching a users email to newEmail.
+// The new address travels in the tokens payload until it is confirmed.
+func (ts *TokenService) NewEmailChangeToken(ctx context.Context, userId, newEmail string) (*Token, error) {
+	err := ts.Store.DeleteTypes(ctx, userId, TypeEmailChange)
+	if err != nil {
+		return nil, err
+	}
+
+	uniqueToken, err := ts.newUniqueToken(8)
+	if err != nil {
+		return nil, err
+	}
+
+	return ts.insertToken(ctx, userId, TypeEmailChange, uniqueToken, newEmail, time.Now().Add(time.Hour))
+}
+
+// Creates a new session for a device. Unless SingleSession is set,
+// existing sessions of the user stay valid. Persistent sessions get the
+// "remember me" lifetimes of ts.Sessions.
+func (ts *TokenService) NewSessionToken(ctx context.Context, userId, userAgent, ipAddress string, persistent bool) (*Token, error) {
+	now := time.Now().UTC()
+	expiresAt := ts.sessionConfig().ExpiresAt(now, now, persistent)
+
+	return ts.newSession(ctx, userId, userAgent, ipAddress, persistent, false, expiresAt)
+}
+
+// Stores the session row of a cookie or a bearer login
+func (ts *TokenService) newSession(ctx context.Context, userId, userAgent, ipAddress string, persistent, bearer bool, expiresAt time.Time) (*Token, error) {
+	if ts.SingleSession {
+		// Revoke all old sessions including their CSRF & bearer tokens
+		err := ts.Store.DeleteTypes(ctx, userId, SessionTypes...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	uniqueToken, err := ts.newUniqueToken(32)
+	if err != nil {
+		return nil, err
+	}
 
-	var token Token
-	if err := row.Scan(
-		&token.Id,
-		&token.UserId,
-		&token.TokenType,
-		&token.Token,
-		&token.ExpiresAt,
-		&token.CreatedAt,
-		&token.UpdatedAt,
-	); err != nil {
+	token, err := ts.Store.Insert(ctx, TokenParams{
+		UserId:     userId,
+		TokenType:  TypeSession,
+		Token:      uniqueToken,
+		UserAgent:  userAgent,
+		IPAddress:  ipAddress,
+		Persistent: persistent,
+		ExpiresAt:  expiresAt,
+	})
+	if err != nil {
 		return nil, err
 	}
 
-	return &token, nil
+	audit.Record(ctx, ts.DB, ts.Logger, nil, audit.Event{
+		UserId:    userId,
+		EventType: audit.EventSessionCreated,
+		IPAddress: ipAddress,
+		UserAgent: userAgent,
+		Metadata:  map[string]any{"session_id": token.Id, "single_session": ts.SingleSession, "persistent": persistent, "bearer": bearer},
+	})
+
+	return token, nil
+}
+
+// Services built without NewTokenService have no lifetimes set
+func (ts *TokenService) sessionConfig() SessionConfig {
+	if ts.Sessions == (SessionConfig{}) {
+		return DefaultSessionConfig()
+	}
+
+	return ts.Sessions
 }
 
-func (ts *TokenService) NewCSRFToken(userId string) (*Token, error) {
+// Creates the CSRF token of a session, replacing the previous one.
+// The token is signed over the session id, see CSRFSecrets, and expires
+// with the session.
+func (ts *TokenService) NewCSRFToken(ctx context.Context, session *Token) (*Token, error) {
 	// Check if old token exists and revoke it
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-	defer cancel()
+	err := ts.Store.DeleteCSRF(ctx, session.Id)
+	if err != nil {
+		return nil, err
+	}
 
-	_, err := ts.DB.DBPool.Exec(ctx, `DELETE FROM tokens WHERE token_type = 'csrf' AND user_id = $1`, userId)
+	if ts.CSRFSecrets == nil {
+		return nil, ErrNoCSRFSecret
+	}
+
+	signedToken, err := ts.CSRFSecrets.Sign(session.Id)
 	if err != nil {
 		return nil, err
 	}
 
-	rawToken := make([]byte, 32)
-	if _, err := rand.Read(rawToken); err != nil {
-		return nil, err 
+	return ts.Store.Insert(ctx, TokenParams{
+		UserId:    session.UserId,
+		TokenType: TypeCSRF,
+		Token:     signedToken,
+		SessionId: session.Id,
+		ExpiresAt: session.ExpiresAt,
+	})
+}
+
+// Lists the active sessions of a user, most recently used first.
+func (ts *TokenService) ListSessions(ctx context.Context, userId string) ([]Session, error) {
+	return ts.Store.ListSessions(ctx, userId)
+}
+
+// Deletes a single session of a user together with its CSRF or bearer tokens.
+// Returns false if the user has no such session.
+func (ts *TokenService) RevokeSession(ctx context.Context, userId, sessionId string) (bool, error) {
+	revoked, err := ts.Store.DeleteSession(ctx, userId, sessionId)
+	if err != nil {
+		return false, err
+	}
+
+	if revoked {
+		audit.Record(ctx, ts.DB, ts.Logger, nil, audit.Event{
+			UserId:    userId,
+			EventType: audit.EventSessionRevoked,
+			Metadata:  map[string]any{"session_id": sessionId},
+		})
+	}
+
+	return revoked, nil
+}
+
+// Looks up a users token of the given type by its value.
+// Returns ErrTokenNotFound if there is no such token and ErrTokenExpired
+// alongside the token if it exists but is no longer valid.
+func (ts *TokenService) GetUserToken(ctx context.Context, userId, tokenType, value string) (*Token, error) {
+	token, err := ts.Store.FindForUser(ctx, userId, tokenType, value)
+	if err != nil {
+		return nil, err
+	}
+
+	if token.ExpiresAt.Before(time.Now().UTC()) {
+		return token, ErrTokenExpired
+	}
+
+	return token, nil
+}
+
+// Looks up a token of the given type by its value alone.
+// Error semantics are the same as for GetUserToken.
+func (ts *TokenService) GetToken(ctx context.Context, tokenType, value string) (*Token, error) {
+	token, err := ts.Store.Find(ctx, tokenType, value)
+	if err != nil {
+		return nil, err
 	}
 
-	t := hmac.New(sha256.New, []byte(os.Getenv("CSRF_SECRET")))
-	t.Write(rawToken)
-	signedToken := hex.EncodeToString(t.Sum(nil))
+	if token.ExpiresAt.Before(time.Now().UTC()) {
+		return token, ErrTokenExpired
+	}
 
-	row := ts.DB.DBPool.QueryRow(ctx, `
-		INSERT INTO tokens (user_id, token_type, token, expires_at)
-		VALUES ($1, $2, $3, $4) RETURNING id, user_id, token_type, token, expires_at, created_at, updated_at`,
-		userId,
-		"csrf",
-		signedToken,
-		time.Now().Add(time.Hour*24))
+	return token, nil
+}
 
-	var token Token
-	if err := row.Scan(
-		&token.Id,
-		&token.UserId,
-		&token.TokenType,
-		&token.Token,
-		&token.ExpiresAt,
-		&token.CreatedAt,
-		&token.UpdatedAt,
-	); err != nil {
+// Like GetToken, but deletes the token in the same step, so two requests
+// can't both use it. Expired tokens are deleted as well.
+func (ts *TokenService) ConsumeToken(ctx context.Context, tokenType, value string) (*Token, error) {
+	token, err := ts.Store.Consume(ctx, tokenType, value)
+	if err != nil {
 		return nil, err
 	}
 
-	return &token, nil
+	if token.ExpiresAt.Before(time.Now().UTC()) {
+		return token, ErrTokenExpired
+	}
+
+	return token, nil
+}
+
+// Returns the most recently created token of the given type for a user.
+func (ts *TokenService) LatestToken(ctx context.Context, userId, tokenType string) (*Token, error) {
+	return ts.Store.Latest(ctx, userId, tokenType)
+}
+
+// Deletes all sessions of a user except the one with the given id.
+// CSRF & bearer tokens of the revoked sessions are deleted as well.
+func (ts *TokenService) RevokeOtherSessions(ctx context.Context, userId, keepId string) error {
+	err := ts.Store.DeleteOtherSessions(ctx, userId, keepId)
+	if err != nil {
+		return err
+	}
+
+	audit.Record(ctx, ts.DB, ts.Logger, nil, audit.Event{
+		UserId:    userId,
+		EventType: audit.EventTokensRevoked,
+		Metadata:  map[string]any{"token_types": SessionTypes, "kept_session_id": keepId},
+	})
+
+	return nil
+}
+
+// Deletes all tokens of the given types belonging to a user.
+func (ts *TokenService) RevokeTokens(ctx context.Context, userId string, tokenTypes ...string) error {
+	err := ts.Store.DeleteTypes(ctx, userId, tokenTypes...)
+	if err != nil {
+		return err
+	}
+
+	// Only logouts are worth auditing, not consumed one-off codes
+	if slices.Contains(tokenTypes, TypeSession) {
+		audit.Record(ctx, ts.DB, ts.Logger, nil, audit.Event{
+			UserId:    userId,
+			EventType: audit.EventTokensRevoked,
+			Metadata:  map[string]any{"token_types": tokenTypes},
+		})
+	}
+
+	return nil
+}
+
+// Deletes every token of a user, e.g. when the account is removed.
+func (ts *TokenService) RevokeAllTokens(ctx context.Context, userId string) error {
+	err := ts.Store.DeleteAll(ctx, userId)
+	if err != nil {
+		return err
+	}
+
+	audit.Record(ctx, ts.DB, ts.Logger, nil, audit.Event{
+		UserId:    userId,
+		EventType: audit.EventTokensRevoked,
+		Metadata:  map[string]any{"token_types": "all"},
+	})
+
+	return nil
+}
+
+// Lists the unexpired tokens of a user, newest first.
+// Token values & payloads are left empty since they are secrets.
+func (ts *TokenService) ListTokens(ctx context.Context, userId string) ([]Token, error) {
+	return ts.Store.List(ctx, userId)
+}
+
+func (ts *TokenService) insertToken(ctx context.Context, userId, tokenType, value, payload string, expiresAt time.Time) (*Token, error) {
+	return ts.Store.Insert(ctx, TokenParams{
+		UserId:    userId,
+		TokenType: tokenType,
+		Token:     value,
+		Payload:   payload,
+		ExpiresAt: expiresAt,
+	})
+}
+
+// The digest stored in place of a token value. Tokens are random enough that
+// an unsalted hash can't be reversed, yet lookups stay a simple equality check.
+func HashToken(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
 }
 
 func (ts *TokenService) newUniqueToken(length int) (string, error) {
@@ -165,18 +483,24 @@ func (ts *TokenService) newUniqueToken(length int) (string, error) {
 	return string(token), nil
 }
 
-func StartTokenCleanup(db *database.Database, logger *slog.Logger) {
+// Deletes expired tokens every hour until ctx is canceled.
+func StartTokenCleanup(ctx context.Context, db *database.Database, logger *slog.Logger) {
 	ticker := time.NewTicker(1 * time.Hour)
 	defer ticker.Stop()
 
 	for {
-		cleanupExpiredTokens(db, logger)
-		<-ticker.C
+		cleanupExpiredTokens(ctx, db, logger)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 	}
 }
 
-func cleanupExpiredTokens(db *database.Database, logger *slog.Logger) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+func cleanupExpiredTokens(ctx context.Context, db *database.Database, logger *slog.Logger) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
 	_, err := db.DBPool.Exec(ctx, "DELETE FROM tokens WHERE expires_at < $1", time.Now())
 	if err != nil {
@@ -34,6 +34,7 @@ func TestMain(m *testing.M) {
 	ts = token.TokenService{
 		DB:     db,
 		Logger: logger,
+		Store:  token.NewPostgresTokenStore(db),
 	}
 
 	code := m.Run()
@@ -43,7 +44,7 @@ func TestMain(m *testing.M) {
 }
 
 func TestSessionToken(t *testing.T) {
-	token, err := ts.NewSessionToken("4c8fc246-38a3-4605-8b1e-f42544e008b6")
+	token, err := ts.NewSessionToken(context.Background(), "4c8fc246-38a3-4605-8b1e-f42544e008b6", "test-agent", "127.0.0.1", false)
 	if err != nil {
 		t.Fatalf("error during TestSessionToken: %v", err)
 	}
@@ -62,12 +63,15 @@ func TestSessionToken(t *testing.T) {
 }
 
 func TestSessionRevoke(t *testing.T) {
-	tokenOne, err := ts.NewSessionToken("4c8fc246-38a3-4605-8b1e-f42544e008b6")
+	ts.SingleSession = true
+	defer func() { ts.SingleSession = false }()
+
+	tokenOne, err := ts.NewSessionToken(context.Background(), "4c8fc246-38a3-4605-8b1e-f42544e008b6", "test-agent", "127.0.0.1", false)
 	if err != nil {
 		t.Fatalf("error during TestSessionToken (token one): %v", err)
 	}
 
-	tokenTwo, err := ts.NewSessionToken("4c8fc246-38a3-4605-8b1e-f42544e008b6")
+	tokenTwo, err := ts.NewSessionToken(context.Background(), "4c8fc246-38a3-4605-8b1e-f42544e008b6", "test-agent", "127.0.0.1", false)
 	if err != nil {
 		t.Fatalf("error during TestSessionToken (token two): %v", err)
 	}
@@ -95,6 +99,80 @@ func TestSessionRevoke(t *testing.T) {
 	cleanupToken(tokenTwo)
 }
 
+func TestMultipleSessions(t *testing.T) {
+	tokenOne, err := ts.NewSessionToken(context.Background(), "4c8fc246-38a3-4605-8b1e-f42544e008b6", "laptop", "127.0.0.1", false)
+	if err != nil {
+		t.Fatalf("error during TestMultipleSessions (token one): %v", err)
+	}
+	defer cleanupToken(tokenOne)
+
+	tokenTwo, err := ts.NewSessionToken(context.Background(), "4c8fc246-38a3-4605-8b1e-f42544e008b6", "phone", "127.0.0.2", false)
+	if err != nil {
+		t.Fatalf("error during TestMultipleSessions (token two): %v", err)
+	}
+	defer cleanupToken(tokenTwo)
+
+	sessions, err := ts.ListSessions(context.Background(), "4c8fc246-38a3-4605-8b1e-f42544e008b6")
+	if err != nil {
+		t.Fatalf("failed to list sessions: %v", err)
+	}
+
+	if len(sessions) != 2 {
+		t.Fatalf("expected 2 sessions, got: %d", len(sessions))
+	}
+
+	found, err := ts.RevokeSession(context.Background(), "4c8fc246-38a3-4605-8b1e-f42544e008b6", tokenOne.Id)
+	if err != nil || !found {
+		t.Fatalf("failed to revoke session one: %v", err)
+	}
+
+	sessions, err = ts.ListSessions(context.Background(), "4c8fc246-38a3-4605-8b1e-f42544e008b6")
+	if err != nil {
+		t.Fatalf("failed to list sessions: %v", err)
+	}
+
+	if len(sessions) != 1 || sessions[0].Id != tokenTwo.Id {
+		t.Errorf("expected only session two to remain, got: %+v", sessions)
+	}
+}
+
+func TestPasswordResetToken(t *testing.T) {
+	tokenOne, err := ts.NewPasswordResetToken(context.Background(), "4c8fc246-38a3-4605-8b1e-f42544e008b6")
+	if err != nil {
+		t.Fatalf("error during TestPasswordResetToken (token one): %v", err)
+	}
+
+	if tokenOne.TokenType != token.TypePasswordReset {
+		t.Errorf("expected token type %s, got: %s", token.TypePasswordReset, tokenOne.TokenType)
+	}
+
+	if time.Until(tokenOne.ExpiresAt) > time.Hour {
+		t.Errorf("expected reset token to expire within an hour, got: %s", tokenOne.ExpiresAt)
+	}
+
+	tokenTwo, err := ts.NewPasswordResetToken(context.Background(), "4c8fc246-38a3-4605-8b1e-f42544e008b6")
+	if err != nil {
+		t.Fatalf("error during TestPasswordResetToken (token two): %v", err)
+	}
+
+	// Requesting a new reset token invalidates the previous one
+	if _, err = ts.GetToken(context.Background(), token.TypePasswordReset, tokenOne.Token); err != token.ErrTokenNotFound {
+		t.Errorf("expected ErrTokenNotFound for token one, got: %v", err)
+	}
+
+	if _, err = ts.GetToken(context.Background(), token.TypePasswordReset, tokenTwo.Token); err != nil {
+		t.Errorf("unexpected error (token two): %v", err)
+	}
+
+	// Consuming deletes it, a second try finds nothing
+	if _, err = ts.ConsumeToken(context.Background(), token.TypePasswordReset, tokenTwo.Token); err != nil {
+		t.Errorf("unexpected error consuming token two: %v", err)
+	}
+	if _, err = ts.ConsumeToken(context.Background(), token.TypePasswordReset, tokenTwo.Token); err != token.ErrTokenNotFound {
+		t.Errorf("expected ErrTokenNotFound consuming token two again, got: %v", err)
+	}
+}
+
 func cleanupToken(token *token.Token) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
@@ -0,0 +1,375 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	audit "fucku/internal/audit"
+	database "fucku/internal/database"
+	mailer "fucku/internal/mailer"
+	token "fucku/internal/tokens"
+	utils "fucku/internal/utils"
+
+	"github.com/alexedwards/argon2id"
+	"github.com/jackc/pgx/v5"
+)
+
+type changePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type changeEmailRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+type confirmEmailRequest struct {
+	Code string `json:"code"`
+}
+
+type changeLocaleRequest struct {
+	Locale string `json:"locale"`
+}
+
+// Changes the password of the logged in user.
+// Every other session of the user is revoked, the current one stays valid.
+func ChangePassword(db *database.Database, logger *slog.Logger, ts *token.TokenService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := GetUserFromContext(r.Context())
+		session, sessionOk := GetSessionFromContext(r.Context())
+		if !ok || !sessionOk {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			logger.Error("failed to change password (failed to read user from context)")
+			return
+		}
+
+		var cr changePasswordRequest
+		err := utils.DecodeJSONBody(w, r, &cr)
+		if err != nil {
+			var mr *utils.MalformedRequest
+			if errors.As(err, &mr) {
+				http.Error(w, mr.Msg, mr.Status)
+				return
+			} else {
+				logger.Error("error while decoding json body in change password", "error", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if err := checkPassword(r.Context(), db, user.Id, cr.CurrentPassword); err != nil {
+			if errors.Is(err, errWrongPassword) {
+				audit.Record(r.Context(), db, logger, r, audit.Event{
+					ActorId:   user.Id,
+					UserId:    user.Id,
+					EventType: audit.EventPasswordChanged,
+					Outcome:   audit.OutcomeFailure,
+					Metadata:  map[string]any{"reason": "wrong_password"},
+				})
+				http.Error(w, "current password is incorrect", http.StatusBadRequest)
+				return
+			}
+			logger.Error("failed to check current password", "error", err, "user_id", user.Id)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		uu := NewUnregisteredUser()
+		uu.Password = cr.NewPassword
+		uu.validateWhitespace()
+		uu.validatePassword()
+
+		if !uu.Valid {
+			http.Error(w, strings.Join(uu.Reasons, "\n"), http.StatusBadRequest)
+			return
+		}
+
+		uu.hashPassword()
+		if !uu.Valid {
+			logger.Warn("failed to hash password", "user_id", user.Id)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		ctx, cancel := db.Timeout(r.Context())
+		defer cancel()
+
+		_, err = db.DBPool.Exec(ctx,
+			`UPDATE users SET password = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2`,
+			uu.Password, user.Id)
+		if err != nil {
+			logger.Error("failed to update password", "error", err, "user_id", user.Id)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if err = ts.RevokeOtherSessions(r.Context(), user.Id, sessionId(session)); err != nil {
+			logger.Error("failed to revoke other sessions after password change", "error", err, "user_id", user.Id)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		audit.Record(r.Context(), db, logger, r, audit.Event{ActorId: user.Id, UserId: user.Id, EventType: audit.EventPasswordChanged})
+		logger.Info("password changed", "user_id", user.Id)
+		w.WriteHeader(200)
+		fmt.Fprintln(w, "password changed successfully")
+	})
+}
+
+// Starts an email change by sending a confirmation code to the new address.
+// users.email is only updated once the code is confirmed.
+func ChangeEmail(db *database.Database, logger *slog.Logger, ts *token.TokenService, mailer *mailer.Mailer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := GetUserFromContext(r.Context())
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			logger.Error("failed to change email (failed to read user from context)")
+			return
+		}
+
+		var cr changeEmailRequest
+		err := utils.DecodeJSONBody(w, r, &cr)
+		if err != nil {
+			var mr *utils.MalformedRequest
+			if errors.As(err, &mr) {
+				http.Error(w, mr.Msg, mr.Status)
+				return
+			} else {
+				logger.Error("error while decoding json body in change email", "error", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if err := checkPassword(r.Context(), db, user.Id, cr.Password); err != nil {
+			if errors.Is(err, errWrongPassword) {
+				audit.Record(r.Context(), db, logger, r, audit.Event{
+					ActorId:   user.Id,
+					UserId:    user.Id,
+					EventType: audit.EventEmailChangeRequest,
+					Outcome:   audit.OutcomeFailure,
+					Metadata:  map[string]any{"reason": "wrong_password"},
+				})
+				http.Error(w, "password is incorrect", http.StatusBadRequest)
+				return
+			}
+			logger.Error("failed to check password", "error", err, "user_id", user.Id)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		uu := NewUnregisteredUser()
+		uu.Email = cr.Email
+		uu.validateWhitespace()
+		uu.validateEmail()
+
+		if !uu.Valid {
+			http.Error(w, strings.Join(uu.Reasons, "\n"), http.StatusBadRequest)
+			return
+		}
+
+		if uu.Email == user.Email {
+			http.Error(w, "this is already your email", http.StatusBadRequest)
+			return
+		}
+
+		taken, err := emailTaken(r.Context(), db, uu.Email)
+		if err != nil {
+			logger.Error("failed to check email during email change", "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if taken {
+			http.Error(w, "email already taken", http.StatusBadRequest)
+			return
+		}
+
+		changeToken, err := ts.NewEmailChangeToken(r.Context(), user.Id, uu.Email)
+		if err != nil {
+			logger.Error("failed to create email change token", "error", err, "user_id", user.Id)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if err := mailer.SendEmailChangeMail(r.Context(), user.Username, uu.Email, user.Locale, changeToken.Token); err != nil {
+			logger.Error("failed to queue email change mail", "error", err, "email", uu.Email)
+		}
+
+		audit.Record(r.Context(), db, logger, r, audit.Event{
+			ActorId:   user.Id,
+			UserId:    user.Id,
+			EventType: audit.EventEmailChangeRequest,
+			Metadata:  map[string]any{"new_email": uu.Email},
+		})
+		logger.Info("email change requested", "user_id", user.Id)
+		w.WriteHeader(200)
+		fmt.Fprintln(w, "confirmation code sent to the new email")
+	})
+}
+
+// Confirms a pending email change and swaps the users email.
+func ConfirmEmailChange(db *database.Database, logger *slog.Logger, ts *token.TokenService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := GetUserFromContext(r.Context())
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			logger.Error("failed to confirm email change (failed to read user from context)")
+			return
+		}
+
+		var cr confirmEmailRequest
+		err := utils.DecodeJSONBody(w, r, &cr)
+		if err != nil {
+			var mr *utils.MalformedRequest
+			if errors.As(err, &mr) {
+				http.Error(w, mr.Msg, mr.Status)
+				return
+			} else {
+				logger.Error("error while decoding json body in confirm email change", "error", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		changeToken, err := ts.GetUserToken(r.Context(), user.Id, token.TypeEmailChange, cr.Code)
+		if err != nil {
+			switch {
+			case errors.Is(err, token.ErrTokenNotFound):
+				http.Error(w, "invalid confirmation code", http.StatusBadRequest)
+			case errors.Is(err, token.ErrTokenExpired):
+				http.Error(w, "confirmation code expired", http.StatusGone)
+			default:
+				logger.Error("failed to read email change token", "error", err, "user_id", user.Id)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		ctx, cancel := db.Timeout(r.Context())
+		defer cancel()
+
+		// The new address was just proven to be reachable, so it counts as verified
+		_, err = db.DBPool.Exec(ctx,
+			`UPDATE users SET email = $1, verified = 1, updated_at = CURRENT_TIMESTAMP WHERE id = $2`,
+			changeToken.Payload, user.Id)
+		if err != nil {
+			if _, ok := database.UniqueViolation(err); ok {
+				http.Error(w, "email already taken", http.StatusConflict)
+				return
+			}
+			logger.Error("failed to update email", "error", err, "user_id", user.Id)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if err = ts.RevokeTokens(r.Context(), user.Id, token.TypeEmailChange); err != nil {
+			logger.Error("failed to delete email change tokens", "error", err, "user_id", user.Id)
+		}
+
+		audit.Record(r.Context(), db, logger, r, audit.Event{
+			ActorId:   user.Id,
+			UserId:    user.Id,
+			EventType: audit.EventEmailChanged,
+			Metadata:  map[string]any{"old_email": user.Email, "new_email": changeToken.Payload},
+		})
+		logger.Info("email changed", "user_id", user.Id)
+		w.WriteHeader(200)
+		fmt.Fprintln(w, "email changed successfully")
+	})
+}
+
+// Sets the language the logged in user gets their mails in.
+func ChangeLocale(db *database.Database, logger *slog.Logger, mailer *mailer.Mailer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := GetUserFromContext(r.Context())
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			logger.Error("failed to change locale (failed to read user from context)")
+			return
+		}
+
+		var cr changeLocaleRequest
+		err := utils.DecodeJSONBody(w, r, &cr)
+		if err != nil {
+			var mr *utils.MalformedRequest
+			if errors.As(err, &mr) {
+				http.Error(w, mr.Msg, mr.Status)
+				return
+			} else {
+				logger.Error("error while decoding json body in change locale", "error", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		locales := mailer.Templates.Locales()
+		if !slices.Contains(locales, cr.Locale) {
+			http.Error(w, "locale must be one of: "+strings.Join(locales, ", "), http.StatusBadRequest)
+			return
+		}
+
+		ctx, cancel := db.Timeout(r.Context())
+		defer cancel()
+
+		_, err = db.DBPool.Exec(ctx,
+			`UPDATE users SET locale = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2`, cr.Locale, user.Id)
+		if err != nil {
+			logger.Error("failed to change locale", "error", err, "user_id", user.Id)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		logger.Info("changed locale", "user_id", user.Id, "locale", cr.Locale)
+		w.WriteHeader(200)
+		fmt.Fprintln(w, "locale changed successfully")
+	})
+}
+
+var errWrongPassword = errors.New("wrong password")
+
+// Compares password against the stored hash of the user.
+// Returns errWrongPassword if they don't match.
+func checkPassword(ctx context.Context, db *database.Database, userId, password string) error {
+	ctx, cancel := db.Timeout(ctx)
+	defer cancel()
+
+	var hash string
+	row := db.DBPool.QueryRow(ctx, `SELECT password FROM users WHERE id = $1`, userId)
+	if err := row.Scan(&hash); err != nil {
+		return err
+	}
+
+	match, err := argon2id.ComparePasswordAndHash(password, hash)
+	if err != nil {
+		return err
+	}
+
+	if !match {
+		return errWrongPassword
+	}
+
+	return nil
+}
+
+func emailTaken(ctx context.Context, db *database.Database, email string) (bool, error) {
+	ctx, cancel := db.Timeout(ctx)
+	defer cancel()
+
+	var id string
+	row := db.DBPool.QueryRow(ctx, `SELECT id FROM users WHERE email = $1`, email)
+	if err := row.Scan(&id); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
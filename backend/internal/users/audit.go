@@ -0,0 +1,150 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	audit "fucku/internal/audit"
+	database "fucku/internal/database"
+
+	"github.com/google/uuid"
+)
+
+const (
+	defaultEventPageSize = 50
+	maxEventPageSize     = 200
+)
+
+// Lists the security relevant events of the logged in user, newest first.
+// Supports limit & offset.
+func SecurityEvents(db *database.Database, logger *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := GetUserFromContext(r.Context())
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			logger.Error("failed to list security events (failed to read user from context)")
+			return
+		}
+
+		f := audit.Filter{UserId: user.Id}
+		if err := parsePage(r, &f); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		events, err := audit.List(r.Context(), db, f)
+		if err != nil {
+			logger.Error("failed to list security events", "error", err, "user_id", user.Id)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(map[string]any{"events": events})
+		if err != nil {
+			http.Error(w, "Failed to encode JSON", http.StatusInternalServerError)
+			logger.Error("failed to encode json", "error", err)
+			return
+		}
+	})
+}
+
+// Queries the audit log. Supports user_id, actor_id, type, outcome, ip,
+// from & to (RFC 3339), limit & offset.
+func AdminAuditEvents(db *database.Database, logger *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, err := parseEventFilter(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		events, err := audit.List(r.Context(), db, f)
+		if err != nil {
+			logger.Error("failed to query audit events", "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(map[string]any{
+			"events": events,
+			"limit":  f.Limit,
+			"offset": f.Offset,
+		})
+		if err != nil {
+			http.Error(w, "Failed to encode JSON", http.StatusInternalServerError)
+			logger.Error("failed to encode json", "error", err)
+			return
+		}
+	})
+}
+
+func parseEventFilter(r *http.Request) (audit.Filter, error) {
+	q := r.URL.Query()
+	f := audit.Filter{
+		UserId:    q.Get("user_id"),
+		ActorId:   q.Get("actor_id"),
+		EventType: q.Get("type"),
+		Outcome:   q.Get("outcome"),
+		IPAddress: q.Get("ip"),
+	}
+
+	for _, id := range []struct{ param, value string }{{"user_id", f.UserId}, {"actor_id", f.ActorId}} {
+		if id.value == "" {
+			continue
+		}
+		if _, err := uuid.Parse(id.value); err != nil {
+			return f, fmt.Errorf("invalid %s", id.param)
+		}
+	}
+
+	for _, t := range []struct {
+		param string
+		dst   **time.Time
+	}{{"from", &f.From}, {"to", &f.To}} {
+		if v := q.Get(t.param); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return f, fmt.Errorf("invalid %s, expected RFC 3339", t.param)
+			}
+			*t.dst = &parsed
+		}
+	}
+
+	return f, parsePage(r, &f)
+}
+
+func parsePage(r *http.Request, f *audit.Filter) error {
+	var err error
+	f.Limit, f.Offset, err = parseLimitOffset(r)
+	return err
+}
+
+func parseLimitOffset(r *http.Request) (int, int, error) {
+	q := r.URL.Query()
+	limit, offset := defaultEventPageSize, 0
+
+	if v := q.Get("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l < 1 || l > maxEventPageSize {
+			return 0, 0, fmt.Errorf("limit must be between 1 and %d", maxEventPageSize)
+		}
+		limit = l
+	}
+
+	if v := q.Get("offset"); v != "" {
+		o, err := strconv.Atoi(v)
+		if err != nil || o < 0 {
+			return 0, 0, errors.New("invalid offset")
+		}
+		offset = o
+	}
+
+	return limit, offset, nil
+}
@@ -0,0 +1,140 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	token "fucku/internal/tokens"
+	utils "fucku/internal/utils"
+)
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// Reports whether a login asked for bearer tokens instead of cookies,
+// e.g. POST /login?mode=token. Works for every way to log in.
+func wantsBearerTokens(r *http.Request) bool {
+	return r.URL.Query().Get("mode") == "token"
+}
+
+// Adds the fields of a token pair to a JSON response, named like an OAuth 2 token response
+func addBearerFields(resData map[string]any, tokens *token.BearerTokens) {
+	now := time.Now().UTC()
+	resData["token_type"] = "Bearer"
+	resData["access_token"] = tokens.Access.Token
+	resData["expires_in"] = int(tokens.Access.ExpiresAt.Sub(now).Seconds())
+	resData["refresh_token"] = tokens.Refresh.Token
+	resData["refresh_expires_in"] = int(tokens.Refresh.ExpiresAt.Sub(now).Seconds())
+}
+
+// Exchanges a refresh token for a new access & refresh token. Replaying an
+// already used refresh token logs out the login it belongs to.
+func RefreshBearerToken(logger *slog.Logger, ts *token.TokenService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var rr refreshRequest
+		err := utils.DecodeJSONBody(w, r, &rr)
+		if err != nil {
+			var mr *utils.MalformedRequest
+			if errors.As(err, &mr) {
+				http.Error(w, mr.Msg, mr.Status)
+				return
+			} else {
+				logger.Error("error while decoding json body in refresh token", "error", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if rr.RefreshToken == "" {
+			http.Error(w, "missing refresh token", http.StatusBadRequest)
+			return
+		}
+
+		tokens, err := ts.RefreshBearerTokens(r.Context(), rr.RefreshToken)
+		if err != nil {
+			if errors.Is(err, token.ErrTokenNotFound) || errors.Is(err, token.ErrTokenExpired) || errors.Is(err, token.ErrRefreshTokenReused) || errors.Is(err, token.ErrUserInactive) {
+				http.Error(w, "invalid refresh token", http.StatusUnauthorized)
+				return
+			}
+			logger.Error("failed to refresh bearer tokens", "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		resData := make(map[string]any)
+		addBearerFields(resData, tokens)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		err = json.NewEncoder(w).Encode(resData)
+		if err != nil {
+			http.Error(w, "Failed to encode JSON", http.StatusInternalServerError)
+			logger.Error("failed to encode json", "error", err)
+			return
+		}
+	})
+}
+
+// Looks up what JWT access tokens say about a user, for token.TokenService.JWTSubjects
+func JWTSubjects(store UserStore) token.JWTSubjectFunc {
+	return func(ctx context.Context, userId string) (token.JWTSubject, error) {
+		u, err := store.GetById(ctx, userId)
+		if err != nil {
+			return token.JWTSubject{}, err
+		}
+
+		roles, err := store.Roles(ctx, userId)
+		if err != nil {
+			return token.JWTSubject{}, err
+		}
+
+		return token.JWTSubject{
+			Username: u.Username,
+			Verified: u.Verified == 1,
+			Roles:    roles,
+		}, nil
+	}
+}
+
+// Refuses refreshes of deleted or suspended users, for token.TokenService.UserActive
+func UserActive(store UserStore) token.UserActiveFunc {
+	return func(ctx context.Context, userId string) error {
+		u, err := store.GetById(ctx, userId)
+		if err != nil {
+			if errors.Is(err, ErrUserNotFound) {
+				return token.ErrUserInactive
+			}
+			return err
+		}
+
+		if u.SuspendedAt != nil {
+			return token.ErrUserInactive
+		}
+
+		return nil
+	}
+}
+
+// Publishes the public keys of the JWT access tokens, so other services
+// can check them on their own, e.g. with the fucku/pkg/jwtverify package.
+// That check is the signature only: while this backend rejects the token
+// of a logged out or suspended user right away, other services accept it
+// until it expires, which is why access tokens are kept short lived.
+func JWKS(keys *token.JWTKeys, logger *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		// Verifiers fetch again on an unknown kid, so a new key works right away
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		err := json.NewEncoder(w).Encode(keys.JWKS())
+		if err != nil {
+			http.Error(w, "Failed to encode JSON", http.StatusInternalServerError)
+			logger.Error("failed to encode json", "error", err)
+			return
+		}
+	})
+}
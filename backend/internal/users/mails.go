@@ -0,0 +1,126 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+
+	audit "fucku/internal/audit"
+	database "fucku/internal/database"
+	mailer "fucku/internal/mailer"
+
+	"github.com/google/uuid"
+)
+
+var mailStatuses = []string{mailer.StatusPending, mailer.StatusSending, mailer.StatusSent, mailer.StatusFailed}
+
+// Lists the mails in the outbox, newest first. Supports status, email,
+// template, limit & offset, e.g. ?status=failed for the dead letters.
+func AdminListMails(outbox *mailer.Outbox, logger *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		f := mailer.OutboxFilter{
+			Status:   q.Get("status"),
+			Email:    q.Get("email"),
+			Template: q.Get("template"),
+		}
+
+		if f.Status != "" && !slices.Contains(mailStatuses, f.Status) {
+			http.Error(w, "invalid status", http.StatusBadRequest)
+			return
+		}
+
+		var err error
+		f.Limit, f.Offset, err = parseLimitOffset(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		mails, err := outbox.List(r.Context(), f)
+		if err != nil {
+			logger.Error("failed to list mails", "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(map[string]any{
+			"mails":  mails,
+			"limit":  f.Limit,
+			"offset": f.Offset,
+		})
+		if err != nil {
+			http.Error(w, "Failed to encode JSON", http.StatusInternalServerError)
+			logger.Error("failed to encode json", "error", err)
+			return
+		}
+	})
+}
+
+// Returns a single mail of the outbox, including its last error.
+func AdminGetMail(outbox *mailer.Outbox, logger *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if _, err := uuid.Parse(id); err != nil {
+			http.Error(w, "invalid mail id", http.StatusBadRequest)
+			return
+		}
+
+		mail, err := outbox.Get(r.Context(), id)
+		if errors.Is(err, mailer.ErrMailNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			logger.Error("failed to get mail", "error", err, "id", id)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(mail)
+		if err != nil {
+			http.Error(w, "Failed to encode JSON", http.StatusInternalServerError)
+			logger.Error("failed to encode json", "error", err)
+			return
+		}
+	})
+}
+
+// Queues a failed mail again with a fresh set of attempts.
+func AdminRetryMail(db *database.Database, outbox *mailer.Outbox, logger *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if _, err := uuid.Parse(id); err != nil {
+			http.Error(w, "invalid mail id", http.StatusBadRequest)
+			return
+		}
+
+		err := outbox.Retry(r.Context(), id)
+		switch {
+		case errors.Is(err, mailer.ErrMailNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case errors.Is(err, mailer.ErrMailNotFailed):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			logger.Error("failed to retry mail", "error", err, "id", id)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		audit.Record(r.Context(), db, logger, r, audit.Event{
+			ActorId:   adminId(r),
+			EventType: audit.EventAdminMailRetried,
+			Metadata:  map[string]any{"mail_id": id},
+		})
+		logger.Info("admin retried mail", "id", id, "admin_id", adminId(r))
+		w.WriteHeader(200)
+		fmt.Fprintln(w, "mail queued successfully")
+	})
+}
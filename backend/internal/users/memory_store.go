@@ -0,0 +1,146 @@
+package internal
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	rbac "fucku/internal/rbac"
+	token "fucku/internal/tokens"
+
+	"github.com/google/uuid"
+)
+
+// Keeps users in process memory, meant for tests without a database.
+type MemoryUserStore struct {
+	// Handed to transactions, its writes are not rolled back
+	Tokens token.TokenStore
+
+	mu          sync.Mutex
+	txMu        sync.Mutex
+	users       map[string]User
+	permissions map[string]rbac.Permissions
+	roles       map[string][]string
+}
+
+func NewMemoryUserStore(tokens token.TokenStore) *MemoryUserStore {
+	return &MemoryUserStore{
+		Tokens:      tokens,
+		users:       make(map[string]User),
+		permissions: make(map[string]rbac.Permissions),
+		roles:       make(map[string][]string),
+	}
+}
+
+func (s *MemoryUserStore) GetByEmail(ctx context.Context, email string) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, u := range s.users {
+		if u.Email == email {
+			return u, nil
+		}
+	}
+
+	return User{}, ErrUserNotFound
+}
+
+func (s *MemoryUserStore) GetById(ctx context.Context, id string) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[id]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+
+	u.clearPassword()
+	return u, nil
+}
+
+func (s *MemoryUserStore) Create(ctx context.Context, email, username, passwordHash, locale string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, u := range s.users {
+		if u.Email == email {
+			return "", ErrEmailTaken
+		}
+		if u.Username == username {
+			return "", ErrUsernameTaken
+		}
+	}
+
+	now := time.Now()
+	u := User{
+		Id:        uuid.NewString(),
+		Email:     email,
+		Username:  username,
+		Password:  passwordHash,
+		Locale:    locale,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	s.users[u.Id] = u
+
+	return u.Id, nil
+}
+
+func (s *MemoryUserStore) Permissions(ctx context.Context, userId string) (rbac.Permissions, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.permissions[userId], nil
+}
+
+func (s *MemoryUserStore) Roles(ctx context.Context, userId string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return slices.Clone(s.roles[userId]), nil
+}
+
+// Runs transactions one after another and restores the users if fn fails.
+func (s *MemoryUserStore) Transaction(ctx context.Context, fn func(users UserStore, tokens token.TokenStore) error) error {
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+
+	s.mu.Lock()
+	snapshot := maps.Clone(s.users)
+	s.mu.Unlock()
+
+	if err := fn(s, s.Tokens); err != nil {
+		s.mu.Lock()
+		s.users = snapshot
+		s.mu.Unlock()
+		return err
+	}
+
+	return nil
+}
+
+// Replaces a user, e.g. to mark it verified or suspended in a test.
+func (s *MemoryUserStore) Put(u User) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.users[u.Id] = u
+}
+
+// Sets the permissions the user gets through its roles.
+func (s *MemoryUserStore) SetPermissions(userId string, permissions rbac.Permissions) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.permissions[userId] = permissions
+}
+
+// Sets the names of the roles granted to the user.
+func (s *MemoryUserStore) SetRoles(userId string, roles ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.roles[userId] = slices.Sorted(slices.Values(roles))
+}
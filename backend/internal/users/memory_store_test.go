@@ -0,0 +1,274 @@
+package internal_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	token "fucku/internal/tokens"
+	users "fucku/internal/users"
+)
+
+// Runs the handlers against in-memory stores, no database needed
+func TestMemoryRegisterLoginLogout(t *testing.T) {
+	secrets, _ := token.NewCSRFSecrets("test-secret")
+	mts := &token.TokenService{Logger: logger, Store: token.NewMemoryTokenStore(), CSRFSecrets: secrets}
+	store := users.NewMemoryUserStore(mts.Store)
+
+	register := func(body string) int {
+		req := httptest.NewRequest("POST", "http://localhost:3000/register", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		users.RegisterUser(store, logger, mts, mailer).ServeHTTP(w, req)
+		return w.Code
+	}
+
+	login := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "http://localhost:3000/login", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		users.LoginUser(store, logger, mts, nil, mailer).ServeHTTP(w, req)
+		return w
+	}
+
+	if code := register(`{"username":"memuser","email":"mem@example.com","password":"1Secret1"}`); code != http.StatusOK {
+		t.Fatalf("expected status 200 on register, got %d", code)
+	}
+
+	if code := register(`{"username":"memuser2","email":"mem@example.com","password":"1Secret1"}`); code != http.StatusConflict {
+		t.Errorf("expected status 409 for a taken email, got %d", code)
+	}
+
+	if code := register(`{"username":"memuser","email":"mem2@example.com","password":"1Secret1"}`); code != http.StatusConflict {
+		t.Errorf("expected status 409 for a taken username, got %d", code)
+	}
+
+	u, err := store.GetByEmail(context.Background(), "mem@example.com")
+	if err != nil {
+		t.Fatalf("registered user not found: %v", err)
+	}
+
+	if _, err := mts.LatestToken(context.Background(), u.Id, token.TypeEmailVerification); err != nil {
+		t.Errorf("expected a verification token, got: %v", err)
+	}
+
+	if w := login(`{"email":"mem@example.com","password":"1Wrong11"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for a wrong password, got %d", w.Code)
+	}
+
+	w := login(`{"email":"mem@example.com","password":"1Secret1"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 on login, got %d", w.Code)
+	}
+
+	var sessionCookie *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "session_token" {
+			sessionCookie = c
+		}
+	}
+	if sessionCookie == nil {
+		t.Fatal("expected a session cookie")
+	}
+
+	session, err := mts.GetToken(context.Background(), token.TypeSession, sessionCookie.Value)
+	if err != nil {
+		t.Fatalf("session not stored: %v", err)
+	}
+
+	u.Password = ""
+	ctx := context.WithValue(context.Background(), users.UserContextKey("user"), u)
+	ctx = context.WithValue(ctx, users.UserContextKey("session"), *session)
+	req := httptest.NewRequest("POST", "http://localhost:3000/logout", nil).WithContext(ctx)
+	w = httptest.NewRecorder()
+	users.LogoutUser(logger, mts).ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 on logout, got %d", w.Code)
+	}
+
+	if _, err := mts.GetToken(context.Background(), token.TypeSession, sessionCookie.Value); !errors.Is(err, token.ErrTokenNotFound) {
+		t.Errorf("expected the session to be revoked, got: %v", err)
+	}
+}
+
+func TestMemoryBearerLogin(t *testing.T) {
+	mts := &token.TokenService{Logger: logger, Store: token.NewMemoryTokenStore()}
+	store := users.NewMemoryUserStore(mts.Store)
+
+	body := `{"username":"bearer","email":"bearer@example.com","password":"1Secret1"}`
+	req := httptest.NewRequest("POST", "http://localhost:3000/register", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	users.RegisterUser(store, logger, mts, mailer).ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 on register, got %d", w.Code)
+	}
+
+	type tokenResponse struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		TokenType    string `json:"token_type"`
+	}
+
+	body = `{"email":"bearer@example.com","password":"1Secret1"}`
+	req = httptest.NewRequest("POST", "http://localhost:3000/login?mode=token", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	users.LoginUser(store, logger, mts, nil, mailer).ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 on login, got %d", w.Code)
+	}
+	if len(w.Result().Cookies()) != 0 {
+		t.Errorf("expected no cookies for a bearer login")
+	}
+
+	var login tokenResponse
+	if err := json.NewDecoder(w.Body).Decode(&login); err != nil || login.AccessToken == "" || login.RefreshToken == "" || login.TokenType != "Bearer" {
+		t.Fatalf("expected a token pair, got: %+v (%v)", login, err)
+	}
+
+	refresh := func(value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "http://localhost:3000/token/refresh", bytes.NewBufferString(`{"refresh_token":"`+value+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		users.RefreshBearerToken(logger, mts).ServeHTTP(w, req)
+		return w
+	}
+
+	w = refresh(login.RefreshToken)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 on refresh, got %d", w.Code)
+	}
+	var refreshed tokenResponse
+	if err := json.NewDecoder(w.Body).Decode(&refreshed); err != nil || refreshed.RefreshToken == login.RefreshToken {
+		t.Fatalf("expected a rotated refresh token, got: %+v (%v)", refreshed, err)
+	}
+
+	// The access token of the login still works until it expires
+	access, err := mts.GetToken(context.Background(), token.TypeAccess, refreshed.AccessToken)
+	if err != nil {
+		t.Fatalf("refreshed access token not stored: %v", err)
+	}
+
+	// Replaying the first refresh token revokes everything of the login
+	if w := refresh(login.RefreshToken); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401 for a reused refresh token, got %d", w.Code)
+	}
+	if w := refresh(refreshed.RefreshToken); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected the rotated refresh token to be revoked, got %d", w.Code)
+	}
+	if _, err := mts.GetToken(context.Background(), token.TypeAccess, access.Token); !errors.Is(err, token.ErrTokenNotFound) {
+		t.Errorf("expected the access token to be revoked, got: %v", err)
+	}
+	if sessions, _ := mts.ListSessions(context.Background(), access.UserId); len(sessions) != 0 {
+		t.Errorf("expected the session to be revoked, got: %+v", sessions)
+	}
+}
+
+func TestMemoryRefreshAfterSuspendAndLogout(t *testing.T) {
+	mts := &token.TokenService{Logger: logger, Store: token.NewMemoryTokenStore()}
+	store := users.NewMemoryUserStore(mts.Store)
+	mts.UserActive = users.UserActive(store)
+
+	body := `{"username":"refresh","email":"refresh@example.com","password":"1Secret1"}`
+	req := httptest.NewRequest("POST", "http://localhost:3000/register", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	users.RegisterUser(store, logger, mts, mailer).ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 on register, got %d", w.Code)
+	}
+
+	login := func() string {
+		req := httptest.NewRequest("POST", "http://localhost:3000/login?mode=token", bytes.NewBufferString(`{"email":"refresh@example.com","password":"1Secret1"}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		users.LoginUser(store, logger, mts, nil, mailer).ServeHTTP(w, req)
+
+		var res struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&res); err != nil || res.RefreshToken == "" {
+			t.Fatalf("expected a token pair, got status %d (%v)", w.Code, err)
+		}
+		return res.RefreshToken
+	}
+
+	refresh := func(value string) int {
+		req := httptest.NewRequest("POST", "http://localhost:3000/token/refresh", bytes.NewBufferString(`{"refresh_token":"`+value+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		users.RefreshBearerToken(logger, mts).ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Suspended while the refresh token is still around
+	suspended := login()
+	u, err := store.GetByEmail(context.Background(), "refresh@example.com")
+	if err != nil {
+		t.Fatalf("registered user not found: %v", err)
+	}
+	now := time.Now()
+	u.SuspendedAt = &now
+	store.Put(u)
+
+	if code := refresh(suspended); code != http.StatusUnauthorized {
+		t.Errorf("expected status 401 refreshing as a suspended user, got %d", code)
+	}
+
+	u.SuspendedAt = nil
+	store.Put(u)
+
+	// Logged out, but the refresh token outlived its session
+	loggedOut := login()
+	stored, err := mts.Store.Find(context.Background(), token.TypeRefresh, loggedOut)
+	if err != nil {
+		t.Fatalf("refresh token not stored: %v", err)
+	}
+	if err := mts.Store.Delete(context.Background(), stored.SessionId); err != nil {
+		t.Fatalf("failed to delete session: %v", err)
+	}
+
+	if code := refresh(loggedOut); code != http.StatusUnauthorized {
+		t.Errorf("expected status 401 refreshing a logged out session, got %d", code)
+	}
+
+	if code := refresh(login()); code != http.StatusOK {
+		t.Errorf("expected status 200 refreshing an active login, got %d", code)
+	}
+}
+
+// Fails every insert, like a database error while creating a token
+type failingTokenStore struct {
+	*token.MemoryTokenStore
+}
+
+func (failingTokenStore) Insert(ctx context.Context, p token.TokenParams) (*token.Token, error) {
+	return nil, errors.New("insert failed")
+}
+
+func TestRegisterRollsBackWithoutToken(t *testing.T) {
+	tokens := failingTokenStore{token.NewMemoryTokenStore()}
+	mts := &token.TokenService{Logger: logger, Store: tokens}
+	store := users.NewMemoryUserStore(tokens)
+
+	body := `{"username":"rollback","email":"rollback@example.com","password":"1Secret1"}`
+	req := httptest.NewRequest("POST", "http://localhost:3000/register", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	users.RegisterUser(store, logger, mts, mailer).ServeHTTP(w, req)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected status 500, got %d", w.Code)
+	}
+
+	if _, err := store.GetByEmail(context.Background(), "rollback@example.com"); !errors.Is(err, users.ErrUserNotFound) {
+		t.Errorf("expected the user to be rolled back, got: %v", err)
+	}
+}
@@ -0,0 +1,457 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	audit "fucku/internal/audit"
+	database "fucku/internal/database"
+	lockout "fucku/internal/lockout"
+	mailer "fucku/internal/mailer"
+	mfa "fucku/internal/mfa"
+	token "fucku/internal/tokens"
+	utils "fucku/internal/utils"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Number of recovery codes handed out when 2FA is enabled
+const recoveryCodeCount = 10
+
+type totpCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type disableTOTPRequest struct {
+	Password     string `json:"password"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type loginMFARequest struct {
+	MFAToken     string `json:"mfa_token"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// Generates a new TOTP secret for the logged in user.
+// 2FA stays disabled until the secret is confirmed with a first code.
+func SetupTOTP(db *database.Database, logger *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := GetUserFromContext(r.Context())
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			logger.Error("failed to set up totp (failed to read user from context)")
+			return
+		}
+
+		ctx, cancel := db.Timeout(r.Context())
+		defer cancel()
+
+		var enabled bool
+		row := db.DBPool.QueryRow(ctx, `SELECT totp_enabled FROM users WHERE id = $1`, user.Id)
+		if err := row.Scan(&enabled); err != nil {
+			logger.Error("failed to read totp state", "error", err, "user_id", user.Id)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if enabled {
+			http.Error(w, "two-factor authentication is already enabled", http.StatusConflict)
+			return
+		}
+
+		secret, err := mfa.GenerateSecret()
+		if err != nil {
+			logger.Error("failed to generate totp secret", "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		_, err = db.DBPool.Exec(ctx,
+			`UPDATE users SET totp_secret = $1, totp_last_step = 0, updated_at = CURRENT_TIMESTAMP WHERE id = $2`,
+			secret, user.Id)
+		if err != nil {
+			logger.Error("failed to store totp secret", "error", err, "user_id", user.Id)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(map[string]any{
+			"secret": secret,
+			"uri":    mfa.TOTPURI(os.Getenv("APP_NAME"), user.Email, secret),
+		})
+		if err != nil {
+			http.Error(w, "Failed to encode JSON", http.StatusInternalServerError)
+			logger.Error("failed to encode json", "error", err)
+			return
+		}
+	})
+}
+
+// Enables 2FA once the user proves their authenticator works
+// and returns a fresh set of recovery codes.
+func ConfirmTOTP(db *database.Database, logger *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := GetUserFromContext(r.Context())
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			logger.Error("failed to confirm totp (failed to read user from context)")
+			return
+		}
+
+		var cr totpCodeRequest
+		err := utils.DecodeJSONBody(w, r, &cr)
+		if err != nil {
+			var mr *utils.MalformedRequest
+			if errors.As(err, &mr) {
+				http.Error(w, mr.Msg, mr.Status)
+				return
+			} else {
+				logger.Error("error while decoding json body in confirm totp", "error", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		ctx, cancel := db.Timeout(r.Context())
+		defer cancel()
+
+		var secret string
+		var enabled bool
+		row := db.DBPool.QueryRow(ctx, `SELECT totp_secret, totp_enabled FROM users WHERE id = $1`, user.Id)
+		if err := row.Scan(&secret, &enabled); err != nil {
+			logger.Error("failed to read totp state", "error", err, "user_id", user.Id)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if enabled {
+			http.Error(w, "two-factor authentication is already enabled", http.StatusConflict)
+			return
+		}
+
+		if secret == "" {
+			http.Error(w, "two-factor setup has not been started", http.StatusBadRequest)
+			return
+		}
+
+		step, valid := mfa.ValidateCode(secret, cr.Code, time.Now())
+		if !valid {
+			http.Error(w, "invalid code", http.StatusBadRequest)
+			return
+		}
+
+		codes, err := mfa.GenerateRecoveryCodes(recoveryCodeCount)
+		if err != nil {
+			logger.Error("failed to generate recovery codes", "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		// Together, so 2FA is never on without the codes that were shown to the user
+		err = db.WithTx(r.Context(), func(tx pgx.Tx) error {
+			if err := replaceRecoveryCodes(r.Context(), tx, user.Id, codes); err != nil {
+				return err
+			}
+
+			_, err := tx.Exec(r.Context(),
+				`UPDATE users SET totp_enabled = true, totp_last_step = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2`,
+				step, user.Id)
+			return err
+		})
+		if err != nil {
+			logger.Error("failed to enable totp", "error", err, "user_id", user.Id)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		audit.Record(r.Context(), db, logger, r, audit.Event{ActorId: user.Id, UserId: user.Id, EventType: audit.EventTOTPEnabled})
+		logger.Info("enabled two-factor authentication", "user_id", user.Id)
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(map[string]any{"recovery_codes": codes})
+		if err != nil {
+			http.Error(w, "Failed to encode JSON", http.StatusInternalServerError)
+			logger.Error("failed to encode json", "error", err)
+			return
+		}
+	})
+}
+
+// Disables 2FA. Requires the password and a current TOTP or recovery code.
+func DisableTOTP(db *database.Database, logger *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := GetUserFromContext(r.Context())
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			logger.Error("failed to disable totp (failed to read user from context)")
+			return
+		}
+
+		var dr disableTOTPRequest
+		err := utils.DecodeJSONBody(w, r, &dr)
+		if err != nil {
+			var mr *utils.MalformedRequest
+			if errors.As(err, &mr) {
+				http.Error(w, mr.Msg, mr.Status)
+				return
+			} else {
+				logger.Error("error while decoding json body in disable totp", "error", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if err := checkPassword(r.Context(), db, user.Id, dr.Password); err != nil {
+			if errors.Is(err, errWrongPassword) {
+				http.Error(w, "password is incorrect", http.StatusBadRequest)
+				return
+			}
+			logger.Error("failed to check password", "error", err, "user_id", user.Id)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		valid, err := checkSecondFactor(r.Context(), db, user.Id, dr.Code, dr.RecoveryCode)
+		if err != nil {
+			logger.Error("failed to check second factor", "error", err, "user_id", user.Id)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if !valid {
+			audit.Record(r.Context(), db, logger, r, audit.Event{
+				ActorId:   user.Id,
+				UserId:    user.Id,
+				EventType: audit.EventTOTPDisabled,
+				Outcome:   audit.OutcomeFailure,
+				Metadata:  map[string]any{"reason": "invalid_code"},
+			})
+			http.Error(w, "invalid code", http.StatusBadRequest)
+			return
+		}
+
+		err = db.WithTx(r.Context(), func(tx pgx.Tx) error {
+			_, err := tx.Exec(r.Context(), `
+				UPDATE users SET totp_enabled = false, totp_secret = '', totp_last_step = 0, updated_at = CURRENT_TIMESTAMP
+				WHERE id = $1`, user.Id)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.Exec(r.Context(), `DELETE FROM recovery_codes WHERE user_id = $1`, user.Id)
+			return err
+		})
+		if err != nil {
+			logger.Error("failed to disable totp", "error", err, "user_id", user.Id)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		audit.Record(r.Context(), db, logger, r, audit.Event{ActorId: user.Id, UserId: user.Id, EventType: audit.EventTOTPDisabled})
+		logger.Info("disabled two-factor authentication", "user_id", user.Id)
+		w.WriteHeader(200)
+		fmt.Fprintln(w, "two-factor authentication disabled")
+	})
+}
+
+// Second step of the login for users with 2FA enabled.
+// Exchanges the mfa_token from /login plus a TOTP or recovery code for a session.
+// Wrong codes count as failed logins of the account, and the mfa_token is
+// used up after token.MaxMFAAttempts of them.
+func LoginMFA(db *database.Database, logger *slog.Logger, ts *token.TokenService, guard *lockout.Guard, mailer *mailer.Mailer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var lr loginMFARequest
+		err := utils.DecodeJSONBody(w, r, &lr)
+		if err != nil {
+			var mr *utils.MalformedRequest
+			if errors.As(err, &mr) {
+				http.Error(w, mr.Msg, mr.Status)
+				return
+			} else {
+				logger.Error("error while decoding json body in login mfa", "error", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		pending, err := ts.GetToken(r.Context(), token.TypeMFAPending, lr.MFAToken)
+		if err != nil {
+			if errors.Is(err, token.ErrTokenNotFound) || errors.Is(err, token.ErrTokenExpired) {
+				http.Error(w, "login expired, please log in again", http.StatusUnauthorized)
+				return
+			}
+			logger.Error("failed to read mfa pending token", "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		ctx, cancel := db.Timeout(r.Context())
+		defer cancel()
+
+		var u User
+		row := db.DBPool.QueryRow(ctx,
+			`SELECT id, username, email, verified, locale, created_at, updated_at, suspended_at FROM users WHERE id = $1`, pending.UserId)
+		if err = row.Scan(&u.Id, &u.Username, &u.Email, &u.Verified, &u.Locale, &u.CreatedAt, &u.UpdatedAt, &u.SuspendedAt); err != nil {
+			logger.Error("failed to parse userdata into struct", "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		// Same limits as the password, the failures add up across both steps
+		wait, locked, err := guard.Check(r.Context(), u.Email, utils.ClientIP(r))
+		if err != nil {
+			logger.Error("failed to check login attempts", "error", err, "user_id", u.Id)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			if locked {
+				http.Error(w, "too many failed logins, try again later", http.StatusTooManyRequests)
+			} else {
+				http.Error(w, "please wait before trying again", http.StatusTooManyRequests)
+			}
+			return
+		}
+
+		attemptsLeft, err := ts.CountMFAAttempt(r.Context(), pending)
+		if err != nil {
+			if errors.Is(err, token.ErrTokenNotFound) {
+				http.Error(w, "login expired, please log in again", http.StatusUnauthorized)
+				return
+			}
+			logger.Error("failed to count mfa attempt", "error", err, "user_id", u.Id)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		valid, err := checkSecondFactor(r.Context(), db, u.Id, lr.Code, lr.RecoveryCode)
+		if err != nil {
+			logger.Error("failed to check second factor", "error", err, "user_id", u.Id)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if !valid {
+			audit.Record(r.Context(), db, logger, r, audit.Event{
+				UserId:    u.Id,
+				EventType: audit.EventLogin,
+				Outcome:   audit.OutcomeFailure,
+				Metadata:  map[string]any{"reason": "invalid_second_factor"},
+			})
+			loginFailed(r, logger, ts, guard, mailer, &u, u.Email)
+
+			if attemptsLeft == 0 {
+				if err = ts.DeleteToken(r.Context(), pending.Id); err != nil {
+					logger.Error("failed to delete mfa pending token", "error", err, "user_id", u.Id)
+				}
+				http.Error(w, "too many invalid codes, please log in again", http.StatusUnauthorized)
+				return
+			}
+			http.Error(w, "invalid code", http.StatusUnauthorized)
+			return
+		}
+
+		// The pending token is single use
+		if err = ts.DeleteToken(r.Context(), pending.Id); err != nil {
+			logger.Error("failed to delete mfa pending token", "error", err, "user_id", u.Id)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if err = guard.Reset(r.Context(), u.Email); err != nil {
+			logger.Error("failed to reset login attempts", "error", err, "user_id", u.Id)
+		}
+
+		if u.SuspendedAt != nil {
+			http.Error(w, "account suspended", http.StatusForbidden)
+			return
+		}
+
+		method := "totp"
+		if lr.Code == "" {
+			method = "recovery_code"
+		}
+		startSession(w, r, logger, ts, mailer, u, method, pending.Payload == token.PayloadRememberMe)
+	})
+}
+
+// Checks a TOTP code, or a recovery code if no TOTP code is given.
+// Accepted codes are consumed so they can't be replayed.
+func checkSecondFactor(ctx context.Context, db *database.Database, userId, code, recoveryCode string) (bool, error) {
+	ctx, cancel := db.Timeout(ctx)
+	defer cancel()
+
+	if code != "" {
+		var secret string
+		var enabled bool
+		row := db.DBPool.QueryRow(ctx, `SELECT totp_secret, totp_enabled FROM users WHERE id = $1`, userId)
+		if err := row.Scan(&secret, &enabled); err != nil {
+			return false, err
+		}
+
+		if !enabled {
+			return false, nil
+		}
+
+		step, valid := mfa.ValidateCode(secret, code, time.Now())
+		if !valid {
+			return false, nil
+		}
+
+		// Only accept each time step once
+		tag, err := db.DBPool.Exec(ctx,
+			`UPDATE users SET totp_last_step = $1 WHERE id = $2 AND totp_last_step < $1`, step, userId)
+		if err != nil {
+			return false, err
+		}
+
+		return tag.RowsAffected() == 1, nil
+	}
+
+	if recoveryCode != "" {
+		tag, err := db.DBPool.Exec(ctx, `
+			UPDATE recovery_codes SET used_at = CURRENT_TIMESTAMP
+			WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`,
+			userId, mfa.HashRecoveryCode(recoveryCode))
+		if err != nil {
+			return false, err
+		}
+
+		return tag.RowsAffected() == 1, nil
+	}
+
+	return false, nil
+}
+
+// Replaces all recovery codes of a user with the given ones.
+// Meant to run in a transaction, see database.WithTx.
+func replaceRecoveryCodes(ctx context.Context, q database.Querier, userId string, codes []string) error {
+	_, err := q.Exec(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userId)
+	if err != nil {
+		return err
+	}
+
+	for _, code := range codes {
+		_, err = q.Exec(ctx,
+			`INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)`,
+			userId, mfa.HashRecoveryCode(code))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,485 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	audit "fucku/internal/audit"
+	database "fucku/internal/database"
+	lockout "fucku/internal/lockout"
+	mailer "fucku/internal/mailer"
+	passkeys "fucku/internal/passkeys"
+	token "fucku/internal/tokens"
+	utils "fucku/internal/utils"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+type finishPasskeyRegistrationRequest struct {
+	Name       string          `json:"name"`
+	Credential json.RawMessage `json:"credential"`
+}
+
+// The email is accepted for older clients but unused, the authenticator
+// tells whose passkey it is
+type beginPasskeyLoginRequest struct {
+	Email string `json:"email"`
+}
+
+type finishPasskeyLoginRequest struct {
+	ChallengeId string          `json:"challenge_id"`
+	Credential  json.RawMessage `json:"credential"`
+	RememberMe  bool            `json:"remember_me"`
+}
+
+type renamePasskeyRequest struct {
+	Name string `json:"name"`
+}
+
+var (
+	// Returned for user handles that don't belong to an account
+	errUnknownPasskey = errors.New("passkey of an unknown user")
+	// Returned while the lockout guard makes the account or client wait
+	errLoginBlocked = errors.New("login blocked by the lockout guard")
+)
+
+// Longest name a passkey may get, in bytes
+const maxPasskeyNameLength = 64
+
+// Starts registering a new passkey for the logged in user.
+func BeginPasskeyRegistration(db *database.Database, logger *slog.Logger, ts *token.TokenService, wa *webauthn.WebAuthn) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := GetUserFromContext(r.Context())
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			logger.Error("failed to begin passkey registration (failed to read user from context)")
+			return
+		}
+
+		credentials, err := passkeys.LoadCredentials(r.Context(), db, user.Id)
+		if err != nil {
+			logger.Error("failed to load passkeys", "error", err, "user_id", user.Id)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		pu := &passkeys.User{Id: user.Id, Username: user.Username, Email: user.Email, Credentials: credentials}
+		creation, sessionData, err := passkeys.BeginRegistration(wa, pu)
+		if err != nil {
+			logger.Error("failed to begin passkey registration", "error", err, "user_id", user.Id)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		_, err = ts.NewChallengeToken(r.Context(), user.Id, token.TypeWebAuthnRegistration, sessionData)
+		if err != nil {
+			logger.Error("failed to store passkey registration challenge", "error", err, "user_id", user.Id)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(creation)
+		if err != nil {
+			http.Error(w, "Failed to encode JSON", http.StatusInternalServerError)
+			logger.Error("failed to encode json", "error", err)
+			return
+		}
+	})
+}
+
+// Verifies the authenticators response and stores the new passkey.
+func FinishPasskeyRegistration(db *database.Database, logger *slog.Logger, ts *token.TokenService, wa *webauthn.WebAuthn) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := GetUserFromContext(r.Context())
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			logger.Error("failed to finish passkey registration (failed to read user from context)")
+			return
+		}
+
+		var fr finishPasskeyRegistrationRequest
+		err := utils.DecodeJSONBody(w, r, &fr)
+		if err != nil {
+			var mr *utils.MalformedRequest
+			if errors.As(err, &mr) {
+				http.Error(w, mr.Msg, mr.Status)
+				return
+			} else {
+				logger.Error("error while decoding json body in finish passkey registration", "error", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		// Checked before the challenge is used up, so the client can retry
+		name := strings.TrimSpace(fr.Name)
+		if name == "" {
+			name = "Passkey"
+		}
+		if len(name) > maxPasskeyNameLength {
+			http.Error(w, "name must be at most 64 characters", http.StatusBadRequest)
+			return
+		}
+
+		challenge, err := ts.LatestToken(r.Context(), user.Id, token.TypeWebAuthnRegistration)
+		if err != nil {
+			if errors.Is(err, token.ErrTokenNotFound) {
+				http.Error(w, "no passkey registration in progress", http.StatusBadRequest)
+				return
+			}
+			logger.Error("failed to read passkey registration challenge", "error", err, "user_id", user.Id)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		// Challenges are single use, even if the ceremony fails
+		if err = ts.RevokeTokens(r.Context(), user.Id, token.TypeWebAuthnRegistration); err != nil {
+			logger.Error("failed to delete passkey registration challenge", "error", err, "user_id", user.Id)
+		}
+
+		credentials, err := passkeys.LoadCredentials(r.Context(), db, user.Id)
+		if err != nil {
+			logger.Error("failed to load passkeys", "error", err, "user_id", user.Id)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		pu := &passkeys.User{Id: user.Id, Username: user.Username, Email: user.Email, Credentials: credentials}
+		credential, err := passkeys.FinishRegistration(wa, pu, challenge.Payload, fr.Credential)
+		if err != nil {
+			logger.Warn("passkey registration failed", "error", err, "user_id", user.Id)
+			http.Error(w, "passkey registration failed", http.StatusBadRequest)
+			return
+		}
+
+		passkey, err := passkeys.SaveCredential(r.Context(), db, user.Id, name, credential)
+		if err != nil {
+			logger.Error("failed to store passkey", "error", err, "user_id", user.Id)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		audit.Record(r.Context(), db, logger, r, audit.Event{
+			ActorId:   user.Id,
+			UserId:    user.Id,
+			EventType: audit.EventPasskeyRegistered,
+			Metadata:  map[string]any{"passkey_id": passkey.Id, "name": passkey.Name},
+		})
+		logger.Info("registered passkey", "user_id", user.Id)
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(map[string]any{"passkey": passkey})
+		if err != nil {
+			http.Error(w, "Failed to encode JSON", http.StatusInternalServerError)
+			logger.Error("failed to encode json", "error", err)
+			return
+		}
+	})
+}
+
+// Lists the passkeys of the logged in user.
+func ListPasskeys(db *database.Database, logger *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := GetUserFromContext(r.Context())
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			logger.Error("failed to list passkeys (failed to read user from context)")
+			return
+		}
+
+		list, err := passkeys.ListPasskeys(r.Context(), db, user.Id)
+		if err != nil {
+			logger.Error("failed to list passkeys", "error", err, "user_id", user.Id)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(map[string]any{"passkeys": list})
+		if err != nil {
+			http.Error(w, "Failed to encode JSON", http.StatusInternalServerError)
+			logger.Error("failed to encode json", "error", err)
+			return
+		}
+	})
+}
+
+// Renames a passkey of the logged in user.
+func RenamePasskey(db *database.Database, logger *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := GetUserFromContext(r.Context())
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			logger.Error("failed to rename passkey (failed to read user from context)")
+			return
+		}
+
+		var rr renamePasskeyRequest
+		err := utils.DecodeJSONBody(w, r, &rr)
+		if err != nil {
+			var mr *utils.MalformedRequest
+			if errors.As(err, &mr) {
+				http.Error(w, mr.Msg, mr.Status)
+				return
+			} else {
+				logger.Error("error while decoding json body in rename passkey", "error", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		name := strings.TrimSpace(rr.Name)
+		if name == "" || len(name) > maxPasskeyNameLength {
+			http.Error(w, "name must be between 1 and 64 characters", http.StatusBadRequest)
+			return
+		}
+
+		id := r.PathValue("id")
+		if _, err := uuid.Parse(id); err != nil {
+			http.Error(w, "passkey not found", http.StatusNotFound)
+			return
+		}
+
+		found, err := passkeys.RenamePasskey(r.Context(), db, user.Id, id, name)
+		if err != nil {
+			logger.Error("failed to rename passkey", "error", err, "user_id", user.Id)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if !found {
+			http.Error(w, "passkey not found", http.StatusNotFound)
+			return
+		}
+
+		audit.Record(r.Context(), db, logger, r, audit.Event{
+			ActorId:   user.Id,
+			UserId:    user.Id,
+			EventType: audit.EventPasskeyRenamed,
+			Metadata:  map[string]any{"passkey_id": id, "name": name},
+		})
+		w.WriteHeader(200)
+		fmt.Fprintln(w, "passkey renamed successfully")
+	})
+}
+
+// Removes a passkey of the logged in user.
+func DeletePasskey(db *database.Database, logger *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := GetUserFromContext(r.Context())
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			logger.Error("failed to delete passkey (failed to read user from context)")
+			return
+		}
+
+		id := r.PathValue("id")
+		if _, err := uuid.Parse(id); err != nil {
+			http.Error(w, "passkey not found", http.StatusNotFound)
+			return
+		}
+
+		found, err := passkeys.DeletePasskey(r.Context(), db, user.Id, id)
+		if err != nil {
+			logger.Error("failed to delete passkey", "error", err, "user_id", user.Id)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if !found {
+			http.Error(w, "passkey not found", http.StatusNotFound)
+			return
+		}
+
+		audit.Record(r.Context(), db, logger, r, audit.Event{
+			ActorId:   user.Id,
+			UserId:    user.Id,
+			EventType: audit.EventPasskeyDeleted,
+			Metadata:  map[string]any{"passkey_id": id},
+		})
+		logger.Info("deleted passkey", "user_id", user.Id)
+		w.WriteHeader(200)
+		fmt.Fprintln(w, "passkey deleted successfully")
+	})
+}
+
+// Starts a passwordless login. The challenge is the same for every account,
+// so it doesn't tell which emails have passkeys.
+func BeginPasskeyLogin(logger *slog.Logger, ts *token.TokenService, wa *webauthn.WebAuthn) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var br beginPasskeyLoginRequest
+		err := utils.DecodeJSONBody(w, r, &br)
+		if err != nil {
+			var mr *utils.MalformedRequest
+			if errors.As(err, &mr) {
+				http.Error(w, mr.Msg, mr.Status)
+				return
+			} else {
+				logger.Error("error while decoding json body in begin passkey login", "error", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		assertion, sessionData, err := passkeys.BeginLogin(wa)
+		if err != nil {
+			logger.Error("failed to begin passkey login", "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		challenge, err := ts.NewChallengeToken(r.Context(), token.NoUserId, token.TypeWebAuthnLogin, sessionData)
+		if err != nil {
+			logger.Error("failed to store passkey login challenge", "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(map[string]any{
+			"challenge_id": challenge.Token,
+			"options":      assertion,
+		})
+		if err != nil {
+			http.Error(w, "Failed to encode JSON", http.StatusInternalServerError)
+			logger.Error("failed to encode json", "error", err)
+			return
+		}
+	})
+}
+
+// Verifies the passkey assertion and starts a session like /login does.
+func FinishPasskeyLogin(db *database.Database, logger *slog.Logger, ts *token.TokenService, wa *webauthn.WebAuthn, guard *lockout.Guard, mailer *mailer.Mailer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var fr finishPasskeyLoginRequest
+		err := utils.DecodeJSONBody(w, r, &fr)
+		if err != nil {
+			var mr *utils.MalformedRequest
+			if errors.As(err, &mr) {
+				http.Error(w, mr.Msg, mr.Status)
+				return
+			} else {
+				logger.Error("error while decoding json body in finish passkey login", "error", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		// Used up right away, so one assertion can't start two sessions
+		challenge, err := ts.ConsumeToken(r.Context(), token.TypeWebAuthnLogin, fr.ChallengeId)
+		if err != nil {
+			if errors.Is(err, token.ErrTokenNotFound) || errors.Is(err, token.ErrTokenExpired) {
+				http.Error(w, "login expired, please try again", http.StatusUnauthorized)
+				return
+			}
+			logger.Error("failed to read passkey login challenge", "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		// The user handle of the passkey is the user id. Once it is known, the
+		// same limits as /login apply, checked before the signature like the
+		// password there
+		var u User
+		var loadErr error
+		var wait time.Duration
+		var locked bool
+		pu, credential, err := passkeys.FinishLogin(wa, challenge.Payload, fr.Credential, func(userId string) (*passkeys.User, error) {
+			if _, err := uuid.Parse(userId); err != nil {
+				return nil, errUnknownPasskey
+			}
+
+			ctx, cancel := db.Timeout(r.Context())
+			defer cancel()
+
+			row := db.DBPool.QueryRow(ctx,
+				`SELECT id, username, email, verified, locale, created_at, updated_at, suspended_at FROM users WHERE id = $1`, userId)
+			if err := row.Scan(&u.Id, &u.Username, &u.Email, &u.Verified, &u.Locale, &u.CreatedAt, &u.UpdatedAt, &u.SuspendedAt); err != nil {
+				if errors.Is(err, pgx.ErrNoRows) {
+					return nil, errUnknownPasskey
+				}
+				loadErr = err
+				return nil, err
+			}
+
+			wait, locked, err = guard.Check(r.Context(), u.Email, utils.ClientIP(r))
+			if err != nil {
+				loadErr = err
+				return nil, err
+			}
+			if wait > 0 {
+				return nil, errLoginBlocked
+			}
+
+			credentials, err := passkeys.LoadCredentials(r.Context(), db, u.Id)
+			if err != nil {
+				loadErr = err
+				return nil, err
+			}
+
+			return &passkeys.User{Id: u.Id, Username: u.Username, Email: u.Email, Credentials: credentials}, nil
+		})
+		if loadErr != nil {
+			logger.Error("failed to load user for passkey login", "error", loadErr)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			if locked {
+				http.Error(w, "too many failed logins, try again later", http.StatusTooManyRequests)
+			} else {
+				http.Error(w, "please wait before trying again", http.StatusTooManyRequests)
+			}
+			return
+		}
+
+		if err != nil {
+			logger.Warn("passkey login failed", "error", err, "user_id", u.Id)
+			if u.Id != "" {
+				audit.Record(r.Context(), db, logger, r, audit.Event{
+					UserId:    u.Id,
+					EventType: audit.EventLogin,
+					Outcome:   audit.OutcomeFailure,
+					Metadata:  map[string]any{"reason": "invalid_passkey"},
+				})
+				loginFailed(r, logger, ts, guard, mailer, &u, u.Email)
+			}
+			http.Error(w, "passkey login failed", http.StatusUnauthorized)
+			return
+		}
+
+		if err = passkeys.UpdateCredential(r.Context(), db, pu.Id, credential); err != nil {
+			logger.Error("failed to update passkey after login", "error", err, "user_id", u.Id)
+		}
+
+		if u.SuspendedAt != nil {
+			audit.Record(r.Context(), db, logger, r, audit.Event{
+				UserId:    u.Id,
+				EventType: audit.EventLogin,
+				Outcome:   audit.OutcomeFailure,
+				Metadata:  map[string]any{"reason": "suspended"},
+			})
+			http.Error(w, "account suspended", http.StatusForbidden)
+			return
+		}
+
+		if err = guard.Reset(r.Context(), u.Email); err != nil {
+			logger.Error("failed to reset login attempts", "error", err, "email", u.Email)
+		}
+
+		// No TOTP step, the passkey verified the user itself, see passkeys.BeginLogin
+		startSession(w, r, logger, ts, mailer, u, "passkey", fr.RememberMe)
+	})
+}
@@ -0,0 +1,191 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	audit "fucku/internal/audit"
+	database "fucku/internal/database"
+	mailer "fucku/internal/mailer"
+	token "fucku/internal/tokens"
+	utils "fucku/internal/utils"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Minimum time between two reset mails for the same user. Requests in
+// between get the usual answer, a 429 would tell the account exists.
+const passwordResetCooldown = time.Minute
+
+type forgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+type resetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// Mails a password reset code to the user.
+// Always answers the same way so it can't be used to probe for accounts.
+func ForgotPassword(db *database.Database, logger *slog.Logger, ts *token.TokenService, mailer *mailer.Mailer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var fr forgotPasswordRequest
+
+		err := utils.DecodeJSONBody(w, r, &fr)
+		if err != nil {
+			var mr *utils.MalformedRequest
+			if errors.As(err, &mr) {
+				http.Error(w, mr.Msg, mr.Status)
+				return
+			} else {
+				logger.Error("error while decoding json body in forgot password", "error", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		const genericResponse = "if an account with this email exists, a reset code has been sent"
+
+		ctx, cancel := db.Timeout(r.Context())
+		defer cancel()
+
+		var userId, username, locale string
+		row := db.DBPool.QueryRow(ctx, `SELECT id, username, locale FROM users WHERE email = $1`, fr.Email)
+		if err := row.Scan(&userId, &username, &locale); err != nil {
+			if !errors.Is(err, pgx.ErrNoRows) {
+				logger.Error("failed to read user during forgot password", "error", err)
+			}
+
+			w.WriteHeader(200)
+			fmt.Fprintln(w, genericResponse)
+			return
+		}
+
+		latest, err := ts.LatestToken(r.Context(), userId, token.TypePasswordReset)
+		if err != nil && !errors.Is(err, token.ErrTokenNotFound) {
+			logger.Error("failed to read latest password reset token", "error", err, "user_id", userId)
+			w.WriteHeader(200)
+			fmt.Fprintln(w, genericResponse)
+			return
+		}
+
+		if latest != nil && time.Now().UTC().Sub(latest.CreatedAt) < passwordResetCooldown {
+			logger.Info("password reset requested again too soon", "user_id", userId)
+			w.WriteHeader(200)
+			fmt.Fprintln(w, genericResponse)
+			return
+		}
+
+		resetToken, err := ts.NewPasswordResetToken(r.Context(), userId)
+		if err != nil {
+			logger.Error("failed to create password reset token", "error", err, "user_id", userId)
+		} else {
+			if err := mailer.SendPasswordResetMail(r.Context(), username, fr.Email, locale, resetToken.Token); err != nil {
+				logger.Error("failed to queue password reset mail", "error", err, "email", fr.Email)
+			}
+			audit.Record(r.Context(), db, logger, r, audit.Event{UserId: userId, EventType: audit.EventPasswordResetRequest})
+			logger.Info("password reset requested", "user_id", userId)
+		}
+
+		w.WriteHeader(200)
+		fmt.Fprintln(w, genericResponse)
+	})
+}
+
+// Sets a new password using a reset code.
+// On success every session & CSRF token of the user is revoked.
+func ResetPassword(db *database.Database, logger *slog.Logger, ts *token.TokenService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var rr resetPasswordRequest
+
+		err := utils.DecodeJSONBody(w, r, &rr)
+		if err != nil {
+			var mr *utils.MalformedRequest
+			if errors.As(err, &mr) {
+				http.Error(w, mr.Msg, mr.Status)
+				return
+			} else {
+				logger.Error("error while decoding json body in reset password", "error", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if rr.Token == "" {
+			http.Error(w, "reset token is required", http.StatusBadRequest)
+			return
+		}
+
+		// Apply the same rules as during registration
+		uu := NewUnregisteredUser()
+		uu.Password = rr.Password
+		uu.validateWhitespace()
+		uu.validatePassword()
+
+		if !uu.Valid {
+			http.Error(w, strings.Join(uu.Reasons, "\n"), http.StatusBadRequest)
+			return
+		}
+
+		// Used up right away, so a code can't set two passwords at once
+		resetToken, err := ts.ConsumeToken(r.Context(), token.TypePasswordReset, rr.Token)
+		if err != nil {
+			switch {
+			case errors.Is(err, token.ErrTokenNotFound), errors.Is(err, token.ErrTokenExpired):
+				var userId string
+				if resetToken != nil {
+					userId = resetToken.UserId
+				}
+				audit.Record(r.Context(), db, logger, r, audit.Event{
+					UserId:    userId,
+					EventType: audit.EventPasswordReset,
+					Outcome:   audit.OutcomeFailure,
+					Metadata:  map[string]any{"reason": err.Error()},
+				})
+				http.Error(w, "invalid or expired reset token", http.StatusBadRequest)
+			default:
+				logger.Error("failed to read password reset token", "error", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		uu.hashPassword()
+		if !uu.Valid {
+			logger.Warn("failed to hash password", "user_id", resetToken.UserId)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		ctx, cancel := db.Timeout(r.Context())
+		defer cancel()
+
+		_, err = db.DBPool.Exec(ctx,
+			`UPDATE users SET password = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2`,
+			uu.Password, resetToken.UserId)
+		if err != nil {
+			logger.Error("failed to update password", "error", err, "user_id", resetToken.UserId)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		// Log out everywhere & drop any other reset token
+		err = ts.RevokeTokens(r.Context(), resetToken.UserId, slices.Concat(token.SessionTypes, []string{token.TypePasswordReset})...)
+		if err != nil {
+			logger.Error("failed to revoke tokens after password reset", "error", err, "user_id", resetToken.UserId)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		audit.Record(r.Context(), db, logger, r, audit.Event{UserId: resetToken.UserId, EventType: audit.EventPasswordReset})
+		logger.Info("password reset", "user_id", resetToken.UserId)
+		w.WriteHeader(200)
+		fmt.Fprintln(w, "password reset successfully")
+	})
+}
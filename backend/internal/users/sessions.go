@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	token "fucku/internal/tokens"
+
+	"github.com/google/uuid"
+)
+
+// Lists the active sessions (devices) of the logged in user.
+func ListSessions(logger *slog.Logger, ts *token.TokenService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := GetUserFromContext(r.Context())
+		current, sessionOk := GetSessionFromContext(r.Context())
+		if !ok || !sessionOk {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			logger.Error("failed to list sessions (failed to read user from context)")
+			return
+		}
+
+		sessions, err := ts.ListSessions(r.Context(), user.Id)
+		if err != nil {
+			logger.Error("failed to list sessions", "error", err, "user_id", user.Id)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		for i := range sessions {
+			sessions[i].Current = sessions[i].Id == sessionId(current)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(map[string]any{"sessions": sessions})
+		if err != nil {
+			http.Error(w, "Failed to encode JSON", http.StatusInternalServerError)
+			logger.Error("failed to encode json", "error", err)
+			return
+		}
+	})
+}
+
+// Revokes one session of the logged in user by its id.
+func RevokeSession(logger *slog.Logger, ts *token.TokenService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := GetUserFromContext(r.Context())
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			logger.Error("failed to revoke session (failed to read user from context)")
+			return
+		}
+
+		sessionId := r.PathValue("id")
+		if _, err := uuid.Parse(sessionId); err != nil {
+			http.Error(w, "session not found", http.StatusNotFound)
+			return
+		}
+
+		found, err := ts.RevokeSession(r.Context(), user.Id, sessionId)
+		if err != nil {
+			logger.Error("failed to revoke session", "error", err, "user_id", user.Id)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if !found {
+			http.Error(w, "session not found", http.StatusNotFound)
+			return
+		}
+
+		logger.Info("revoked session", "user_id", user.Id, "session_id", sessionId)
+		w.WriteHeader(200)
+		fmt.Fprintln(w, "session revoked successfully")
+	})
+}
+
+// Revokes every session of the logged in user except the current one.
+func RevokeOtherSessions(logger *slog.Logger, ts *token.TokenService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := GetUserFromContext(r.Context())
+		session, sessionOk := GetSessionFromContext(r.Context())
+		if !ok || !sessionOk {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			logger.Error("failed to revoke sessions (failed to read user from context)")
+			return
+		}
+
+		if err := ts.RevokeOtherSessions(r.Context(), user.Id, sessionId(session)); err != nil {
+			logger.Error("failed to revoke other sessions", "error", err, "user_id", user.Id)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		logger.Info("revoked other sessions", "user_id", user.Id)
+		w.WriteHeader(200)
+		fmt.Fprintln(w, "other sessions revoked successfully")
+	})
+}
+
+// Returns the id of the session a request was authenticated with. Bearer
+// requests carry an access token, which belongs to a session.
+func sessionId(t token.Token) string {
+	if t.TokenType == token.TypeSession {
+		return t.Id
+	}
+
+	return t.SessionId
+}
@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"context"
+	"errors"
+
+	database "fucku/internal/database"
+	rbac "fucku/internal/rbac"
+	token "fucku/internal/tokens"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	ErrEmailTaken    = errors.New("email already taken")
+	ErrUsernameTaken = errors.New("username already taken")
+)
+
+// Persists users for the registration, login & auth handlers.
+// Lookups return ErrUserNotFound if there is no such user.
+type UserStore interface {
+	// Includes the password hash & whether TOTP is enabled
+	GetByEmail(ctx context.Context, email string) (User, error)
+	// Without the password hash
+	GetById(ctx context.Context, id string) (User, error)
+	// Inserts a user and returns its id. The password has to be hashed already.
+	// Returns ErrEmailTaken or ErrUsernameTaken if either is in use.
+	Create(ctx context.Context, email, username, passwordHash, locale string) (string, error)
+	Permissions(ctx context.Context, userId string) (rbac.Permissions, error)
+	// Names of the roles granted to the user, sorted
+	Roles(ctx context.Context, userId string) ([]string, error)
+	// Runs fn with stores that write in one transaction, so nothing fn
+	// wrote is kept if it returns an error. fn may run more than once.
+	Transaction(ctx context.Context, fn func(users UserStore, tokens token.TokenStore) error) error
+}
+
+// Keeps users in the users table
+type PostgresUserStore struct {
+	DB     *database.Database
+	Tokens *token.PostgresTokenStore
+	// Set on the stores passed into Transaction
+	tx pgx.Tx
+}
+
+func NewPostgresUserStore(db *database.Database) *PostgresUserStore {
+	return &PostgresUserStore{
+		DB:     db,
+		Tokens: token.NewPostgresTokenStore(db),
+	}
+}
+
+func (s *PostgresUserStore) conn() database.Querier {
+	if s.tx != nil {
+		return s.tx
+	}
+
+	return s.DB.DBPool
+}
+
+func (s *PostgresUserStore) GetByEmail(ctx context.Context, email string) (User, error) {
+	ctx, cancel := s.DB.Timeout(ctx)
+	defer cancel()
+
+	var u User
+	row := s.conn().QueryRow(ctx, `
+		SELECT id, email, username, verified, locale, password, totp_enabled, created_at, updated_at, suspended_at
+		FROM users WHERE email = $1 LIMIT 1`, email)
+	if err := row.Scan(
+		&u.Id,
+		&u.Email,
+		&u.Username,
+		&u.Verified,
+		&u.Locale,
+		&u.Password,
+		&u.TOTPEnabled,
+		&u.CreatedAt,
+		&u.UpdatedAt,
+		&u.SuspendedAt,
+	); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return User{}, ErrUserNotFound
+		}
+		return User{}, err
+	}
+
+	return u, nil
+}
+
+func (s *PostgresUserStore) GetById(ctx context.Context, id string) (User, error) {
+	ctx, cancel := s.DB.Timeout(ctx)
+	defer cancel()
+
+	var u User
+	row := s.conn().QueryRow(ctx, `
+		SELECT id, email, username, verified, locale, created_at, updated_at, suspended_at
+		FROM users WHERE id = $1`, id)
+	if err := row.Scan(&u.Id, &u.Email, &u.Username, &u.Verified, &u.Locale, &u.CreatedAt, &u.UpdatedAt, &u.SuspendedAt); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return User{}, ErrUserNotFound
+		}
+		return User{}, err
+	}
+
+	return u, nil
+}
+
+func (s *PostgresUserStore) Create(ctx context.Context, email, username, passwordHash, locale string) (string, error) {
+	ctx, cancel := s.DB.Timeout(ctx)
+	defer cancel()
+
+	var id string
+	row := s.conn().QueryRow(ctx,
+		`INSERT INTO users (email, username, password, locale) VALUES ($1, $2, $3, $4) RETURNING id`,
+		email, username, passwordHash, locale)
+	if err := row.Scan(&id); err != nil {
+		if constraint, ok := database.UniqueViolation(err); ok {
+			switch constraint {
+			case "users_email_key":
+				return "", ErrEmailTaken
+			case "users_username_key":
+				return "", ErrUsernameTaken
+			}
+		}
+		return "", err
+	}
+
+	return id, nil
+}
+
+func (s *PostgresUserStore) Permissions(ctx context.Context, userId string) (rbac.Permissions, error) {
+	return rbac.LoadPermissions(ctx, s.DB, userId)
+}
+
+func (s *PostgresUserStore) Roles(ctx context.Context, userId string) ([]string, error) {
+	return rbac.UserRoles(ctx, s.DB, userId)
+}
+
+func (s *PostgresUserStore) Transaction(ctx context.Context, fn func(users UserStore, tokens token.TokenStore) error) error {
+	return s.DB.WithTx(ctx, func(tx pgx.Tx) error {
+		tokens := s.Tokens.WithTx(tx)
+		return fn(&PostgresUserStore{DB: s.DB, Tokens: tokens, tx: tx}, tokens)
+	})
+}
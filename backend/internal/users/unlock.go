@@ -0,0 +1,132 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"mime"
+	"net/http"
+
+	audit "fucku/internal/audit"
+	database "fucku/internal/database"
+	lockout "fucku/internal/lockout"
+	token "fucku/internal/tokens"
+	utils "fucku/internal/utils"
+)
+
+type unlockAccountRequest struct {
+	Token string `json:"token"`
+}
+
+// Lifts a login lock using the token from the account locked mail.
+// Accepts a JSON body or the form of UnlockAccountPage.
+func UnlockAccount(store UserStore, db *database.Database, logger *slog.Logger, ts *token.TokenService, guard *lockout.Guard) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ur unlockAccountRequest
+
+		if isFormPost(r) {
+			ur.Token = r.PostFormValue("token")
+		} else {
+			err := utils.DecodeJSONBody(w, r, &ur)
+			if err != nil {
+				var mr *utils.MalformedRequest
+				if errors.As(err, &mr) {
+					http.Error(w, mr.Msg, mr.Status)
+					return
+				} else {
+					logger.Error("error while decoding json body in unlock account", "error", err)
+					http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+					return
+				}
+			}
+		}
+
+		if ur.Token == "" {
+			http.Error(w, "unlock token is required", http.StatusBadRequest)
+			return
+		}
+
+		unlockToken, err := ts.GetToken(r.Context(), token.TypeAccountUnlock, ur.Token)
+		if err != nil {
+			switch {
+			case errors.Is(err, token.ErrTokenNotFound), errors.Is(err, token.ErrTokenExpired):
+				http.Error(w, "invalid or expired unlock token", http.StatusBadRequest)
+			default:
+				logger.Error("failed to read account unlock token", "error", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		u, err := store.GetById(r.Context(), unlockToken.UserId)
+		if err != nil {
+			logger.Error("failed to load user to unlock", "error", err, "user_id", unlockToken.UserId)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if err = guard.Reset(r.Context(), u.Email); err != nil {
+			logger.Error("failed to unlock account", "error", err, "user_id", u.Id)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if err = ts.DeleteToken(r.Context(), unlockToken.Id); err != nil {
+			logger.Error("failed to delete account unlock token", "error", err, "user_id", u.Id)
+		}
+
+		audit.Record(r.Context(), db, logger, r, audit.Event{ActorId: u.Id, UserId: u.Id, EventType: audit.EventAccountUnlocked})
+		logger.Info("unlocked account", "user_id", u.Id)
+		w.WriteHeader(200)
+		fmt.Fprintln(w, "account unlocked successfully")
+	})
+}
+
+var unlockPage = template.Must(template.New("unlock").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Unlock account</title></head>
+<body>
+<form method="post" action="unlock">
+<input type="hidden" name="token" value="{{.}}">
+<button type="submit">Unlock my account</button>
+</form>
+</body>
+</html>
+`))
+
+// Target of the link in the account locked mail. Only checks the token and
+// asks to confirm, the unlock itself is a POST to UnlockAccount, so link
+// scanners & prefetching mail clients can't use up the token.
+func UnlockAccountPage(logger *slog.Logger, ts *token.TokenService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value := r.URL.Query().Get("token")
+		if value == "" {
+			http.Error(w, "unlock token is required", http.StatusBadRequest)
+			return
+		}
+
+		_, err := ts.GetToken(r.Context(), token.TypeAccountUnlock, value)
+		if err != nil {
+			switch {
+			case errors.Is(err, token.ErrTokenNotFound), errors.Is(err, token.ErrTokenExpired):
+				http.Error(w, "invalid or expired unlock token", http.StatusBadRequest)
+			default:
+				logger.Error("failed to read account unlock token", "error", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(200)
+		if err = unlockPage.Execute(w, value); err != nil {
+			logger.Error("failed to render unlock page", "error", err)
+		}
+	})
+}
+
+func isFormPost(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "application/x-www-form-urlencoded"
+}
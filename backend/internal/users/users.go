@@ -6,26 +6,31 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"math"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
-	database "fucku/internal/database"
+	audit "fucku/internal/audit"
+	lockout "fucku/internal/lockout"
 	mailer "fucku/internal/mailer"
 	token "fucku/internal/tokens"
 	utils "fucku/internal/utils"
 
 	"github.com/alexedwards/argon2id"
-	"github.com/jackc/pgx/v5"
 )
 
 type UnregisteredUser struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
 	Email    string `json:"email"`
-	Valid    bool
-	Reasons  []string
+	Locale   string `json:"locale"`
+	// Only read on login, asks for a persistent session
+	RememberMe bool `json:"remember_me"`
+	Valid      bool
+	Reasons    []string
 }
 
 func NewUnregisteredUser() UnregisteredUser {
@@ -109,8 +114,13 @@ type User struct {
 	Username  string    `json:"username"`
 	Verified  int       `json:"verified"`
 	Password  string    `json:"password,omitempty"`
+	Locale    string    `json:"locale"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
+	// Set while an admin has suspended the account
+	SuspendedAt *time.Time `json:"suspended_at,omitempty"`
+	// Only loaded where the login needs it, see UserStore.GetByEmail
+	TOTPEnabled bool `json:"-"`
 }
 
 func (u *User) clearPassword() {
@@ -126,7 +136,14 @@ func GetUserFromContext(ctx context.Context) (User, bool) {
 	return u, ok
 }
 
-func RegisterUser(db *database.Database, logger *slog.Logger, ts *token.TokenService, mailer *mailer.Mailer) http.Handler {
+// Gets the session token the current request was authenticated with.
+// Only id, user id, type & expiry are set.
+func GetSessionFromContext(ctx context.Context) (token.Token, bool) {
+	t, ok := ctx.Value(UserContextKey("session")).(token.Token)
+	return t, ok
+}
+
+func RegisterUser(store UserStore, logger *slog.Logger, ts *token.TokenService, mailer *mailer.Mailer) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		uu := NewUnregisteredUser()
 
@@ -150,32 +167,15 @@ func RegisterUser(db *database.Database, logger *slog.Logger, ts *token.TokenSer
 		uu.validatePassword()
 		uu.validateEmail()
 
-		// Check for unique email
-		emailCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-		defer cancel()
-
-		var email string
-		emailRow := db.DBPool.QueryRow(emailCtx, `SELECT email FROM users WHERE email = $1`, uu.Email)
-
-		if err := emailRow.Scan(&email); err != nil {
-			if err != pgx.ErrNoRows {
-				logger.Error("failed to parse email during registration", "error", err)
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-				return
-			}
-		}
-
-		if email != "" {
-			http.Error(w, "email already taken", http.StatusBadRequest)
-			return
-		}
-
 		if !uu.Valid {
 			logger.Warn("registration input validation failed", "reasons", uu.Reasons, "email", uu.Email)
 			http.Error(w, strings.Join(uu.Reasons, "\n"), http.StatusBadRequest)
 			return
 		}
 
+		// Mails go out in the requested language or the one of the browser
+		uu.Locale = mailer.Locale(uu.Locale, r.Header.Get("Accept-Language"))
+
 		// Hash password
 		uu.hashPassword()
 		if !uu.Valid {
@@ -184,38 +184,58 @@ func RegisterUser(db *database.Database, logger *slog.Logger, ts *token.TokenSer
 			return
 		}
 
-		// Insert user
-		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-		defer cancel()
-
+		// Insert the user together with its verification token, so a failure
+		// can't leave behind an account that can never be verified.
+		// Uniqueness is left to the constraints, checking first would be racy.
 		var id string
-		row := db.DBPool.QueryRow(ctx,
-			`INSERT INTO users (email, username, password) VALUES ($1, $2, $3) RETURNING id`,
-			uu.Email, uu.Username, uu.Password)
-		if err = row.Scan(&id); err != nil {
-			logger.Error("error while inserting user", "error", err, "username", uu.Username)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-			return
-		}
+		var verification *token.Token
+		err = store.Transaction(r.Context(), func(users UserStore, tokens token.TokenStore) error {
+			var err error
+			id, err = users.Create(r.Context(), uu.Email, uu.Username, uu.Password, uu.Locale)
+			if err != nil {
+				return err
+			}
 
-		// Generate verification token
-		token, err := ts.NewVerificationToken(id)
+			verification, err = ts.WithStore(tokens).NewVerificationToken(r.Context(), id)
+			return err
+		})
 		if err != nil {
-			logger.Error("error while creating verification token", "error", err, "username", uu.Username)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			reason := ""
+			switch {
+			case errors.Is(err, ErrEmailTaken):
+				reason = "email_taken"
+			case errors.Is(err, ErrUsernameTaken):
+				reason = "username_taken"
+			default:
+				logger.Error("error while registering user", "error", err, "username", uu.Username)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+
+			audit.Record(r.Context(), ts.DB, logger, r, audit.Event{
+				EventType: audit.EventRegister,
+				Outcome:   audit.OutcomeFailure,
+				Metadata:  map[string]any{"reason": reason, "email": uu.Email, "username": uu.Username},
+			})
+			http.Error(w, err.Error(), http.StatusConflict)
 			return
 		}
 
-		logger.Debug("created verification token", "token", token.Token, "user_id", id)
+		logger.Debug("created verification token", "token", verification.Token, "user_id", id)
+		audit.Record(r.Context(), ts.DB, logger, r, audit.Event{ActorId: id, UserId: id, EventType: audit.EventRegister})
 
-		go mailer.SendRegistrationMail(uu.Username, uu.Email, token.Token)
+		if err := mailer.SendRegistrationMail(r.Context(), uu.Username, uu.Email, uu.Locale, verification.Token); err != nil {
+			logger.Error("failed to queue verification mail", "error", err, "email", uu.Email)
+		}
 
 		w.WriteHeader(200)
 		fmt.Fprintln(w, "User registered successfully")
 	})
 }
 
-func LoginUser(db *database.Database, logger *slog.Logger, ts *token.TokenService) http.Handler {
+// Logs a user in with email & password. Failed attempts are tracked per
+// account & IP, repeated failures are slowed down and eventually locked.
+func LoginUser(store UserStore, logger *slog.Logger, ts *token.TokenService, guard *lockout.Guard, mailer *mailer.Mailer) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// 1. validate password
 		uu := NewUnregisteredUser()
@@ -243,22 +263,38 @@ func LoginUser(db *database.Database, logger *slog.Logger, ts *token.TokenServic
 			return
 		}
 
-		var u User
-		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-		defer cancel()
-		row := db.DBPool.QueryRow(ctx, `
-            SELECT id, email, username, verified, password, created_at, updated_at
-            FROM users WHERE email = $1 LIMIT 1;
-            `, uu.Email)
-		if err := row.Scan(
-			&u.Id,
-			&u.Email,
-			&u.Username,
-			&u.Verified,
-			&u.Password,
-			&u.CreatedAt,
-			&u.UpdatedAt,
-		); err != nil {
+		// Refuse before hashing anything if the client has to wait
+		ip := utils.ClientIP(r)
+		wait, locked, err := guard.Check(r.Context(), uu.Email, ip)
+		if err != nil {
+			logger.Error("failed to check login attempts", "error", err, "email", uu.Email)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			if locked {
+				http.Error(w, "too many failed logins, try again later", http.StatusTooManyRequests)
+			} else {
+				http.Error(w, "please wait before trying again", http.StatusTooManyRequests)
+			}
+			return
+		}
+
+		u, err := store.GetByEmail(r.Context(), uu.Email)
+		if err != nil {
+			if errors.Is(err, ErrUserNotFound) {
+				// Unknown email, answer like a wrong password
+				audit.Record(r.Context(), ts.DB, logger, r, audit.Event{
+					EventType: audit.EventLogin,
+					Outcome:   audit.OutcomeFailure,
+					Metadata:  map[string]any{"reason": "unknown_email", "email": uu.Email},
+				})
+				loginFailed(r, logger, ts, guard, mailer, nil, uu.Email)
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
 			logger.Error("error while parsing user from db during login", "error", err)
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
@@ -267,86 +303,291 @@ func LoginUser(db *database.Database, logger *slog.Logger, ts *token.TokenServic
 		match, err := argon2id.ComparePasswordAndHash(uu.Password, u.Password)
 		if !match || err != nil {
 			// Invalid password
+			audit.Record(r.Context(), ts.DB, logger, r, audit.Event{
+				UserId:    u.Id,
+				EventType: audit.EventLogin,
+				Outcome:   audit.OutcomeFailure,
+				Metadata:  map[string]any{"reason": "wrong_password"},
+			})
+			loginFailed(r, logger, ts, guard, mailer, &u, uu.Email)
 			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 			return
 		}
 
-		// 2. revoke & create session
-		token, err := ts.NewSessionToken(u.Id)
+		// Clear sensitive data
+		u.clearPassword()
+
+		if u.SuspendedAt != nil {
+			audit.Record(r.Context(), ts.DB, logger, r, audit.Event{
+				UserId:    u.Id,
+				EventType: audit.EventLogin,
+				Outcome:   audit.OutcomeFailure,
+				Metadata:  map[string]any{"reason": "suspended"},
+			})
+			http.Error(w, "account suspended", http.StatusForbidden)
+			return
+		}
+
+		// 2. ask for the second factor if enabled
+		if u.TOTPEnabled {
+			pending, err := ts.NewMFAPendingToken(r.Context(), u.Id, uu.RememberMe)
+			if err != nil {
+				logger.Error("failed to create mfa pending token", "error", err, "email", u.Email)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			err = json.NewEncoder(w).Encode(map[string]any{
+				"mfa_required": true,
+				"mfa_token":    pending.Token,
+			})
+			if err != nil {
+				http.Error(w, "Failed to encode JSON", http.StatusInternalServerError)
+				logger.Error("failed to encode json", "error", err)
+			}
+			return
+		}
+
+		// Users with 2FA are reset once the second factor is right, see LoginMFA
+		if err = guard.Reset(r.Context(), uu.Email); err != nil {
+			logger.Error("failed to reset login attempts", "error", err, "email", uu.Email)
+		}
+
+		// 3. create session for this device
+		startSession(w, r, logger, ts, mailer, u, "password", uu.RememberMe)
+	})
+}
+
+// Counts a failed login. If it locked the account, its owner (u, nil for
+// unknown emails) gets an unlock link. Every lock ends up in the audit log.
+func loginFailed(r *http.Request, logger *slog.Logger, ts *token.TokenService, guard *lockout.Guard, mailer *mailer.Mailer, u *User, email string) {
+	failure, err := guard.RecordFailure(r.Context(), email, utils.ClientIP(r))
+	if err != nil {
+		logger.Error("failed to record failed login", "error", err, "email", email)
+		return
+	}
+
+	if failure.IPLocked {
+		audit.Record(r.Context(), ts.DB, logger, r, audit.Event{
+			EventType: audit.EventLoginLocked,
+			Metadata:  map[string]any{"scope": "ip", "until": time.Now().UTC().Add(guard.Config.LockoutDuration)},
+		})
+	}
+
+	if !failure.AccountLocked {
+		return
+	}
+
+	event := audit.Event{
+		EventType: audit.EventLoginLocked,
+		Metadata:  map[string]any{"scope": "account", "email": email, "until": time.Now().UTC().Add(guard.Config.LockoutDuration)},
+	}
+	if u != nil {
+		event.UserId = u.Id
+	}
+	audit.Record(r.Context(), ts.DB, logger, r, event)
+
+	if u == nil {
+		return
+	}
+
+	unlockToken, err := ts.NewAccountUnlockToken(r.Context(), u.Id, guard.Config.LockoutDuration)
+	if err != nil {
+		logger.Error("failed to create account unlock token", "error", err, "user_id", u.Id)
+		return
+	}
+
+	if err := mailer.SendAccountLockedMail(r.Context(), u.Username, u.Email, u.Locale, unlockToken.Token); err != nil {
+		logger.Error("failed to queue account locked mail", "error", err, "email", u.Email)
+	}
+}
+
+// Creates a session & csrf token for the user, sets both cookies
+// and writes the user as JSON response. Logins asking for bearer tokens
+// (see wantsBearerTokens) get an access & refresh token in the response
+// instead of cookies. method names the way the user authenticated for the
+// audit log, persistent is set for "remember me". Logins from a device
+// without an active session are reported to the user by mail.
+func startSession(w http.ResponseWriter, r *http.Request, logger *slog.Logger, ts *token.TokenService, mailer *mailer.Mailer, u User, method string, persistent bool) {
+	newDevice, err := isNewDevice(r, ts, u.Id)
+	if err != nil {
+		logger.Error("failed to list sessions", "error", err, "email", u.Email)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	resData := make(map[string]any)
+	resData["user"] = u
+
+	var session *token.Token
+	bearer := wantsBearerTokens(r)
+	if bearer {
+		tokens, err := ts.NewBearerTokens(r.Context(), u.Id, r.UserAgent(), utils.ClientIP(r))
+		if err != nil {
+			logger.Error("failed to create bearer tokens", "error", err, "email", u.Email)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		session = tokens.Access
+		addBearerFields(resData, tokens)
+		w.Header().Set("Cache-Control", "no-store")
+	} else {
+		session, err = ts.NewSessionToken(r.Context(), u.Id, r.UserAgent(), utils.ClientIP(r), persistent)
 		if err != nil {
 			logger.Error("failed to create session token", "error", err, "email", u.Email)
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
 
-		csrfToken, err := ts.NewCSRFToken(u.Id)
+		csrfToken, err := ts.NewCSRFToken(r.Context(), session)
 		if err != nil {
 			logger.Error("failed to create csrf token", "error", err, "email", u.Email)
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
 
-		resData := make(map[string]any)
+		SetSessionCookies(w, session.Token, csrfToken.Token, session.Persistent, session.ExpiresAt)
+	}
 
-		// Clear sensitive data
-		u.clearPassword()
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(resData)
+	if err != nil {
+		http.Error(w, "Failed to encode JSON", http.StatusInternalServerError)
+		logger.Error("failed to encode json", "error", err)
+		return
+	}
 
-		resData["user"] = u
-
-		http.SetCookie(w, &http.Cookie{
-			Name:     "session_token",
-			Value:    token.Token,
-			Path:     "/",
-			HttpOnly: true,
-			// Enable in production
-			// Secure: true,
-			SameSite: http.SameSiteStrictMode,
-			Expires:  token.ExpiresAt,
-		})
+	audit.Record(r.Context(), ts.DB, logger, r, audit.Event{
+		ActorId:   u.Id,
+		UserId:    u.Id,
+		EventType: audit.EventLogin,
+		Metadata:  map[string]any{"method": method, "session_id": sessionId(*session), "bearer": bearer},
+	})
+	logger.Info("logged in", "email", u.Email)
 
-		http.SetCookie(w, &http.Cookie{
-			Name:     "csrf_token",
-			Value:    csrfToken.Token,
-			Path:     "/",
-			HttpOnly: false,
-			// Enable in production
-			// Secure: true,
-			SameSite: http.SameSiteStrictMode,
-			Expires:  csrfToken.ExpiresAt,
-		})
+	if newDevice {
+		if err := mailer.SendNewLoginMail(r.Context(), u.Username, u.Email, u.Locale, r.UserAgent(), utils.ClientIP(r), session.CreatedAt); err != nil {
+			logger.Error("failed to queue new login mail", "error", err, "email", u.Email)
+		}
+	}
+}
+
+// Reports whether none of the users active sessions was started with the
+// user agent of r. Good enough to spot new devices without fingerprinting.
+func isNewDevice(r *http.Request, ts *token.TokenService, userId string) (bool, error) {
+	sessions, err := ts.ListSessions(r.Context(), userId)
+	if err != nil {
+		return false, err
+	}
+
+	for _, s := range sessions {
+		if s.UserAgent == r.UserAgent() {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// Sets the session & csrf cookies, the latter only if csrfValue isn't empty.
+// Cookies of persistent sessions expire with the session, the others are
+// dropped by the browser when it closes.
+func SetSessionCookies(w http.ResponseWriter, sessionValue, csrfValue string, persistent bool, expiresAt time.Time) {
+	var expires time.Time
+	if persistent {
+		expires = expiresAt
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "session_token",
+		Value:    sessionValue,
+		Path:     "/",
+		HttpOnly: true,
+		// Enable in production
+		// Secure: true,
+		SameSite: http.SameSiteStrictMode,
+		Expires:  expires,
+	})
+
+	if csrfValue == "" {
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "csrf_token",
+		Value:    csrfValue,
+		Path:     "/",
+		HttpOnly: false,
+		// Enable in production
+		// Secure: true,
+		SameSite: http.SameSiteStrictMode,
+		Expires:  expires,
+	})
+}
+
+// Reports how long the current session is valid, both until it expires
+// without activity and at the latest. For bearer requests that is how long
+// the access token is valid.
+func AuthStatus(sessions token.SessionConfig, logger *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, ok := GetSessionFromContext(r.Context())
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			logger.Error("failed to read session from context")
+			return
+		}
+
+		now := time.Now().UTC()
+		resData := map[string]any{
+			"persistent": session.Persistent,
+			"expires_at": session.ExpiresAt,
+			"expires_in": int(session.ExpiresAt.Sub(now).Seconds()),
+		}
+
+		// Access tokens only last until they are refreshed
+		if session.TokenType == token.TypeSession {
+			lifetimeEnd := sessions.LifetimeEnd(session.CreatedAt, session.Persistent)
+			resData["lifetime_expires_at"] = lifetimeEnd
+			resData["lifetime_expires_in"] = int(lifetimeEnd.Sub(now).Seconds())
+		}
 
 		w.Header().Set("Content-Type", "application/json")
-		err = json.NewEncoder(w).Encode(resData)
+		err := json.NewEncoder(w).Encode(resData)
 		if err != nil {
 			http.Error(w, "Failed to encode JSON", http.StatusInternalServerError)
 			logger.Error("failed to encode json", "error", err)
 			return
 		}
-
-		logger.Info("logged in", "email", u.Email)
 	})
 }
 
-// Clears a users session & csrf tokens.
-func LogoutUser(db *database.Database, logger *slog.Logger, ts *token.TokenService) http.Handler {
+// Clears the current session & its csrf token.
+// Other devices of the user stay logged in.
+func LogoutUser(logger *slog.Logger, ts *token.TokenService) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user, ok := GetUserFromContext(r.Context())
-		if !ok {
+		session, sessionOk := GetSessionFromContext(r.Context())
+		if !ok || !sessionOk {
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			logger.Error("failed to log out user (failed to read user from context)", "request", r)
 			return
 		}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-		defer cancel()
-
-		_, err := db.DBPool.Exec(ctx, `DELETE FROM tokens WHERE user_id = $1 AND token_type = 'csrf' OR token_type = 'session'`, user.Id)
+		_, err := ts.RevokeSession(r.Context(), user.Id, sessionId(session))
 		if err != nil {
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			logger.Error("failed to log out user", "error", err)
 			return
 		}
 
+		audit.Record(r.Context(), ts.DB, logger, r, audit.Event{
+			ActorId:   user.Id,
+			UserId:    user.Id,
+			EventType: audit.EventLogout,
+			Metadata:  map[string]any{"session_id": sessionId(session)},
+		})
 		logger.Info("logged out", "email", user.Email)
 		w.WriteHeader(200)
 		fmt.Fprintln(w, "user logged out successfully")
@@ -6,24 +6,31 @@ import (
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"slices"
 	"testing"
 	"time"
 
+	audit "fucku/internal/audit"
 	config "fucku/internal/config"
 	database "fucku/internal/database"
+	lockout "fucku/internal/lockout"
 	mail "fucku/internal/mailer"
+	rbac "fucku/internal/rbac"
 	token "fucku/internal/tokens"
 	users "fucku/internal/users"
 	"fucku/pkg"
 )
 
 var (
-	db     *database.Database
-	logger *slog.Logger
-	ts     *token.TokenService
-	mailer *mail.Mailer
-	conf   *config.AppConfig
+	db        *database.Database
+	userStore *users.PostgresUserStore
+	logger    *slog.Logger
+	ts        *token.TokenService
+	mailer    *mail.Mailer
+	conf      *config.AppConfig
+	guard     *lockout.Guard
 )
 
 func TestMain(m *testing.M) {
@@ -39,8 +46,21 @@ func TestMain(m *testing.M) {
 	}
 
 	ts = token.NewTokenService(logger, db)
+	ts.CSRFSecrets, _ = token.NewCSRFSecrets("test-secret")
+	userStore = users.NewPostgresUserStore(db)
 	conf = config.NewAppConfig(logger, db)
-	mailer = mail.NewMailer(logger, conf)
+	// Without a database the outbox sends right away
+	outbox := mail.NewOutbox(logger, nil, mail.NewLogTransport(logger), mail.DefaultOutboxConfig())
+	mailer, err = mail.NewMailer(logger, conf, outbox, mail.Address{Email: "noreply@example.com"})
+	if err != nil {
+		logger.Error("failed to set up mailer", "error", err)
+		return
+	}
+
+	// No backoff, so tests can fail logins back to back
+	guardConfig := lockout.DefaultConfig()
+	guardConfig.BaseDelay = 0
+	guard = lockout.NewGuard(logger, db, guardConfig)
 
 	code := m.Run()
 
@@ -54,7 +74,7 @@ func TestRegisterUserSuccess(t *testing.T) {
 	req.Header.Set("Content-Type", "application/json")
 	w := httptest.NewRecorder()
 
-	users.RegisterUser(db, logger, ts, mailer).ServeHTTP(w, req)
+	users.RegisterUser(userStore, logger, ts, mailer).ServeHTTP(w, req)
 
 	if w.Code != http.StatusOK {
 		t.Errorf("expected status 200, got %d", w.Code)
@@ -83,7 +103,7 @@ func TestRegisterUserPasswordTooShort(t *testing.T) {
 	req.Header.Set("Content-Type", "application/json")
 	w := httptest.NewRecorder()
 
-	users.RegisterUser(db, logger, ts, mailer).ServeHTTP(w, req)
+	users.RegisterUser(userStore, logger, ts, mailer).ServeHTTP(w, req)
 
 	if w.Code != http.StatusBadRequest {
 		t.Errorf("expected status 400, got %d", w.Code)
@@ -96,7 +116,7 @@ func TestRegisterUserIllegalCharacter(t *testing.T) {
 	req.Header.Set("Content-Type", "application/json")
 	w := httptest.NewRecorder()
 
-	users.RegisterUser(db, logger, ts, mailer).ServeHTTP(w, req)
+	users.RegisterUser(userStore, logger, ts, mailer).ServeHTTP(w, req)
 
 	if w.Code != http.StatusBadRequest {
 		t.Errorf("expected status 400, got %d", w.Code)
@@ -109,7 +129,7 @@ func TestLoginUserSuccess(t *testing.T) {
 	registerReq := httptest.NewRequest("POST", "http://localhost:3000/login", bytes.NewBufferString(body))
 	registerReq.Header.Set("Content-Type", "application/json")
 	registerWriter := httptest.NewRecorder()
-	users.RegisterUser(db, logger, ts, mailer).ServeHTTP(registerWriter, registerReq)
+	users.RegisterUser(userStore, logger, ts, mailer).ServeHTTP(registerWriter, registerReq)
 
 	if registerWriter.Code != http.StatusOK {
 		t.Errorf("expected status 200, got %d", registerWriter.Code)
@@ -120,7 +140,7 @@ func TestLoginUserSuccess(t *testing.T) {
 	req.Header.Set("Content-Type", "application/json")
 	w := httptest.NewRecorder()
 
-	users.LoginUser(db, logger, ts).ServeHTTP(w, req)
+	users.LoginUser(userStore, logger, ts, guard, mailer).ServeHTTP(w, req)
 
 	if w.Code != http.StatusOK {
 		t.Errorf("expected status 200, got %d", w.Code)
@@ -136,3 +156,368 @@ func TestLoginUserSuccess(t *testing.T) {
 
 	t.Logf("%+v", w.Result().Header)
 }
+
+func TestVerifyUser(t *testing.T) {
+	body := `{"username":"verifytest","email":"verifytest@example.com", "password":"1Secret1"}`
+	registerReq := httptest.NewRequest("POST", "http://localhost:3000/register", bytes.NewBufferString(body))
+	registerReq.Header.Set("Content-Type", "application/json")
+	registerWriter := httptest.NewRecorder()
+	users.RegisterUser(userStore, logger, ts, mailer).ServeHTTP(registerWriter, registerReq)
+
+	if registerWriter.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", registerWriter.Code)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	defer func() {
+		_, err := db.DBPool.Exec(ctx, `DELETE FROM users WHERE email = 'verifytest@example.com'`)
+		if err != nil {
+			t.Log("Failed to cleanup verifytest@example.com user")
+		}
+	}()
+
+	// Only the hash of the mailed code is stored, so issue another one
+	var userId string
+	row := db.DBPool.QueryRow(ctx, `SELECT id FROM users WHERE email = 'verifytest@example.com'`)
+	if err := row.Scan(&userId); err != nil {
+		t.Fatalf("Error while reading user: %v", err)
+	}
+	verification, err := ts.NewVerificationToken(ctx, userId)
+	if err != nil {
+		t.Fatalf("Error while creating verification token: %v", err)
+	}
+	code := verification.Token
+
+	// Wrong code
+	req := httptest.NewRequest("POST", "http://localhost:3000/verify",
+		bytes.NewBufferString(`{"email":"verifytest@example.com","code":"wrongcode"}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	users.VerifyUser(userStore, db, logger, ts).ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d", w.Code)
+	}
+
+	// Correct code through the link variant
+	req = httptest.NewRequest("GET", "http://localhost:3000/verify?email=verifytest@example.com&code="+code, nil)
+	w = httptest.NewRecorder()
+	users.VerifyUser(userStore, db, logger, ts).ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", w.Code)
+	}
+
+	// Already used
+	req = httptest.NewRequest("GET", "http://localhost:3000/verify?email=verifytest@example.com&code="+code, nil)
+	w = httptest.NewRecorder()
+	users.VerifyUser(userStore, db, logger, ts).ServeHTTP(w, req)
+
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected status 409, got %d", w.Code)
+	}
+}
+
+func TestSuspendedUserCannotLogin(t *testing.T) {
+	body := `{"username":"suspendtest","email":"suspendtest@example.com", "password":"1Secret1"}`
+	registerReq := httptest.NewRequest("POST", "http://localhost:3000/register", bytes.NewBufferString(body))
+	registerReq.Header.Set("Content-Type", "application/json")
+	registerWriter := httptest.NewRecorder()
+	users.RegisterUser(userStore, logger, ts, mailer).ServeHTTP(registerWriter, registerReq)
+
+	if registerWriter.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", registerWriter.Code)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	defer func() {
+		_, err := db.DBPool.Exec(ctx, `DELETE FROM users WHERE email = 'suspendtest@example.com'`)
+		if err != nil {
+			t.Log("Failed to cleanup suspendtest@example.com user")
+		}
+	}()
+
+	found, total, err := users.SearchUsers(ctx, db, users.UserFilter{Query: "suspendtest", Limit: 10})
+	if err != nil {
+		t.Fatalf("failed to search users: %v", err)
+	}
+	if total != 1 || len(found) != 1 {
+		t.Fatalf("expected 1 user, got: %d", total)
+	}
+
+	if err = users.SetSuspended(ctx, db, found[0].Id, true); err != nil {
+		t.Fatalf("failed to suspend user: %v", err)
+	}
+
+	req := httptest.NewRequest("POST", "http://localhost:3000/login", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	users.LoginUser(userStore, logger, ts, guard, mailer).ServeHTTP(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected status 403, got %d", w.Code)
+	}
+
+	if err = users.SetSuspended(ctx, db, found[0].Id, false); err != nil {
+		t.Fatalf("failed to unsuspend user: %v", err)
+	}
+
+	req = httptest.NewRequest("POST", "http://localhost:3000/login", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	users.LoginUser(userStore, logger, ts, guard, mailer).ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", w.Code)
+	}
+}
+
+func TestSeedAdminSkipsExistingUsers(t *testing.T) {
+	body := `{"username":"seedtest","email":"seedtest@example.com", "password":"1Secret1"}`
+	req := httptest.NewRequest("POST", "http://localhost:3000/register", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	users.RegisterUser(userStore, logger, ts, mailer).ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	defer func() {
+		_, err := db.DBPool.Exec(ctx, `DELETE FROM users WHERE email = 'seedtest@example.com'`)
+		if err != nil {
+			t.Log("Failed to cleanup seedtest@example.com user")
+		}
+	}()
+
+	if err := rbac.SeedRoles(ctx, db); err != nil {
+		t.Fatalf("failed to seed roles: %v", err)
+	}
+
+	u, err := userStore.GetByEmail(ctx, "seedtest@example.com")
+	if err != nil {
+		t.Fatalf("registered user not found: %v", err)
+	}
+
+	// Like on startup: whoever registered the address doesn't become admin
+	if err = users.SeedAdmin(ctx, db, logger, u.Email, "", "", false); err != nil {
+		t.Fatalf("failed to seed admin: %v", err)
+	}
+	if roles, _ := rbac.UserRoles(ctx, db, u.Id); slices.Contains(roles, rbac.RoleAdmin) {
+		t.Fatalf("expected the existing user not to be promoted, got: %v", roles)
+	}
+
+	// Like seed-admin
+	if err = users.SeedAdmin(ctx, db, logger, u.Email, "", "", true); err != nil {
+		t.Fatalf("failed to seed admin: %v", err)
+	}
+	if roles, _ := rbac.UserRoles(ctx, db, u.Id); !slices.Contains(roles, rbac.RoleAdmin) {
+		t.Errorf("expected the existing user to be promoted, got: %v", roles)
+	}
+}
+
+func TestLoginIsAudited(t *testing.T) {
+	body := `{"username":"audittest","email":"audittest@example.com", "password":"1Secret1"}`
+	registerReq := httptest.NewRequest("POST", "http://localhost:3000/register", bytes.NewBufferString(body))
+	registerReq.Header.Set("Content-Type", "application/json")
+	registerWriter := httptest.NewRecorder()
+	users.RegisterUser(userStore, logger, ts, mailer).ServeHTTP(registerWriter, registerReq)
+
+	if registerWriter.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", registerWriter.Code)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	defer func() {
+		_, err := db.DBPool.Exec(ctx, `DELETE FROM users WHERE email = 'audittest@example.com'`)
+		if err != nil {
+			t.Log("Failed to cleanup audittest@example.com user")
+		}
+	}()
+
+	// Wrong password, then the right one
+	for _, password := range []string{"1Wrong11", "1Secret1"} {
+		req := httptest.NewRequest("POST", "http://localhost:3000/login",
+			bytes.NewBufferString(`{"email":"audittest@example.com", "password":"`+password+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		users.LoginUser(userStore, logger, ts, guard, mailer).ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	var userId string
+	row := db.DBPool.QueryRow(ctx, `SELECT id FROM users WHERE email = 'audittest@example.com'`)
+	if err := row.Scan(&userId); err != nil {
+		t.Fatalf("Error while reading user: %v", err)
+	}
+
+	events, err := audit.List(ctx, db, audit.Filter{UserId: userId, EventType: audit.EventLogin, Limit: 10})
+	if err != nil {
+		t.Fatalf("failed to list audit events: %v", err)
+	}
+
+	if len(events) != 2 {
+		t.Fatalf("expected 2 login events, got: %d", len(events))
+	}
+
+	// Newest first
+	if events[0].Outcome != audit.OutcomeSuccess || events[1].Outcome != audit.OutcomeFailure {
+		t.Errorf("expected success after failure, got: %s, %s", events[0].Outcome, events[1].Outcome)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	body := `{"username":"locktest","email":"locktest@example.com", "password":"1Secret1"}`
+	registerReq := httptest.NewRequest("POST", "http://localhost:3000/register", bytes.NewBufferString(body))
+	registerReq.Header.Set("Content-Type", "application/json")
+	registerWriter := httptest.NewRecorder()
+	users.RegisterUser(userStore, logger, ts, mailer).ServeHTTP(registerWriter, registerReq)
+
+	if registerWriter.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", registerWriter.Code)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	defer func() {
+		_, err := db.DBPool.Exec(ctx, `DELETE FROM users WHERE email = 'locktest@example.com'`)
+		if err != nil {
+			t.Log("Failed to cleanup locktest@example.com user")
+		}
+	}()
+
+	config := lockout.DefaultConfig()
+	config.BaseDelay = 0
+	config.MaxAccountFailures = 3
+	strict := lockout.NewGuard(logger, db, config)
+
+	login := func(password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "http://localhost:3000/login",
+			bytes.NewBufferString(`{"email":"locktest@example.com", "password":"`+password+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		users.LoginUser(userStore, logger, ts, strict, mailer).ServeHTTP(w, req)
+		return w
+	}
+
+	for range config.MaxAccountFailures {
+		if w := login("1Wrong11"); w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status 400, got %d", w.Code)
+		}
+	}
+
+	// Locked, even with the right password
+	w := login("1Secret1")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status 429, got %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Errorf("expected a Retry-After header")
+	}
+
+	// Only the hash of the mailed token is stored, so issue another one
+	var userId string
+	row := db.DBPool.QueryRow(ctx, `SELECT id FROM users WHERE email = 'locktest@example.com'`)
+	if err := row.Scan(&userId); err != nil {
+		t.Fatalf("Error while reading user: %v", err)
+	}
+	unlock, err := ts.NewAccountUnlockToken(ctx, userId, time.Hour)
+	if err != nil {
+		t.Fatalf("Error while creating unlock token: %v", err)
+	}
+	unlockToken := unlock.Token
+
+	// Opening the mailed link only asks for confirmation
+	req := httptest.NewRequest("GET", "http://localhost:3000/login/unlock?token="+unlockToken, nil)
+	pageWriter := httptest.NewRecorder()
+	users.UnlockAccountPage(logger, ts).ServeHTTP(pageWriter, req)
+
+	if pageWriter.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", pageWriter.Code)
+	}
+
+	if w := login("1Secret1"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status 429, got %d", w.Code)
+	}
+
+	// Submitting its form does the unlock
+	req = httptest.NewRequest("POST", "http://localhost:3000/login/unlock", bytes.NewBufferString("token="+url.QueryEscape(unlockToken)))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	unlockWriter := httptest.NewRecorder()
+	users.UnlockAccount(userStore, db, logger, ts, strict).ServeHTTP(unlockWriter, req)
+
+	if unlockWriter.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", unlockWriter.Code)
+	}
+
+	if w := login("1Secret1"); w.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", w.Code)
+	}
+}
+
+func TestLoginMFAAttemptsUseUpToken(t *testing.T) {
+	body := `{"username":"mfatest","email":"mfatest@example.com", "password":"1Secret1"}`
+	registerReq := httptest.NewRequest("POST", "http://localhost:3000/register", bytes.NewBufferString(body))
+	registerReq.Header.Set("Content-Type", "application/json")
+	registerWriter := httptest.NewRecorder()
+	users.RegisterUser(userStore, logger, ts, mailer).ServeHTTP(registerWriter, registerReq)
+
+	if registerWriter.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", registerWriter.Code)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	defer func() {
+		_, err := db.DBPool.Exec(ctx, `DELETE FROM users WHERE email = 'mfatest@example.com'`)
+		if err != nil {
+			t.Log("Failed to cleanup mfatest@example.com user")
+		}
+		guard.Reset(ctx, "mfatest@example.com")
+	}()
+
+	var userId string
+	row := db.DBPool.QueryRow(ctx, `SELECT id FROM users WHERE email = 'mfatest@example.com'`)
+	if err := row.Scan(&userId); err != nil {
+		t.Fatalf("Error while reading user: %v", err)
+	}
+
+	pending, err := ts.NewMFAPendingToken(ctx, userId, false)
+	if err != nil {
+		t.Fatalf("Error while creating mfa pending token: %v", err)
+	}
+
+	// Only the token is limited here, not the account
+	config := lockout.DefaultConfig()
+	config.BaseDelay = 0
+	config.MaxAccountFailures = 100
+	lenient := lockout.NewGuard(logger, db, config)
+
+	loginMFA := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "http://localhost:3000/login/mfa",
+			bytes.NewBufferString(`{"mfa_token":"`+pending.Token+`", "code":"000000"}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		users.LoginMFA(db, logger, ts, lenient, mailer).ServeHTTP(w, req)
+		return w
+	}
+
+	for range token.MaxMFAAttempts {
+		if w := loginMFA(); w.Code != http.StatusUnauthorized {
+			t.Fatalf("expected status 401, got %d", w.Code)
+		}
+	}
+
+	if _, err := ts.GetToken(ctx, token.TypeMFAPending, pending.Token); err != token.ErrTokenNotFound {
+		t.Errorf("expected the mfa pending token to be used up, got: %v", err)
+	}
+}
@@ -0,0 +1,193 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	audit "fucku/internal/audit"
+	database "fucku/internal/database"
+	mailer "fucku/internal/mailer"
+	token "fucku/internal/tokens"
+	utils "fucku/internal/utils"
+)
+
+// Minimum time between two verification mails for the same user
+const verificationResendCooldown = time.Minute
+
+type verificationRequest struct {
+	Email string `json:"email"`
+	Code  string `json:"code"`
+}
+
+// Consumes an email verification code and marks the user as verified.
+// Accepts a JSON body on POST and the email & code query parameters on GET,
+// so the link from the registration mail works as well.
+func VerifyUser(store UserStore, db *database.Database, logger *slog.Logger, ts *token.TokenService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var vr verificationRequest
+
+		if r.Method == http.MethodGet {
+			vr.Email = r.URL.Query().Get("email")
+			vr.Code = r.URL.Query().Get("code")
+		} else {
+			err := utils.DecodeJSONBody(w, r, &vr)
+			if err != nil {
+				var mr *utils.MalformedRequest
+				if errors.As(err, &mr) {
+					http.Error(w, mr.Msg, mr.Status)
+					return
+				} else {
+					logger.Error("error while decoding json body in verify user", "error", err)
+					http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+					return
+				}
+			}
+		}
+
+		if vr.Email == "" || vr.Code == "" {
+			http.Error(w, "email and code are required", http.StatusBadRequest)
+			return
+		}
+
+		u, err := store.GetByEmail(r.Context(), vr.Email)
+		if err != nil {
+			if errors.Is(err, ErrUserNotFound) {
+				// Do not reveal whether the email exists
+				http.Error(w, "invalid verification code", http.StatusBadRequest)
+				return
+			}
+			logger.Error("failed to read user during verification", "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		userId := u.Id
+
+		if u.Verified == 1 {
+			http.Error(w, "email already verified", http.StatusConflict)
+			return
+		}
+
+		_, err = ts.GetUserToken(r.Context(), userId, token.TypeEmailVerification, vr.Code)
+		if err != nil {
+			if errors.Is(err, token.ErrTokenNotFound) || errors.Is(err, token.ErrTokenExpired) {
+				audit.Record(r.Context(), db, logger, r, audit.Event{
+					UserId:    userId,
+					EventType: audit.EventEmailVerified,
+					Outcome:   audit.OutcomeFailure,
+					Metadata:  map[string]any{"reason": err.Error()},
+				})
+			}
+
+			switch {
+			case errors.Is(err, token.ErrTokenNotFound):
+				http.Error(w, "invalid verification code", http.StatusBadRequest)
+			case errors.Is(err, token.ErrTokenExpired):
+				http.Error(w, "verification code expired", http.StatusGone)
+			default:
+				logger.Error("failed to read verification token", "error", err, "user_id", userId)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		if err = MarkVerified(r.Context(), db, userId); err != nil {
+			logger.Error("failed to mark user as verified", "error", err, "user_id", userId)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		// Codes are single use, drop every outstanding one
+		if err = ts.RevokeTokens(r.Context(), userId, token.TypeEmailVerification); err != nil {
+			logger.Error("failed to delete verification tokens", "error", err, "user_id", userId)
+		}
+
+		audit.Record(r.Context(), db, logger, r, audit.Event{UserId: userId, EventType: audit.EventEmailVerified})
+		logger.Info("verified email", "email", vr.Email)
+		w.WriteHeader(200)
+		fmt.Fprintln(w, "email verified successfully")
+	})
+}
+
+// Sends a fresh verification code, invalidating all previous ones.
+// Answers the same way for unknown and already verified emails.
+func ResendVerification(store UserStore, logger *slog.Logger, ts *token.TokenService, mailer *mailer.Mailer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var vr verificationRequest
+
+		err := utils.DecodeJSONBody(w, r, &vr)
+		if err != nil {
+			var mr *utils.MalformedRequest
+			if errors.As(err, &mr) {
+				http.Error(w, mr.Msg, mr.Status)
+				return
+			} else {
+				logger.Error("error while decoding json body in resend verification", "error", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if vr.Email == "" {
+			http.Error(w, "email is required", http.StatusBadRequest)
+			return
+		}
+
+		const genericResponse = "if the account exists and is not verified yet, a new code has been sent"
+
+		u, err := store.GetByEmail(r.Context(), vr.Email)
+		if err != nil && !errors.Is(err, ErrUserNotFound) {
+			logger.Error("failed to read user during verification resend", "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		userId, username, locale := u.Id, u.Username, u.Locale
+
+		if userId == "" || u.Verified == 1 {
+			w.WriteHeader(200)
+			fmt.Fprintln(w, genericResponse)
+			return
+		}
+
+		latest, err := ts.LatestToken(r.Context(), userId, token.TypeEmailVerification)
+		if err != nil && !errors.Is(err, token.ErrTokenNotFound) {
+			logger.Error("failed to read latest verification token", "error", err, "user_id", userId)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if latest != nil {
+			wait := verificationResendCooldown - time.Now().UTC().Sub(latest.CreatedAt)
+			if wait > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				http.Error(w, "please wait before requesting another code", http.StatusTooManyRequests)
+				return
+			}
+		}
+
+		if err = ts.RevokeTokens(r.Context(), userId, token.TypeEmailVerification); err != nil {
+			logger.Error("failed to revoke verification tokens", "error", err, "user_id", userId)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		verificationToken, err := ts.NewVerificationToken(r.Context(), userId)
+		if err != nil {
+			logger.Error("error while creating verification token", "error", err, "user_id", userId)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if err := mailer.SendRegistrationMail(r.Context(), username, vr.Email, locale, verificationToken.Token); err != nil {
+			logger.Error("failed to queue verification mail", "error", err, "email", vr.Email)
+		}
+		audit.Record(r.Context(), ts.DB, logger, r, audit.Event{UserId: userId, EventType: audit.EventVerificationResent})
+
+		w.WriteHeader(200)
+		fmt.Fprintln(w, genericResponse)
+	})
+}
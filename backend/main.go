@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -14,7 +16,11 @@ import (
 
 	config "fucku/internal/config"
 	database "fucku/internal/database"
+	lockout "fucku/internal/lockout"
 	mailer "fucku/internal/mailer"
+	passkeys "fucku/internal/passkeys"
+	ratelimit "fucku/internal/ratelimit"
+	rbac "fucku/internal/rbac"
 	token "fucku/internal/tokens"
 	users "fucku/internal/users"
 	"fucku/pkg"
@@ -23,21 +29,45 @@ import (
 )
 
 // We setup the database prior to running the app.
-func setupApp(db *database.Database) error {
-	// If it already exists, postgres will error accordingly, which we ignore.
-	err := database.SetupDatabase(db)
-	if err != nil {
-		if !strings.Contains(err.Error(), "already exists") {
+func setupApp(ctx context.Context, db *database.Database, logger *slog.Logger) error {
+	// Creating the database needs rights a managed database may not grant
+	if os.Getenv("DB_SKIP_CREATE") != "true" {
+		maintenanceDB := os.Getenv("DB_MAINTENANCE_NAME")
+		if maintenanceDB == "" {
+			maintenanceDB = "postgres"
+		}
+
+		if err := database.SetupDatabase(ctx, os.Getenv("DB_URL"), maintenanceDB); err != nil {
 			return err
 		}
 	}
 
+	// Brings the schema up to date, instances starting at the same time wait for each other
+	migrator, err := database.NewMigrator(logger, db)
+	if err != nil {
+		return err
+	}
+
+	if _, err = migrator.Up(ctx); err != nil {
+		return err
+	}
+
 	return nil
 }
 
 // Create context and call the actual apps entry point
 func main() {
 	ctx := context.Background()
+
+	// Subcommands like seed-admin run instead of the server
+	if len(os.Args) > 1 {
+		if err := runCommand(ctx, os.Args[1:], os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	if err := run(ctx, os.Stdout); err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err)
 		os.Exit(1)
@@ -67,24 +97,122 @@ func run(ctx context.Context, w io.Writer) error {
 		return err
 	}
 
+	if v := os.Getenv("DB_QUERY_TIMEOUT"); v != "" {
+		timeout, err := time.ParseDuration(v)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid DB_QUERY_TIMEOUT %q", v)
+		}
+		db.QueryTimeout = timeout
+	}
+
+	if v := os.Getenv("DB_TX_TIMEOUT"); v != "" {
+		timeout, err := time.ParseDuration(v)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid DB_TX_TIMEOUT %q", v)
+		}
+		db.TxTimeout = timeout
+	}
+
 	// Sets up the database & tables
-	err = setupApp(db)
+	err = setupApp(ctx, db, logger)
 	if err != nil {
 		logger.Error("app setup failed", "error", err)
 		return err
 	}
 
+	// Seeds roles and, if configured, the first admin
+	err = rbac.SeedRoles(ctx, db)
+	if err != nil {
+		logger.Error("failed to seed roles", "error", err)
+		return err
+	}
+
+	if email := os.Getenv("ADMIN_EMAIL"); email != "" {
+		err = users.SeedAdmin(ctx, db, logger, email, os.Getenv("ADMIN_USERNAME"), os.Getenv("ADMIN_PASSWORD"), false)
+		if err != nil {
+			logger.Error("failed to seed admin", "error", err)
+			return err
+		}
+	}
+
+	// CSRF tokens can't be signed without a secret, so don't start at all
+	csrfSecrets, err := token.CSRFSecretsFromEnv()
+	if err != nil {
+		logger.Error("failed to configure csrf secrets", "error", err)
+		return err
+	}
+
 	// Creates a token service
 	tokenService := token.NewTokenService(logger, db)
+	tokenService.SingleSession = os.Getenv("SINGLE_SESSION") == "true"
+	tokenService.CSRFSecrets = csrfSecrets
+	tokenService.Sessions = token.SessionConfigFromEnv()
+	// Bearer logins get signed JWT access tokens if a signing key is configured
+	jwtKeys, err := token.JWTKeysFromEnv()
+	if err != nil {
+		logger.Error("failed to load jwt signing keys", "error", err)
+		return err
+	}
+	userStore := users.NewPostgresUserStore(db)
+	tokenService.UserActive = users.UserActive(userStore)
+	if jwtKeys != nil {
+		tokenService.JWTKeys = jwtKeys
+		tokenService.JWTSubjects = users.JWTSubjects(userStore)
+	}
 	appConfig := config.NewAppConfig(logger, db)
 
-	mailer := mailer.NewMailer(logger, appConfig)
+	// Mails go out through the transport named in MAIL_TRANSPORT
+	mailTransport, err := mailer.TransportFromEnv(logger)
+	if err != nil {
+		logger.Error("failed to configure mail transport", "error", err)
+		return err
+	}
+	// Mails are queued in the outbox_emails table & sent by the outbox workers
+	mailOutbox := mailer.NewOutbox(logger, db, mailTransport, mailer.OutboxConfigFromEnv())
+	mailer, err := mailer.NewMailer(logger, appConfig, mailOutbox, mailer.SenderFromEnv())
+	if err != nil {
+		logger.Error("failed to load mail templates", "error", err)
+		return err
+	}
+
+	loginGuard := lockout.NewGuard(logger, db, lockout.ConfigFromEnv())
+
+	// Limits are kept in memory unless several instances have to share them
+	var limitStore ratelimit.Store
+	var limitCleanup func(context.Context)
+	if os.Getenv("RATE_LIMIT_STORE") == "postgres" {
+		store := ratelimit.NewPostgresStore(logger, db)
+		limitStore, limitCleanup = store, store.StartCleanup
+	} else {
+		store := ratelimit.NewMemoryStore()
+		limitStore, limitCleanup = store, store.StartCleanup
+	}
+
+	// Passkeys are optional, their ceremonies are only routed if configured
+	webAuthn, err := passkeys.WebAuthnFromEnv()
+	if err != nil {
+		logger.Error("failed to configure webauthn", "error", err)
+		return err
+	}
+	if webAuthn == nil {
+		logger.Info("passkeys disabled, set WEBAUTHN_RP_ID & WEBAUTHN_ORIGINS to enable them")
+	}
 
 	/** WORKERS **/
-	go token.StartTokenCleanup(db, logger)
+	// Workers stop once the shutdown signal cancels ctx
+	go token.StartTokenCleanup(ctx, db, logger)
 	logger.Info("started token cleanup service")
-	go appConfig.StartConfigWorker()
+	appConfig.OnChange(func(old, new config.Snapshot) {
+		logger.Info("config changed", "mailing_active", new.MailingActive)
+	})
+	appConfig.StartConfigWorker(ctx)
 	logger.Info("started config service")
+	go loginGuard.StartCleanup(ctx)
+	logger.Info("started login attempt cleanup service")
+	go limitCleanup(ctx)
+	logger.Info("started rate limit cleanup service")
+	mailOutbox.Start(ctx)
+	logger.Info("started mail outbox workers", "workers", mailOutbox.Config.Workers)
 
 	/** ROUTES & SERVER  **/
 	mux := http.NewServeMux()
@@ -92,30 +220,335 @@ func run(ctx context.Context, w io.Writer) error {
 	// User Routes
 	// mux.Handle("POST /register", testMiddleware(te()))
 	mux.Handle("POST /register", Chain(
-		users.RegisterUser(db, logger, tokenService, mailer),
+		users.RegisterUser(userStore, logger, tokenService, mailer),
+		RecoveryMiddleware(logger),
+		RateLimitMiddleware(logger, limitStore, "register", ratelimit.Limit{
+			Algorithm: ratelimit.SlidingWindow, Requests: 5, Period: time.Hour,
+		}, ratelimit.ByIP),
+	))
+
+	mux.Handle("POST /verify", Chain(
+		users.VerifyUser(userStore, db, logger, tokenService),
+		RecoveryMiddleware(logger),
+	))
+
+	mux.Handle("GET /verify", Chain(
+		users.VerifyUser(userStore, db, logger, tokenService),
+		RecoveryMiddleware(logger),
+	))
+
+	mux.Handle("POST /verify/resend", Chain(
+		users.ResendVerification(userStore, logger, tokenService, mailer),
+		RecoveryMiddleware(logger),
+	))
+
+	mux.Handle("POST /password/forgot", Chain(
+		users.ForgotPassword(db, logger, tokenService, mailer),
+		RecoveryMiddleware(logger),
+		RateLimitMiddleware(logger, limitStore, "password_forgot", ratelimit.Limit{
+			Algorithm: ratelimit.TokenBucket, Requests: 5, Period: time.Minute,
+		}, ratelimit.ByIP),
+	))
+
+	mux.Handle("POST /password/reset", Chain(
+		users.ResetPassword(db, logger, tokenService),
 		RecoveryMiddleware(logger),
+		RateLimitMiddleware(logger, limitStore, "password_reset", ratelimit.Limit{
+			Algorithm: ratelimit.TokenBucket, Requests: 5, Period: time.Minute,
+		}, ratelimit.ByIP),
 	))
 
 	mux.Handle("POST /login", Chain(
-		users.LoginUser(db, logger, tokenService),
+		users.LoginUser(userStore, logger, tokenService, loginGuard, mailer),
 		RecoveryMiddleware(logger),
+		RateLimitMiddleware(logger, limitStore, "login", ratelimit.Limit{
+			Algorithm: ratelimit.TokenBucket, Requests: 10, Period: time.Minute,
+		}, ratelimit.ByIP),
 	))
 
+	mux.Handle("POST /token/refresh", Chain(
+		users.RefreshBearerToken(logger, tokenService),
+		RecoveryMiddleware(logger),
+		RateLimitMiddleware(logger, limitStore, "refresh", ratelimit.Limit{
+			Algorithm: ratelimit.TokenBucket, Requests: 30, Period: time.Minute,
+		}, ratelimit.ByIP),
+	))
+
+	// Both count against one limit, each guesses a token
+	unlockLimit := RateLimitMiddleware(logger, limitStore, "login_unlock", ratelimit.Limit{
+		Algorithm: ratelimit.TokenBucket, Requests: 5, Period: time.Minute,
+	}, ratelimit.ByIP)
+
+	mux.Handle("POST /login/unlock", Chain(
+		users.UnlockAccount(userStore, db, logger, tokenService, loginGuard),
+		RecoveryMiddleware(logger),
+		unlockLimit,
+	))
+
+	mux.Handle("GET /login/unlock", Chain(
+		users.UnlockAccountPage(logger, tokenService),
+		RecoveryMiddleware(logger),
+		unlockLimit,
+	))
+
+	mux.Handle("POST /login/mfa", Chain(
+		users.LoginMFA(db, logger, tokenService, loginGuard, mailer),
+		RecoveryMiddleware(logger),
+		RateLimitMiddleware(logger, limitStore, "login_mfa", ratelimit.Limit{
+			Algorithm: ratelimit.TokenBucket, Requests: 10, Period: time.Minute,
+		}, ratelimit.ByIP),
+	))
+
+	if webAuthn != nil {
+		mux.Handle("POST /login/passkey/begin", Chain(
+			users.BeginPasskeyLogin(logger, tokenService, webAuthn),
+			RecoveryMiddleware(logger),
+			RateLimitMiddleware(logger, limitStore, "login_passkey", ratelimit.Limit{
+				Algorithm: ratelimit.TokenBucket, Requests: 10, Period: time.Minute,
+			}, ratelimit.ByIP),
+		))
+
+		mux.Handle("POST /login/passkey/finish", Chain(
+			users.FinishPasskeyLogin(db, logger, tokenService, webAuthn, loginGuard, mailer),
+			RecoveryMiddleware(logger),
+			RateLimitMiddleware(logger, limitStore, "login_passkey_finish", ratelimit.Limit{
+				Algorithm: ratelimit.TokenBucket, Requests: 10, Period: time.Minute,
+			}, ratelimit.ByIP),
+		))
+	}
+
 	mux.Handle("GET /auth/status", Chain(
-		http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
-			w.WriteHeader(http.StatusOK)
-		}),
+		users.AuthStatus(tokenService.Sessions, logger),
+		RecoveryMiddleware(logger),
+		IsAuthenticatedMiddleware(userStore, tokenService, logger),
+	))
+
+	if jwtKeys != nil {
+		mux.Handle("GET /.well-known/jwks.json", Chain(
+			users.JWKS(jwtKeys, logger),
+			RecoveryMiddleware(logger),
+		))
+	}
+
+	mux.Handle("POST /me/password", Chain(
+		users.ChangePassword(db, logger, tokenService),
+		RecoveryMiddleware(logger),
+		CSRFMiddleware(tokenService, logger),
+		IsAuthenticatedMiddleware(userStore, tokenService, logger),
+	))
+
+	mux.Handle("POST /me/email", Chain(
+		users.ChangeEmail(db, logger, tokenService, mailer),
+		RecoveryMiddleware(logger),
+		CSRFMiddleware(tokenService, logger),
+		IsAuthenticatedMiddleware(userStore, tokenService, logger),
+	))
+
+	mux.Handle("POST /me/locale", Chain(
+		users.ChangeLocale(db, logger, mailer),
+		RecoveryMiddleware(logger),
+		CSRFMiddleware(tokenService, logger),
+		IsAuthenticatedMiddleware(userStore, tokenService, logger),
+	))
+
+	mux.Handle("POST /me/email/confirm", Chain(
+		users.ConfirmEmailChange(db, logger, tokenService),
+		RecoveryMiddleware(logger),
+		CSRFMiddleware(tokenService, logger),
+		IsAuthenticatedMiddleware(userStore, tokenService, logger),
+	))
+
+	mux.Handle("POST /me/mfa/totp/setup", Chain(
+		users.SetupTOTP(db, logger),
 		RecoveryMiddleware(logger),
-		IsAuthenticatedMiddleware(db, logger),
+		CSRFMiddleware(tokenService, logger),
+		IsAuthenticatedMiddleware(userStore, tokenService, logger),
+	))
+
+	mux.Handle("POST /me/mfa/totp/confirm", Chain(
+		users.ConfirmTOTP(db, logger),
+		RecoveryMiddleware(logger),
+		CSRFMiddleware(tokenService, logger),
+		IsAuthenticatedMiddleware(userStore, tokenService, logger),
+	))
+
+	mux.Handle("POST /me/mfa/totp/disable", Chain(
+		users.DisableTOTP(db, logger),
+		RecoveryMiddleware(logger),
+		CSRFMiddleware(tokenService, logger),
+		IsAuthenticatedMiddleware(userStore, tokenService, logger),
+	))
+
+	// Listing, renaming & deleting passkeys works without WebAuthn
+	if webAuthn != nil {
+		mux.Handle("POST /me/passkeys/register/begin", Chain(
+			users.BeginPasskeyRegistration(db, logger, tokenService, webAuthn),
+			RecoveryMiddleware(logger),
+			CSRFMiddleware(tokenService, logger),
+			IsAuthenticatedMiddleware(userStore, tokenService, logger),
+		))
+
+		mux.Handle("POST /me/passkeys/register/finish", Chain(
+			users.FinishPasskeyRegistration(db, logger, tokenService, webAuthn),
+			RecoveryMiddleware(logger),
+			CSRFMiddleware(tokenService, logger),
+			IsAuthenticatedMiddleware(userStore, tokenService, logger),
+		))
+	}
+
+	mux.Handle("GET /me/passkeys", Chain(
+		users.ListPasskeys(db, logger),
+		RecoveryMiddleware(logger),
+		IsAuthenticatedMiddleware(userStore, tokenService, logger),
+	))
+
+	mux.Handle("PATCH /me/passkeys/{id}", Chain(
+		users.RenamePasskey(db, logger),
+		RecoveryMiddleware(logger),
+		CSRFMiddleware(tokenService, logger),
+		IsAuthenticatedMiddleware(userStore, tokenService, logger),
+	))
+
+	mux.Handle("DELETE /me/passkeys/{id}", Chain(
+		users.DeletePasskey(db, logger),
+		RecoveryMiddleware(logger),
+		CSRFMiddleware(tokenService, logger),
+		IsAuthenticatedMiddleware(userStore, tokenService, logger),
+	))
+
+	mux.Handle("GET /me/sessions", Chain(
+		users.ListSessions(logger, tokenService),
+		RecoveryMiddleware(logger),
+		IsAuthenticatedMiddleware(userStore, tokenService, logger),
+	))
+
+	mux.Handle("DELETE /me/sessions/{id}", Chain(
+		users.RevokeSession(logger, tokenService),
+		RecoveryMiddleware(logger),
+		CSRFMiddleware(tokenService, logger),
+		IsAuthenticatedMiddleware(userStore, tokenService, logger),
+	))
+
+	mux.Handle("DELETE /me/sessions", Chain(
+		users.RevokeOtherSessions(logger, tokenService),
+		RecoveryMiddleware(logger),
+		CSRFMiddleware(tokenService, logger),
+		IsAuthenticatedMiddleware(userStore, tokenService, logger),
+	))
+
+	mux.Handle("GET /me/security-events", Chain(
+		users.SecurityEvents(db, logger),
+		RecoveryMiddleware(logger),
+		IsAuthenticatedMiddleware(userStore, tokenService, logger),
 	))
 
 	mux.Handle("POST /logout", Chain(
-		users.LogoutUser(db, logger, tokenService),
+		users.LogoutUser(logger, tokenService),
+		RecoveryMiddleware(logger),
+		CSRFMiddleware(tokenService, logger),
+		IsAuthenticatedMiddleware(userStore, tokenService, logger),
+	))
+
+	// Admin Routes
+	mux.Handle("GET /admin/users", Chain(
+		users.AdminListUsers(db, logger),
 		RecoveryMiddleware(logger),
-		CSRFMiddleware(db, logger),
-		IsAuthenticatedMiddleware(db, logger),
+		IsAuthenticatedMiddleware(userStore, tokenService, logger),
+		RequirePermission(logger, rbac.PermUsersRead),
 	))
 
+	mux.Handle("GET /admin/users/{id}", Chain(
+		users.AdminGetUser(userStore, db, logger, tokenService),
+		RecoveryMiddleware(logger),
+		IsAuthenticatedMiddleware(userStore, tokenService, logger),
+		RequirePermission(logger, rbac.PermUsersRead),
+	))
+
+	mux.Handle("POST /admin/users/{id}/verify", Chain(
+		users.AdminVerifyUser(userStore, db, logger, tokenService),
+		RecoveryMiddleware(logger),
+		CSRFMiddleware(tokenService, logger),
+		IsAuthenticatedMiddleware(userStore, tokenService, logger),
+		RequirePermission(logger, rbac.PermUsersWrite),
+	))
+
+	mux.Handle("POST /admin/users/{id}/suspend", Chain(
+		users.AdminSuspendUser(userStore, db, logger, tokenService),
+		RecoveryMiddleware(logger),
+		CSRFMiddleware(tokenService, logger),
+		IsAuthenticatedMiddleware(userStore, tokenService, logger),
+		RequirePermission(logger, rbac.PermUsersWrite),
+	))
+
+	mux.Handle("POST /admin/users/{id}/unsuspend", Chain(
+		users.AdminUnsuspendUser(userStore, db, logger),
+		RecoveryMiddleware(logger),
+		CSRFMiddleware(tokenService, logger),
+		IsAuthenticatedMiddleware(userStore, tokenService, logger),
+		RequirePermission(logger, rbac.PermUsersWrite),
+	))
+
+	mux.Handle("POST /admin/users/{id}/password-reset", Chain(
+		users.AdminForcePasswordReset(userStore, db, logger, tokenService, mailer),
+		RecoveryMiddleware(logger),
+		CSRFMiddleware(tokenService, logger),
+		IsAuthenticatedMiddleware(userStore, tokenService, logger),
+		RequirePermission(logger, rbac.PermUsersWrite),
+	))
+
+	mux.Handle("DELETE /admin/users/{id}/sessions", Chain(
+		users.AdminRevokeSessions(userStore, db, logger, tokenService),
+		RecoveryMiddleware(logger),
+		CSRFMiddleware(tokenService, logger),
+		IsAuthenticatedMiddleware(userStore, tokenService, logger),
+		RequirePermission(logger, rbac.PermUsersWrite),
+	))
+
+	mux.Handle("DELETE /admin/users/{id}", Chain(
+		users.AdminDeleteUser(userStore, db, logger, tokenService),
+		RecoveryMiddleware(logger),
+		CSRFMiddleware(tokenService, logger),
+		IsAuthenticatedMiddleware(userStore, tokenService, logger),
+		RequirePermission(logger, rbac.PermUsersDelete),
+	))
+
+	mux.Handle("GET /admin/audit-events", Chain(
+		users.AdminAuditEvents(db, logger),
+		RecoveryMiddleware(logger),
+		IsAuthenticatedMiddleware(userStore, tokenService, logger),
+		RequirePermission(logger, rbac.PermAuditRead),
+	))
+
+	mux.Handle("GET /admin/mails", Chain(
+		users.AdminListMails(mailOutbox, logger),
+		RecoveryMiddleware(logger),
+		IsAuthenticatedMiddleware(userStore, tokenService, logger),
+		RequirePermission(logger, rbac.PermMailRead),
+	))
+
+	mux.Handle("GET /admin/mails/{id}", Chain(
+		users.AdminGetMail(mailOutbox, logger),
+		RecoveryMiddleware(logger),
+		IsAuthenticatedMiddleware(userStore, tokenService, logger),
+		RequirePermission(logger, rbac.PermMailRead),
+	))
+
+	mux.Handle("POST /admin/mails/{id}/retry", Chain(
+		users.AdminRetryMail(db, mailOutbox, logger),
+		RecoveryMiddleware(logger),
+		CSRFMiddleware(tokenService, logger),
+		IsAuthenticatedMiddleware(userStore, tokenService, logger),
+		RequirePermission(logger, rbac.PermMailWrite),
+	))
+
+	// Development only routes
+	if os.Getenv("APP_ENV") == "development" {
+		mux.Handle("GET /dev/mails/{template}", Chain(
+			mailer.PreviewHandler(),
+			RecoveryMiddleware(logger),
+		))
+	}
+
 	server := &http.Server{
 		Addr:    ":3000",
 		Handler: CORSMiddleware()(mux),
@@ -132,16 +565,24 @@ func run(ctx context.Context, w io.Writer) error {
 	<-ctx.Done()
 	logger.Info("shutdown signal received")
 
-	// Close connection pool
-	if db.DBPool != nil {
-		db.DBPool.Close()
-	}
+	// Let running requests finish before their queries lose the pool
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelShutdown()
 
-	if err := server.Shutdown(context.Background()); err != nil {
+	if err := server.Shutdown(shutdownCtx); err != nil {
 		logger.Error("server shutdown error", "error", err)
 		return err
 	}
 
+	// Mails being sent are finished & recorded before the pool goes away
+	mailOutbox.Wait()
+	appConfig.Wait()
+
+	// Close connection pool
+	if db.DBPool != nil {
+		db.DBPool.Close()
+	}
+
 	logger.Info("server exited properly")
 
 	return nil
@@ -172,9 +613,19 @@ func RecoveryMiddleware(logger *slog.Logger) Middleware {
 	}
 }
 
-func CSRFMiddleware(db *database.Database, logger *slog.Logger) Middleware {
+// Checks the double submitted CSRF token, that it was signed for the
+// session in the session cookie and belongs to the same user. Unsigned
+// tokens of sessions from before signing are replaced by a signed one.
+// Bearer requests are let through: browsers never add the header on
+// their own and IsAuthenticatedMiddleware then ignores the cookies.
+func CSRFMiddleware(ts *token.TokenService, logger *slog.Logger) Middleware {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := bearerToken(r); ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+
 			csrfToken, err := r.Cookie("csrf_token")
 			if err != nil {
 				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
@@ -182,78 +633,223 @@ func CSRFMiddleware(db *database.Database, logger *slog.Logger) Middleware {
 			}
 
 			csrfHeader := r.Header.Get("X-CSRF-Token")
-			if csrfHeader == "" || csrfHeader != csrfToken.Value {
+			if csrfHeader == "" || subtle.ConstantTimeCompare([]byte(csrfHeader), []byte(csrfToken.Value)) != 1 {
 				http.Error(w, "Invalid CSRF token", http.StatusForbidden)
 				return
 			}
 
-			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-			defer cancel()
+			sessionCookie, err := r.Cookie("session_token")
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+
+			session, err := ts.Store.Find(r.Context(), token.TypeSession, sessionCookie.Value)
+			if err != nil {
+				if !errors.Is(err, token.ErrTokenNotFound) {
+					logger.Error("failed to load session", "error", err)
+				}
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
 
-			var expiry time.Time
-			row := db.DBPool.QueryRow(ctx,
-				`SELECT expires_at FROM tokens WHERE token = $1`, csrfToken.Value)
+			// Tokens from before they were signed have no signature, they are
+			// checked against the store alone and swapped for a signed one below
+			legacy := !strings.Contains(csrfToken.Value, ".")
+			if !legacy && !ts.CSRFSecrets.Verify(csrfToken.Value, session.Id) {
+				http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+				return
+			}
 
-			if err = row.Scan(&expiry); err != nil {
-				logger.Error("failed to parse expiry from db csrf token", "error", err)
+			stored, err := ts.Store.FindForUser(r.Context(), session.UserId, token.TypeCSRF, csrfToken.Value)
+			if err != nil {
+				if errors.Is(err, token.ErrTokenNotFound) {
+					http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+					return
+				}
+				logger.Error("failed to load csrf token", "error", err)
 				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 				return
 			}
 
-			if expiry.Before(time.Now().UTC()) {
+			if stored.ExpiresAt.Before(time.Now().UTC()) {
 				http.Error(w, "CSRF token expired", http.StatusInternalServerError)
 				return
 			}
 
+			if legacy {
+				if stored.SessionId != session.Id {
+					http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+					return
+				}
+
+				signed, err := ts.NewCSRFToken(r.Context(), session)
+				if err != nil {
+					logger.Error("failed to replace legacy csrf token", "error", err)
+					http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+					return
+				}
+				users.SetSessionCookies(w, sessionCookie.Value, signed.Token, session.Persistent, session.ExpiresAt)
+			}
+
 			next.ServeHTTP(w, r)
 		})
 	}
 }
 
-func IsAuthenticatedMiddleware(db *database.Database, logger *slog.Logger) Middleware {
+// Loads the user of the bearer access token or else the session cookie.
+// Active cookie sessions are extended by the idle timeout up to their
+// lifetime, see token.SessionConfig, and get their cookies re-issued
+// whenever that was written. Access tokens are never extended.
+func IsAuthenticatedMiddleware(userStore users.UserStore, ts *token.TokenService, logger *slog.Logger) Middleware {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			cookie, err := r.Cookie("session_token")
+			var session *token.Token
+			var err error
+			if value, ok := bearerToken(r); ok {
+				session, err = ts.GetAccessToken(r.Context(), value)
+			} else {
+				session, err = cookieSession(w, r, ts.Store, ts.Sessions, logger)
+			}
 			if err != nil {
+				if !errors.Is(err, token.ErrTokenNotFound) && !errors.Is(err, token.ErrTokenExpired) {
+					logger.Error("failed to load session", "error", err)
+				}
 				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 				return
 			}
 
-			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-			defer cancel()
-
-			row := db.DBPool.QueryRow(ctx, `SELECT user_id FROM tokens WHERE token = $1`, cookie.Value)
-
-			var userId string
-			if err := row.Scan(&userId); err != nil {
-				log.Println(err)
-				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			u, err := userStore.GetById(r.Context(), session.UserId)
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				logger.Error("failed to parse userdata into struct", "error", err)
 				return
 			}
 
-			var u users.User
-			row = db.DBPool.QueryRow(ctx, `SELECT id, username, email, verified, created_at, updated_at FROM users WHERE id = $1`, userId)
-			if err = row.Scan(&u.Id, &u.Username, &u.Email, &u.Verified, &u.CreatedAt, &u.UpdatedAt); err != nil {
+			permissions, err := userStore.Permissions(r.Context(), u.Id)
+			if err != nil {
 				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-				logger.Error("failed to parse userdata into struct", "error", err)
+				logger.Error("failed to load user permissions", "error", err, "user_id", u.Id)
 				return
 			}
 
+			// Handlers only get to see what identifies the session
+			session.Token = ""
+			session.Payload = ""
+
 			const userKey = users.UserContextKey("user")
-			ctx = context.WithValue(r.Context(), userKey, u)
+			const sessionKey = users.UserContextKey("session")
+			const permissionsKey = users.UserContextKey("permissions")
+			ctx := context.WithValue(r.Context(), userKey, u)
+			ctx = context.WithValue(ctx, sessionKey, *session)
+			ctx = context.WithValue(ctx, permissionsKey, permissions)
 
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
 
+// Rejects requests of users lacking the permission.
+// Has to be chained after IsAuthenticatedMiddleware.
+func RequirePermission(logger *slog.Logger, permission string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			permissions, ok := users.GetPermissionsFromContext(r.Context())
+			if !ok {
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+
+			if !permissions.Has(permission) {
+				user, _ := users.GetUserFromContext(r.Context())
+				logger.Warn("permission denied", "user_id", user.Id, "permission", permission, "path", r.URL.Path)
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Returns the token of an "Authorization: Bearer" header, if there is one
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, value, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || value == "" {
+		return "", false
+	}
+
+	return value, true
+}
+
+func cookieSession(w http.ResponseWriter, r *http.Request, tokens token.TokenStore, sessions token.SessionConfig, logger *slog.Logger) (*token.Token, error) {
+	cookie, err := r.Cookie("session_token")
+	if err != nil {
+		return nil, token.ErrTokenNotFound
+	}
+
+	session, err := tokens.Find(r.Context(), token.TypeSession, cookie.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	// Also ends sessions that outlived a since shortened lifetime
+	now := time.Now().UTC()
+	expiresAt := sessions.ExpiresAt(session.CreatedAt, now, session.Persistent)
+	if session.ExpiresAt.Before(now) || !expiresAt.After(now) {
+		return nil, token.ErrTokenExpired
+	}
+
+	// Only writes once a minute to keep the load down
+	renewed, err := tokens.TouchSession(r.Context(), session.Id, expiresAt)
+	if err != nil {
+		logger.Error("failed to extend session", "error", err)
+	}
+	if renewed {
+		session.ExpiresAt = expiresAt
+		csrfValue := ""
+		if csrfCookie, err := r.Cookie("csrf_token"); err == nil {
+			csrfValue = csrfCookie.Value
+		}
+		users.SetSessionCookies(w, cookie.Value, csrfValue, session.Persistent, expiresAt)
+	}
+
+	return session, nil
+}
+
+// Throttles requests per key, answering 429 once the limit is used up.
+// The name separates the counters of different routes sharing a key func.
+// If the store fails requests are let through rather than locking everyone out.
+func RateLimitMiddleware(logger *slog.Logger, store ratelimit.Store, name string, limit ratelimit.Limit, key ratelimit.KeyFunc) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			res, err := store.Take(r.Context(), name+":"+key(r), limit)
+			if err != nil {
+				logger.Error("failed to check rate limit", "error", err, "limit", name)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ratelimit.WriteHeaders(w, limit, res)
+			if !res.Allowed {
+				logger.Warn("rate limit exceeded", "limit", name, "path", r.URL.Path)
+				http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
 func CORSMiddleware() Middleware {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			w.Header().Add("Access-Control-Allow-Origin", "http://localhost:5173")
-			w.Header().Add("Access-Control-Allow-Methods", "GET,POST,OPTIONS")
+			w.Header().Add("Access-Control-Allow-Methods", "GET,POST,PATCH,DELETE,OPTIONS")
 			w.Header().Add("Access-Control-Allow-Headers", "Content-Type, Authorization, X-CSRF-Token")
 			w.Header().Add("Access-Control-Allow-Credentials", "true")
+			w.Header().Add("Access-Control-Expose-Headers", "Retry-After, RateLimit-Policy, RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset")
 
 			if r.Method == "OPTIONS" {
 				w.WriteHeader(http.StatusOK)
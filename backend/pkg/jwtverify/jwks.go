@@ -0,0 +1,134 @@
+// Package jwtverify checks the JWT access tokens issued by the auth backend
+// against the keys it publishes at /.well-known/jwks.json.
+//
+// Verifying is offline, so a token stays valid here until it expires even
+// if its login was revoked meanwhile. Ask the backend (e.g. GET /auth/status)
+// where acting on a revoked login for a few minutes is not acceptable.
+package jwtverify
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Value of the typ header, see RFC 9068
+const TokenType = "at+jwt"
+
+const (
+	AlgEdDSA = "EdDSA"
+	AlgRS256 = "RS256"
+)
+
+var ErrUnsupportedKey = errors.New("unsupported key type")
+
+// Claims of an access token. The subject is the user id.
+type Claims struct {
+	jwt.RegisteredClaims
+	// The login the token was issued for
+	SessionId string   `json:"sid"`
+	Username  string   `json:"username"`
+	Verified  bool     `json:"verified"`
+	Roles     []string `json:"roles"`
+}
+
+// A public key as published in a JWKS, see RFC 7517
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	// Ed25519 keys
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	// RSA keys
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// Describes an Ed25519 or RSA public key. An empty kid is replaced by the
+// keys thumbprint.
+func NewJWK(kid string, key crypto.PublicKey) (JWK, error) {
+	var k JWK
+	switch key := key.(type) {
+	case ed25519.PublicKey:
+		k = JWK{Kty: "OKP", Alg: AlgEdDSA, Crv: "Ed25519", X: b64(key)}
+	case *rsa.PublicKey:
+		k = JWK{Kty: "RSA", Alg: AlgRS256, N: b64(key.N.Bytes()), E: b64(big.NewInt(int64(key.E)).Bytes())}
+	default:
+		return JWK{}, ErrUnsupportedKey
+	}
+
+	k.Use = "sig"
+	k.Kid = kid
+	if k.Kid == "" {
+		k.Kid = k.Thumbprint()
+	}
+
+	return k, nil
+}
+
+// Returns the RFC 7638 thumbprint, the SHA-256 of the required members.
+func (k JWK) Thumbprint() string {
+	// Members in lexical order, as the RFC requires
+	var members any
+	switch k.Kty {
+	case "OKP":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{k.Crv, k.Kty, k.X}
+	default:
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{k.E, k.Kty, k.N}
+	}
+
+	// Can't fail for a struct of strings
+	data, _ := json.Marshal(members)
+	sum := sha256.Sum256(data)
+	return b64(sum[:])
+}
+
+// Decodes the public key, checking it fits the algorithm.
+func (k JWK) PublicKey() (crypto.PublicKey, error) {
+	switch {
+	case k.Kty == "OKP" && k.Crv == "Ed25519" && k.Alg == AlgEdDSA:
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key %q", k.Kid)
+		}
+		return ed25519.PublicKey(x), nil
+	case k.Kty == "RSA" && k.Alg == AlgRS256:
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RSA modulus of key %q", k.Kid)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("invalid RSA exponent of key %q", k.Kid)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	}
+
+	return nil, fmt.Errorf("%w: %s/%s", ErrUnsupportedKey, k.Kty, k.Alg)
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
@@ -0,0 +1,167 @@
+package jwtverify
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// Checks access tokens against a JWKS, safe for concurrent use.
+//
+//	v := jwtverify.NewVerifier("https://auth.example.com/.well-known/jwks.json", "https://auth.example.com", "")
+//	claims, err := v.Verify(ctx, strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+type Verifier struct {
+	// Where the keys are fetched from, empty for verifiers of fixed keys
+	URL string
+	// Required iss claim
+	Issuer string
+	// Required aud claim, not checked if empty
+	Audience string
+	Client   *http.Client
+	// Keys are fetched again once this old, so new ones are picked up
+	CacheTTL time.Duration
+	// Least time between two fetches, tokens of unknown keys fetch early
+	MinRefresh time.Duration
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	algs      map[string]string
+	fetchedAt time.Time
+}
+
+// Creates a verifier fetching the keys from jwksURL on first use.
+func NewVerifier(jwksURL, issuer, audience string) *Verifier {
+	return &Verifier{
+		URL:        jwksURL,
+		Issuer:     issuer,
+		Audience:   audience,
+		Client:     &http.Client{Timeout: 10 * time.Second},
+		CacheTTL:   time.Hour,
+		MinRefresh: time.Minute,
+	}
+}
+
+// Creates a verifier of fixed keys, which never fetches.
+func NewStaticVerifier(keys JWKS, issuer, audience string) (*Verifier, error) {
+	v := &Verifier{Issuer: issuer, Audience: audience}
+	if err := v.setKeys(keys); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// Checks the signature, expiry, issuer & audience of an access token and
+// returns its claims.
+func (v *Verifier) Verify(ctx context.Context, token string) (*Claims, error) {
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{AlgEdDSA, AlgRS256}),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuer(v.Issuer),
+	}
+	if v.Audience != "" {
+		options = append(options, jwt.WithAudience(v.Audience))
+	}
+
+	var claims Claims
+	_, err := jwt.ParseWithClaims(token, &claims, func(t *jwt.Token) (any, error) {
+		if typ, _ := t.Header["typ"].(string); typ != TokenType {
+			return nil, fmt.Errorf("unexpected token type %q", typ)
+		}
+
+		kid, _ := t.Header["kid"].(string)
+		return v.key(ctx, kid, t.Method.Alg())
+	}, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &claims, nil
+}
+
+// Returns the key of kid, fetching the keys if they are stale or don't
+// know kid yet. The key has to be meant for alg.
+func (v *Verifier) key(ctx context.Context, kid, alg string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	key, ok := v.keys[kid]
+	if v.URL != "" {
+		age := time.Since(v.fetchedAt)
+		if age > v.CacheTTL || (!ok && age > v.MinRefresh) {
+			if err := v.fetch(ctx); err != nil && !ok {
+				return nil, err
+			}
+			key, ok = v.keys[kid]
+		}
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, kid)
+	}
+	if v.algs[kid] != alg {
+		return nil, fmt.Errorf("key %q is not meant for %s", kid, alg)
+	}
+
+	return key, nil
+}
+
+func (v *Verifier) fetch(ctx context.Context) error {
+	// Also on failure, so an unreachable server isn't asked on every token
+	v.fetchedAt = time.Now()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.URL, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := v.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching %s: %s", v.URL, res.Status)
+	}
+
+	var keys JWKS
+	if err := json.NewDecoder(res.Body).Decode(&keys); err != nil {
+		return err
+	}
+
+	return v.setKeys(keys)
+}
+
+// Replaces the keys, skipping those of unsupported types
+func (v *Verifier) setKeys(keys JWKS) error {
+	v.keys = make(map[string]crypto.PublicKey)
+	v.algs = make(map[string]string)
+	for _, k := range keys.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := k.PublicKey()
+		if errors.Is(err, ErrUnsupportedKey) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		v.keys[k.Kid] = key
+		v.algs[k.Kid] = k.Alg
+	}
+
+	return nil
+}
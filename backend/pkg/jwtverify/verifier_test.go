@@ -0,0 +1,137 @@
+package jwtverify_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"fucku/pkg/jwtverify"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const issuer = "https://auth.example.com"
+
+func newKey(t *testing.T) (ed25519.PrivateKey, jwtverify.JWK) {
+	t.Helper()
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	jwk, err := jwtverify.NewJWK("", pub)
+	if err != nil {
+		t.Fatalf("failed to describe key: %v", err)
+	}
+
+	return priv, jwk
+}
+
+func sign(t *testing.T, key ed25519.PrivateKey, kid, typ string, expiresAt time.Time) string {
+	t.Helper()
+
+	tok := jwt.NewWithClaims(jwt.SigningMethodEdDSA, jwtverify.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    issuer,
+			Subject:   "4c8fc246-38a3-4605-8b1e-f42544e008b6",
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+		Username: "verifyuser",
+		Roles:    []string{"user"},
+	})
+	tok.Header["kid"] = kid
+	tok.Header["typ"] = typ
+
+	value, err := tok.SignedString(key)
+	if err != nil {
+		t.Fatalf("failed to sign: %v", err)
+	}
+
+	return value
+}
+
+func TestVerify(t *testing.T) {
+	key, jwk := newKey(t)
+	v, err := jwtverify.NewStaticVerifier(jwtverify.JWKS{Keys: []jwtverify.JWK{jwk}}, issuer, "")
+	if err != nil {
+		t.Fatalf("failed to create verifier: %v", err)
+	}
+
+	claims, err := v.Verify(context.Background(), sign(t, key, jwk.Kid, jwtverify.TokenType, time.Now().Add(time.Minute)))
+	if err != nil {
+		t.Fatalf("failed to verify: %v", err)
+	}
+	if claims.Subject != "4c8fc246-38a3-4605-8b1e-f42544e008b6" || claims.Username != "verifyuser" {
+		t.Errorf("unexpected claims: %+v", claims)
+	}
+
+	if _, err := v.Verify(context.Background(), sign(t, key, jwk.Kid, jwtverify.TokenType, time.Now().Add(-time.Minute))); !errors.Is(err, jwt.ErrTokenExpired) {
+		t.Errorf("expected an expired token to be rejected, got: %v", err)
+	}
+
+	if _, err := v.Verify(context.Background(), sign(t, key, jwk.Kid, "JWT", time.Now().Add(time.Minute))); err == nil {
+		t.Error("expected a token of another type to be rejected")
+	}
+
+	other, _ := newKey(t)
+	if _, err := v.Verify(context.Background(), sign(t, other, jwk.Kid, jwtverify.TokenType, time.Now().Add(time.Minute))); !errors.Is(err, jwt.ErrTokenSignatureInvalid) {
+		t.Errorf("expected a token of another key to be rejected, got: %v", err)
+	}
+
+	strict, _ := jwtverify.NewStaticVerifier(jwtverify.JWKS{Keys: []jwtverify.JWK{jwk}}, issuer, "billing")
+	if _, err := strict.Verify(context.Background(), sign(t, key, jwk.Kid, jwtverify.TokenType, time.Now().Add(time.Minute))); !errors.Is(err, jwt.ErrTokenInvalidClaims) {
+		t.Errorf("expected a token for another audience to be rejected, got: %v", err)
+	}
+}
+
+func TestVerifierFetchesNewKeys(t *testing.T) {
+	oldKey, oldJWK := newKey(t)
+	newPriv, newJWK := newKey(t)
+
+	var published atomic.Value
+	published.Store(jwtverify.JWKS{Keys: []jwtverify.JWK{oldJWK}})
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		json.NewEncoder(w).Encode(published.Load())
+	}))
+	defer server.Close()
+
+	v := jwtverify.NewVerifier(server.URL, issuer, "")
+	v.MinRefresh = 0
+
+	if _, err := v.Verify(context.Background(), sign(t, oldKey, oldJWK.Kid, jwtverify.TokenType, time.Now().Add(time.Minute))); err != nil {
+		t.Fatalf("failed to verify: %v", err)
+	}
+	if _, err := v.Verify(context.Background(), sign(t, oldKey, oldJWK.Kid, jwtverify.TokenType, time.Now().Add(time.Minute))); err != nil {
+		t.Fatalf("failed to verify: %v", err)
+	}
+	if fetches.Load() != 1 {
+		t.Errorf("expected the keys to be cached, fetched %d times", fetches.Load())
+	}
+
+	published.Store(jwtverify.JWKS{Keys: []jwtverify.JWK{newJWK, oldJWK}})
+	if _, err := v.Verify(context.Background(), sign(t, newPriv, newJWK.Kid, jwtverify.TokenType, time.Now().Add(time.Minute))); err != nil {
+		t.Errorf("expected a token of a new key to verify after fetching again, got: %v", err)
+	}
+
+	if _, err := v.Verify(context.Background(), sign(t, newPriv, "unknown", jwtverify.TokenType, time.Now().Add(time.Minute))); !errors.Is(err, jwtverify.ErrUnknownKey) {
+		t.Errorf("expected ErrUnknownKey, got: %v", err)
+	}
+}
+
+func TestThumbprint(t *testing.T) {
+	// Example of RFC 8037, appendix A.3
+	jwk := jwtverify.JWK{Kty: "OKP", Crv: "Ed25519", X: "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}
+	if got := jwk.Thumbprint(); got != "kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k" {
+		t.Errorf("unexpected thumbprint: %s", got)
+	}
+}
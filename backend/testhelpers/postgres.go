@@ -2,15 +2,25 @@ package testhelpers
 
 import (
 	"context"
-	"log"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	database "fucku/internal/database"
 
-	_ "github.com/lib/pq"
 	"github.com/testcontainers/testcontainers-go"
 	"github.com/testcontainers/testcontainers-go/modules/postgres"
 	"github.com/testcontainers/testcontainers-go/wait"
 )
 
-func SetupPostgres(ctx context.Context) {
+// Starts a throwaway Postgres container with all migrations applied. The
+// container is removed when the test ends, without Docker the test is skipped.
+func SetupPostgres(t *testing.T) *database.Database {
+	t.Helper()
+	testcontainers.SkipIfProviderIsNotHealthy(t)
+
+	ctx := context.Background()
 	dbName := "fucku_test"
 	dbUser := "postgres"
 	dbPassword := "postgres"
@@ -20,19 +30,40 @@ func SetupPostgres(ctx context.Context) {
 		postgres.WithDatabase(dbName),
 		postgres.WithUsername(dbUser),
 		postgres.WithPassword(dbPassword),
+		// The server restarts once after the init scripts, so wait for the second start
+		testcontainers.WithWaitStrategy(
+			wait.ForLog("database system is ready to accept connections").
+				WithOccurrence(2).
+				WithStartupTimeout(time.Minute),
+		),
 	)
-	defer func() {
+	t.Cleanup(func() {
 		if err := testcontainers.TerminateContainer(container); err != nil {
-			log.Printf("failed to terminate container: %s", err)
+			t.Logf("failed to terminate container: %s", err)
 		}
-	}()
+	})
 	if err != nil {
-		log.Printf("failed to start container: %s", err)
-		return
+		t.Fatalf("failed to start container: %s", err)
 	}
 
-	testcontainers.WithAdditionalWaitStrategy(
-		wait.ForLog("database system is ready to accept connections"),
-		wait.ForListeningPort("5432/tcp"),
-	)
+	connString, err := container.ConnectionString(ctx, "sslmode=disable")
+	if err != nil {
+		t.Fatalf("failed to get connection string: %s", err)
+	}
+
+	db, err := database.NewDatabase(connString)
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err)
+	}
+	t.Cleanup(db.DBPool.Close)
+
+	migrator, err := database.NewMigrator(slog.New(slog.NewTextHandler(io.Discard, nil)), db)
+	if err != nil {
+		t.Fatalf("failed to load migrations: %s", err)
+	}
+	if _, err := migrator.Up(ctx); err != nil {
+		t.Fatalf("failed to migrate: %s", err)
+	}
+
+	return db
 }